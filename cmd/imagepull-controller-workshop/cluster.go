@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/oklog/run"
+	koopercontroller "github.com/spotahome/kooper/v2/controller"
+	kooperlog "github.com/spotahome/kooper/v2/log"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/slok/imagepull-controller-workshop/internal/controller/drain"
+	controllernamespace "github.com/slok/imagepull-controller-workshop/internal/controller/namespace"
+	"github.com/slok/imagepull-controller-workshop/internal/log"
+	"github.com/slok/imagepull-controller-workshop/internal/metrics"
+	"github.com/slok/imagepull-controller-workshop/internal/notify"
+	storagekubernetes "github.com/slok/imagepull-controller-workshop/internal/storage/kubernetes"
+)
+
+// namespaceRepository is the repository used to get the namespaces of a cluster.
+type namespaceRepository interface {
+	ListNamespaces(ctx context.Context, options metav1.ListOptions) (*corev1.NamespaceList, error)
+	WatchNamespaces(ctx context.Context, options metav1.ListOptions) (watch.Interface, error)
+	GetNamespace(ctx context.Context, name string) (*corev1.Namespace, error)
+}
+
+// newNamespaceRepository returns the namespace repository of a cluster, on namespace scoped
+// mode only the configured namespaces are used, without listing them from the API server.
+func newNamespaceRepository(cmdCfg CmdConfig, repo storagekubernetes.Repository) (namespaceRepository, error) {
+	if len(cmdCfg.ScopedNamespaces) > 0 {
+		return storagekubernetes.NewNamespaceScopedRepository(repo, storagekubernetes.NamespaceScopedRepositoryConfig{
+			Namespaces:   cmdCfg.ScopedNamespaces,
+			PollInterval: cmdCfg.ScopedNamespacePollInterval,
+		})
+	}
+
+	return repo, nil
+}
+
+// namespaceController has the dependencies of the namespace controller of a cluster.
+type namespaceController struct {
+	// Cluster is the cluster name, empty for the cluster the controller is running on.
+	Cluster string
+	// K8sRepo is the repository of the cluster.
+	K8sRepo storagekubernetes.Repository
+	// HandlerK8sRepo is the repository used by the handler, gets the source resources from
+	// the source cluster and manages the resources on the cluster.
+	HandlerK8sRepo        controllernamespace.HandlerRepository
+	Retriever             koopercontroller.Retriever
+	Trigger               *controllernamespace.TriggerQueue
+	Rollout               *controllernamespace.Rollout
+	FanOut                *controllernamespace.FanOutTracker
+	Expressions           *controllernamespace.Expressions
+	RegistryAliases       controllernamespace.RegistryAliases
+	EventRecorder         controllernamespace.EventRecorder
+	MetricsRecorder       metrics.Recorder
+	KooperMetricsRecorder koopercontroller.MetricsRecorder
+	Notifier              notify.Notifier
+	Drainer               *drain.Drainer
+	Logger                log.Logger
+	KooperLogger          kooperlog.Logger
+}
+
+// addNamespaceController adds the namespace controller of a cluster and its self healer to
+// the run group. Returns the tracker of the controller reconcile results.
+func addNamespaceController(ctx context.Context, g *run.Group, cmdCfg CmdConfig, nc namespaceController) (*controllernamespace.ResultTracker, error) {
+	name, drainName := "imagepull-workshop-namespace", "namespace"
+	if nc.Cluster != "" {
+		name, drainName = name+"-"+nc.Cluster, drainName+"-"+nc.Cluster
+	}
+
+	// On namespace scoped mode, the namespaces can't be patched without cluster wide RBAC.
+	disableNamespaceStatus := cmdCfg.DisableNamespaceStatus || len(cmdCfg.ScopedNamespaces) > 0
+
+	handler, err := controllernamespace.NewHandler(controllernamespace.HandlerConfig{
+		RunningNamespace:            cmdCfg.NamespaceRunning,
+		ImagePullSecretName:         cmdCfg.SecretName,
+		SaImagePullSecretName:       cmdCfg.SaSecretName,
+		Resources:                   cmdCfg.Resources(),
+		ServiceAccountNames:         cmdCfg.ServiceAccounts,
+		ServiceAccountWaitDelay:     cmdCfg.ServiceAccountWait,
+		ConflictPolicy:              controllernamespace.ConflictPolicy(cmdCfg.ConflictPolicy),
+		ImmutableSecrets:            cmdCfg.ImmutableSecrets,
+		ImmutableSecretsGracePeriod: cmdCfg.ImmutableSecretsGracePeriod,
+		DisableNamespaceStatus:      disableNamespaceStatus,
+		LabelFilter:                 controllernamespace.MetadataFilter{Allow: cmdCfg.LabelAllow, Deny: cmdCfg.LabelDeny},
+		AnnotationFilter:            controllernamespace.MetadataFilter{Allow: cmdCfg.AnnotationAllow, Deny: cmdCfg.AnnotationDeny},
+		Rollout:                     nc.Rollout,
+		Expressions:                 nc.Expressions,
+		RegistryAliases:             nc.RegistryAliases,
+		K8sRepo:                     nc.HandlerK8sRepo,
+		EventRecorder:               nc.EventRecorder,
+		MetricsRecorder:             nc.MetricsRecorder,
+		Notifier:                    nc.Notifier,
+		Logger:                      nc.Logger,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create namespace controller handler: %w", err)
+	}
+
+	// The fan-out needs the handlings before the retries, the requeues are not handled yet.
+	if nc.FanOut != nil {
+		handler = nc.FanOut.NamespaceHandler(handler)
+	}
+
+	tracker := controllernamespace.NewResultTracker()
+	retryHandler, err := controllernamespace.NewRetryHandler(controllernamespace.RetryHandlerConfig{
+		Handler:          tracker.Handler(handler),
+		Trigger:          nc.Trigger,
+		MaxRetries:       cmdCfg.MaxRetries,
+		InitialBackoff:   cmdCfg.RetryBackoffInitial,
+		MaxBackoff:       cmdCfg.RetryBackoffMax,
+		Jitter:           cmdCfg.RetryBackoffJitter,
+		FailureThreshold: cmdCfg.NotifyFailureThreshold,
+		MetricsRecorder:  nc.MetricsRecorder,
+		Notifier:         nc.Notifier,
+		Logger:           nc.Logger,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create namespace controller retry handler: %w", err)
+	}
+
+	selfHealer, err := controllernamespace.NewSelfHealer(controllernamespace.SelfHealerConfig{
+		K8sRepo:    nc.K8sRepo,
+		Trigger:    nc.Trigger,
+		Namespaces: cmdCfg.ScopedNamespaces,
+		// The scoped namespaces are polled, the service accounts changes are watched instead.
+		ServiceAccounts: len(cmdCfg.ScopedNamespaces) > 0,
+		Logger:          nc.Logger,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create namespace self healer: %w", err)
+	}
+
+	// The controller and the triggered handlings use the same handler.
+	nsHandler := nc.Trigger.Handler(nc.Drainer.Handler(drainName, retryHandler))
+	ctrl, err := koopercontroller.New(&koopercontroller.Config{
+		Handler:              nsHandler,
+		Retriever:            nc.Retriever,
+		Logger:               nc.KooperLogger,
+		MetricsRecorder:      nc.KooperMetricsRecorder,
+		Name:                 name,
+		ConcurrentWorkers:    cmdCfg.Workers,
+		ProcessingJobRetries: 0, // Retries are managed by the retry handler.
+		ResyncInterval:       cmdCfg.ResyncInterval,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create namespace controller: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	g.Add(
+		func() error {
+			return ctrl.Run(ctx)
+		},
+		func(_ error) {
+			cancel()
+		},
+	)
+
+	g.Add(
+		func() error {
+			return nc.Trigger.Run(ctx, nsHandler)
+		},
+		func(_ error) {
+			cancel()
+		},
+	)
+
+	g.Add(
+		func() error {
+			return selfHealer.Run(ctx)
+		},
+		func(_ error) {
+			cancel()
+		},
+	)
+
+	return tracker, nil
+}
+
+const (
+	// targetClusterRetryInterval is the interval to retry the failed target clusters.
+	targetClusterRetryInterval = time.Minute
+	// targetClusterSyncTimeout is the max time to wait for the namespaces of a target
+	// cluster to be listed before considering the cluster failed.
+	targetClusterSyncTimeout = time.Minute
+	// targetClusterHealthCheckInterval is the interval to check the target clusters API.
+	targetClusterHealthCheckInterval = 30 * time.Second
+	// targetClusterHealthCheckTimeout is the timeout of a target cluster health check.
+	targetClusterHealthCheckTimeout = 10 * time.Second
+)
+
+// targetClusterController runs the namespace controller of a target cluster. The cluster
+// failures (e.g invalid kubeconfig, unreachable API) don't stop the application, they are
+// logged, measured and the cluster controller is retried in background, this way a failing
+// cluster doesn't stop the others.
+type targetClusterController struct {
+	Cluster   targetCluster
+	CmdConfig CmdConfig
+	// SourceK8sRepo is the source cluster repository, used to get the source resources and
+	// the kubeconfig secrets.
+	SourceK8sRepo *storagekubernetes.SecretCachedRepository
+	// Controller has the dependencies shared with the other clusters, the cluster ones are
+	// set on each run.
+	Controller namespaceController
+}
+
+// Run runs the target cluster controller until the context is done.
+func (t targetClusterController) Run(ctx context.Context) error {
+	for {
+		err := t.run(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		t.Controller.MetricsRecorder.SetClusterConnected(ctx, false)
+		t.Controller.Logger.Errorf("target cluster failed, retrying in %s: %s", targetClusterRetryInterval, err)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(targetClusterRetryInterval):
+		}
+	}
+}
+
+func (t targetClusterController) run(ctx context.Context) error {
+	kcfg, err := loadTargetClusterConfig(ctx, t.Cluster, t.SourceK8sRepo)
+	if err != nil {
+		return fmt.Errorf("could not load K8S configuration: %w", err)
+	}
+
+	kcli, err := kubernetes.NewForConfig(kcfg)
+	if err != nil {
+		return fmt.Errorf("could not create Kubernetes client: %w", err)
+	}
+
+	k8sRepo := storagekubernetes.NewRepository(kcli)
+	eventRecorder := storagekubernetes.NewEventRecorder(kcli, "imagepull-controller-workshop")
+	defer eventRecorder.Stop()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	nsRepo, err := newNamespaceRepository(t.CmdConfig, k8sRepo)
+	if err != nil {
+		return fmt.Errorf("could not create namespace repository: %w", err)
+	}
+	nsRetriever, err := controllernamespace.NewRetriever(ctx, nsRepo)
+	if err != nil {
+		return fmt.Errorf("could not create namespace controller retriever: %w", err)
+	}
+	retriever := &syncedRetriever{Retriever: nsRetriever}
+
+	trigger, err := controllernamespace.NewTriggerQueue(controllernamespace.TriggerQueueConfig{
+		K8sRepo: nsRepo,
+		Workers: t.CmdConfig.Workers,
+		Logger:  t.Controller.Logger,
+	})
+	if err != nil {
+		return fmt.Errorf("could not create namespace controller trigger queue: %w", err)
+	}
+
+	nc := t.Controller
+	nc.Cluster = t.Cluster.Name
+	nc.K8sRepo = k8sRepo
+	nc.HandlerK8sRepo = storagekubernetes.NewClusterRepository(k8sRepo, t.SourceK8sRepo, t.CmdConfig.NamespaceRunning)
+	nc.Retriever = retriever
+	nc.Trigger = trigger
+	nc.EventRecorder = eventRecorder
+
+	var g run.Group
+	_, err = addNamespaceController(ctx, &g, t.CmdConfig, nc)
+	if err != nil {
+		return err
+	}
+
+	// The controller informer retries an unreachable API forever, the cluster is connected
+	// once the namespaces are listed, and the API health is checked afterwards.
+	g.Add(
+		func() error {
+			syncCtx, syncCancel := context.WithTimeout(ctx, targetClusterSyncTimeout)
+			defer syncCancel()
+			if !cache.WaitForCacheSync(syncCtx.Done(), retriever.HasSynced) {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return fmt.Errorf("namespaces not synced after %s", targetClusterSyncTimeout)
+			}
+
+			t.Controller.MetricsRecorder.SetClusterConnected(ctx, true)
+			t.Controller.Logger.Infof("Propagating to %q target cluster", t.Cluster.Name)
+
+			t.checkHealth(ctx, kcli)
+			return nil
+		},
+		func(_ error) {
+			cancel()
+		},
+	)
+
+	return g.Run()
+}
+
+// checkHealth checks periodically the target cluster API until the context is done, setting
+// the cluster as disconnected while the API is not ready.
+func (t targetClusterController) checkHealth(ctx context.Context, kcli kubernetes.Interface) {
+	connected := true
+	ticker := time.NewTicker(targetClusterHealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		checkCtx, checkCancel := context.WithTimeout(ctx, targetClusterHealthCheckTimeout)
+		_, err := kcli.Discovery().RESTClient().Get().AbsPath("/readyz").DoRaw(checkCtx)
+		checkCancel()
+		if ctx.Err() != nil {
+			return
+		}
+
+		switch {
+		case err != nil && connected:
+			t.Controller.Logger.Warningf("target cluster API not ready: %s", err)
+		case err == nil && !connected:
+			t.Controller.Logger.Infof("target cluster API ready again")
+		}
+		connected = err == nil
+		t.Controller.MetricsRecorder.SetClusterConnected(ctx, connected)
+	}
+}
+
+// syncedRetriever is a retriever that knows when the resources have been listed completely
+// (all the pages) at least once, like the informer cache sync of the controller.
+type syncedRetriever struct {
+	koopercontroller.Retriever
+	synced int32
+}
+
+func (s *syncedRetriever) List(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+	obj, err := s.Retriever.List(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+
+	if l, err := meta.ListAccessor(obj); err == nil && l.GetContinue() == "" {
+		atomic.StoreInt32(&s.synced, 1)
+	}
+
+	return obj, nil
+}
+
+// HasSynced returns true if the resources have been listed.
+func (s *syncedRetriever) HasSynced() bool {
+	return atomic.LoadInt32(&s.synced) == 1
+}
+
+// loadTargetClusterConfig loads the Kubernetes configuration of a target cluster, the kubeconfig
+// secrets are get from the source repository.
+func loadTargetClusterConfig(ctx context.Context, cluster targetCluster, sourceRepo storagekubernetes.SourceRepository) (*rest.Config, error) {
+	var cfg *rest.Config
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: cluster.Context}
+
+	switch cluster.Source {
+	case targetClusterSourceSecret:
+		secret, err := sourceRepo.GetSecret(ctx, cluster.SecretNamespace, cluster.SecretName)
+		if err != nil {
+			return nil, fmt.Errorf("could not get kubeconfig secret: %w", err)
+		}
+
+		data, ok := secret.Data[cluster.SecretKey]
+		if !ok {
+			return nil, fmt.Errorf("kubeconfig secret missing %q key", cluster.SecretKey)
+		}
+
+		kubeConfig, err := clientcmd.Load(data)
+		if err != nil {
+			return nil, fmt.Errorf("could not load kubeconfig: %w", err)
+		}
+
+		cfg, err = clientcmd.NewDefaultClientConfig(*kubeConfig, overrides).ClientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("could not load configuration: %w", err)
+		}
+
+	default:
+		config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(&clientcmd.ClientConfigLoadingRules{ExplicitPath: cluster.KubeConfig}, overrides).ClientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("could not load configuration: %w", err)
+		}
+		cfg = config
+	}
+
+	// Set better cli rate limiter.
+	cfg.QPS = 100
+	cfg.Burst = 100
+
+	return cfg, nil
+}
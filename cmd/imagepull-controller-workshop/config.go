@@ -1,24 +1,113 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"gopkg.in/alecthomas/kingpin.v2"
 	"k8s.io/client-go/util/homedir"
+
+	controllernamespace "github.com/slok/imagepull-controller-workshop/internal/controller/namespace"
+	notifywebhook "github.com/slok/imagepull-controller-workshop/internal/notify/webhook"
+	"github.com/slok/imagepull-controller-workshop/internal/source/vault"
+	"github.com/slok/imagepull-controller-workshop/internal/tracing"
+)
+
+// Image pull credentials sources.
+const (
+	credentialsSourceKubernetes = "kubernetes"
+	credentialsSourceVault      = "vault"
+)
+
+// Commands.
+const (
+	commandRun       = "run"
+	commandPreflight = "preflight"
+	commandManifests = "manifests"
+)
+
+// Preflight modes.
+const (
+	preflightFail = "fail"
+	preflightWarn = "warn"
+	preflightSkip = "skip"
 )
 
 // CmdConfig represents the configuration of the command.
 type CmdConfig struct {
-	Development      bool
-	Debug            bool
-	Workers          int
-	KubeConfig       string
-	NamespaceRunning string
-	ResyncInterval   time.Duration
-	SecretName       string
-	SaSecretName     string
+	Command                        string
+	Flags                          []string
+	Development                    bool
+	Debug                          bool
+	Workers                        int
+	KubeConfig                     string
+	NamespaceRunning               string
+	ClusterName                    string
+	TargetClusters                 []string
+	ScopedNamespaces               []string
+	ScopedNamespacePollInterval    time.Duration
+	Preflight                      string
+	ResyncInterval                 time.Duration
+	ShutdownGracePeriod            time.Duration
+	MaxRetries                     int
+	RetryBackoffInitial            time.Duration
+	RetryBackoffMax                time.Duration
+	RetryBackoffJitter             float64
+	SecretName                     string
+	SaSecretName                   string
+	ReplicateSecrets               []string
+	ReplicatePullSecrets           []string
+	ReplicateConfigMaps            []string
+	ServiceAccounts                []string
+	ServiceAccountWait             time.Duration
+	ConflictPolicy                 string
+	ImmutableSecrets               bool
+	ImmutableSecretsGracePeriod    time.Duration
+	CanaryNamespaces               []string
+	CanaryVerificationPeriod       time.Duration
+	CanaryCheckInterval            time.Duration
+	VerifyRegistryCredentials      bool
+	RegistryVerifyTimeout          time.Duration
+	CredentialsExpiryThresholds    []time.Duration
+	CredentialsExpiryCheckInterval time.Duration
+	RejectExpiredCredentials       bool
+	DisableNamespaceStatus         bool
+	LabelAllow                     []string
+	LabelDeny                      []string
+	AnnotationAllow                []string
+	AnnotationDeny                 []string
+	RegistryAliases                []string
+	DockerHubAliases               bool
+	SelectExpression               string
+	SecretNameExpression           string
+	ServiceAccountsExpression      string
+	MetricsListenAddr              string
+	MetricsPath                    string
+	TracingExporter                string
+	TracingOTLPEndpoint            string
+	TracingOTLPInsecure            bool
+	AdminListenAddr                string
+	AdminToken                     string
+	PprofListenAddr                string
+	NotifyWebhookURLs              []string
+	NotifySlackWebhookURLs         []string
+	NotifyDebounce                 time.Duration
+	NotifyMaxDelay                 time.Duration
+	NotifyFailureThreshold         int
+	CredentialsSource              string
+	VaultAddress                   string
+	VaultKVMount                   string
+	VaultPath                      string
+	VaultAuthMethod                string
+	VaultToken                     string
+	VaultKubernetesRole            string
+	VaultKubernetesAuthMount       string
+	VaultPollInterval              time.Duration
+	ManifestsName                  string
+	ManifestsImage                 string
 }
 
 // NewCmdConfig returns a new command configuration.
@@ -28,19 +117,290 @@ func NewCmdConfig() (*CmdConfig, error) {
 	c := &CmdConfig{}
 	app := kingpin.New("imagepullsecret-controller", "A Kubernetes controller to spread imagepullsecrets on namespaces.")
 
+	app.Command(commandRun, "Run the controller.").Default()
+	app.Command(commandPreflight, "Check the RBAC permissions and configuration required by the controller and exit.")
+	manifestsCmd := app.Command(commandManifests, "Render the Kubernetes manifests (RBAC, deployment...) required by the controller with the configuration and exit.")
+	manifestsCmd.Flag("name", "the name of the rendered resources.").Default("imagepull-controller-workshop").StringVar(&c.ManifestsName)
+	manifestsCmd.Flag("image", "the controller container image.").Default("slok/imagepull-controller-workshop:latest").StringVar(&c.ManifestsImage)
+
 	app.Flag("debug", "Enable debug mode.").BoolVar(&c.Debug)
 	app.Flag("development", "Enable development mode.").BoolVar(&c.Development)
 	app.Flag("kube-config", "kubernetes configuration path, only used when development mode enabled.").Default(kubeHome).Short('c').StringVar(&c.KubeConfig)
 	app.Flag("namespace-running", "kubernetes namespace where the controller is running.").Short('r').Required().StringVar(&c.NamespaceRunning)
+	app.Flag("cluster-name", "the name of the cluster where the controller is running, used on the metrics and logs.").Default("local").StringVar(&c.ClusterName)
+	app.Flag("target-cluster", "extra cluster where the resources will be propagated from the running ns, in `name=kubeconfig:path[#context]`, `name=context:context` (from the kube-config) or `name=secret:namespace/name[/key][#context]` format (can be repeated).").StringsVar(&c.TargetClusters)
+	app.Flag("scoped-namespace", "namespace where the resources will be propagated, instead of all the cluster namespaces, so it doesn't need cluster wide RBAC. The namespaces are polled instead of watched and the status is not written (can be repeated, enables the namespace scoped mode).").StringsVar(&c.ScopedNamespaces)
+	app.Flag("scoped-namespace-poll-interval", "the interval the scoped namespaces are polled for changes on the namespace scoped mode.").Default("30s").DurationVar(&c.ScopedNamespacePollInterval)
+	app.Flag("preflight", "what to do when the RBAC permissions and configuration preflight checks fail on startup.").Default(preflightFail).EnumVar(&c.Preflight, preflightFail, preflightWarn, preflightSkip)
 	app.Flag("workers", "concurrent processing workers for each kubernetes controller.").Default("5").Short('w').IntVar(&c.Workers)
 	app.Flag("resync-interval", "the duration between resync the controllers resources.").Default("5m").DurationVar(&c.ResyncInterval)
+	app.Flag("shutdown-grace-period", "the max duration to wait for the in-flight handlings to finish when shutting down.").Default("30s").DurationVar(&c.ShutdownGracePeriod)
+	app.Flag("max-retries", "the max number of retries when handling a resource fails with a transient error.").Default("5").IntVar(&c.MaxRetries)
+	app.Flag("retry-backoff-initial", "the backoff duration used on the first retry, it will increase exponentially.").Default("1s").DurationVar(&c.RetryBackoffInitial)
+	app.Flag("retry-backoff-max", "the max backoff duration between retries.").Default("5m").DurationVar(&c.RetryBackoffMax)
+	app.Flag("retry-backoff-jitter", "the jitter factor [0, 1) applied to the retries backoff.").Default("0.2").Float64Var(&c.RetryBackoffJitter)
 	app.Flag("secret-name", "the secret name in the running ns that has the image pull credentials.").Default("image-pull-secret").StringVar(&c.SecretName)
 	app.Flag("sa-secret-name", "the clone secret name taht will reference the default service account.").Default("image-pull-secret").StringVar(&c.SaSecretName)
+	app.Flag("replicate-secret", "extra secret (any type) in the running ns that will be replicated on the namespaces, in `name[:target-name]` format (can be repeated).").StringsVar(&c.ReplicateSecrets)
+	app.Flag("replicate-image-pull-secret", "extra image pull secret in the running ns that will be replicated on the namespaces and referenced by the service accounts, in `name[:target-name]` format (can be repeated).").StringsVar(&c.ReplicatePullSecrets)
+	app.Flag("replicate-configmap", "configmap in the running ns that will be replicated on the namespaces, in `name[:target-name]` format (can be repeated).").StringsVar(&c.ReplicateConfigMaps)
+	app.Flag("service-account", "the service account names that will reference the clone secret on each namespace (can be repeated).").Default("default").StringsVar(&c.ServiceAccounts)
+
+	app.Flag("service-account-wait-delay", "the delay to retry a namespace when its service accounts have not been created yet.").Default("5s").DurationVar(&c.ServiceAccountWait)
+	app.Flag("conflict-policy", "the policy used when a secret not managed by the controller already exists on a namespace.").Default(string(controllernamespace.ConflictPolicySkip)).EnumVar(&c.ConflictPolicy, conflictPolicies()...)
+	app.Flag("immutable-secrets", "replicate the image pull secrets as immutable secrets named with their content hash, switching the service accounts on every change (blue/green).").BoolVar(&c.ImmutableSecrets)
+	app.Flag("immutable-secrets-gc-grace-period", "the duration the replaced immutable secrets are kept before being garbage collected.").Default("1h").DurationVar(&c.ImmutableSecretsGracePeriod)
+	app.Flag("canary-namespace", "namespace that gets the image pull secret source changes first, the rest get them once verified (can be repeated, enables the canary rollout).").StringsVar(&c.CanaryNamespaces)
+	app.Flag("canary-verification-period", "the duration the canary namespaces need to be verified before promoting the image pull secret changes.").Default("5m").DurationVar(&c.CanaryVerificationPeriod)
+	app.Flag("canary-check-interval", "the interval between canary namespaces verifications.").Default("30s").DurationVar(&c.CanaryCheckInterval)
+	app.Flag("verify-registry-credentials", "verify the image pull secret source credentials against their registries (v2 auth flow) before accepting them.").BoolVar(&c.VerifyRegistryCredentials)
+	app.Flag("registry-verify-timeout", "the timeout of the registry requests used to verify the credentials.").Default("10s").DurationVar(&c.RegistryVerifyTimeout)
+	app.Flag("credentials-expiry-threshold", "the time to expiry of the source credentials that triggers a warning (can be repeated).").Default("168h", "24h").DurationListVar(&c.CredentialsExpiryThresholds)
+	app.Flag("credentials-expiry-check-interval", "the interval to check the source credentials expiry against the thresholds.").Default("5m").DurationVar(&c.CredentialsExpiryCheckInterval)
+	app.Flag("reject-expired-credentials", "don't propagate the source credentials that are already expired, the cached ones are evicted when they expire.").BoolVar(&c.RejectExpiredCredentials)
+	app.Flag("disable-namespace-status", "disable writing the sync status annotations on the namespaces.").BoolVar(&c.DisableNamespaceStatus)
+	app.Flag("label-allow", "the label keys that will be propagated to the secret copies, if none, all allowed (can be repeated, `*` suffix for prefixes).").StringsVar(&c.LabelAllow)
+	app.Flag("label-deny", "the label keys that will not be propagated to the secret copies (can be repeated, `*` suffix for prefixes).").Default(controllernamespace.DefaultLabelDenyList...).StringsVar(&c.LabelDeny)
+	app.Flag("annotation-allow", "the annotation keys that will be propagated to the secret copies, if none, all allowed (can be repeated, `*` suffix for prefixes).").StringsVar(&c.AnnotationAllow)
+	app.Flag("annotation-deny", "the annotation keys that will not be propagated to the secret copies (can be repeated, `*` suffix for prefixes).").Default(controllernamespace.DefaultAnnotationDenyList...).StringsVar(&c.AnnotationDeny)
+	app.Flag("registry-alias", "registry aliases (e.g mirrors) that will get the same credentials on the docker config JSON secret copies, in `registry=alias1,alias2` format (can be repeated).").StringsVar(&c.RegistryAliases)
+	app.Flag("docker-hub-aliases", "expand the Docker Hub credentials with all the Docker Hub canonical forms on the docker config JSON secret copies.").BoolVar(&c.DockerHubAliases)
+	app.Flag("select-expression", "CEL expression returning a bool to select the handled namespaces (vars: object, name, labels, annotations).").StringVar(&c.SelectExpression)
+	app.Flag("secret-name-expression", "CEL expression returning the image pull secret name of each namespace, empty for the default (vars: object, name, labels, annotations).").StringVar(&c.SecretNameExpression)
+	app.Flag("service-accounts-expression", "CEL expression returning the service accounts list of each namespace, empty for the default (vars: object, name, labels, annotations).").StringVar(&c.ServiceAccountsExpression)
+	app.Flag("metrics-listen-address", "the address where the metrics will be served.").Default(":8081").StringVar(&c.MetricsListenAddr)
+	app.Flag("metrics-path", "the path where the metrics will be served.").Default("/metrics").StringVar(&c.MetricsPath)
 
-	_, err := app.Parse(os.Args[1:])
+	app.Flag("tracing-exporter", "the exporter used for the traces.").Default(string(tracing.ExporterNone)).EnumVar(&c.TracingExporter, tracingExporters()...)
+	app.Flag("tracing-otlp-endpoint", "the OTLP HTTP collector endpoint used with the OTLP tracing exporter.").Default("localhost:4318").StringVar(&c.TracingOTLPEndpoint)
+	app.Flag("tracing-otlp-insecure", "disable TLS on the OTLP HTTP collector connection.").BoolVar(&c.TracingOTLPInsecure)
+
+	app.Flag("admin-listen-address", "the address where the admin API of the running cluster (target clusters not included) will be served, if empty, disabled.").StringVar(&c.AdminListenAddr)
+	app.Flag("admin-token", "the bearer token required by the admin API.").Envar("ADMIN_TOKEN").StringVar(&c.AdminToken)
+	app.Flag("pprof-listen-address", "the address where the pprof endpoints will be served without authentication, use a loopback address (e.g `127.0.0.1:6060`), if empty, disabled.").StringVar(&c.PprofListenAddr)
+
+	app.Flag("notify-webhook-url", "webhook URL where the notifications will be sent in generic JSON format (can be repeated).").StringsVar(&c.NotifyWebhookURLs)
+	app.Flag("notify-slack-webhook-url", "Slack incoming webhook URL where the notifications will be sent (can be repeated).").StringsVar(&c.NotifySlackWebhookURLs)
+	app.Flag("notify-debounce", "the duration without new events that will send the batched notifications.").Default("30s").DurationVar(&c.NotifyDebounce)
+	app.Flag("notify-max-delay", "the max duration the batched notifications will wait before being sent.").Default("5m").DurationVar(&c.NotifyMaxDelay)
+	app.Flag("notify-failure-threshold", "the consecutive handling failures of a namespace that will notify its propagation is failing.").Default("3").IntVar(&c.NotifyFailureThreshold)
+
+	app.Flag("credentials-source", "the source of the image pull credentials secret.").Default(credentialsSourceKubernetes).EnumVar(&c.CredentialsSource, credentialsSourceKubernetes, credentialsSourceVault)
+	app.Flag("vault-address", "the Vault server address, used with the Vault credentials source.").Envar("VAULT_ADDR").StringVar(&c.VaultAddress)
+	app.Flag("vault-kv-mount", "the Vault KV v2 secrets engine mount path.").Default("secret").StringVar(&c.VaultKVMount)
+	app.Flag("vault-path", "the Vault KV v2 path of the image pull credentials.").StringVar(&c.VaultPath)
+	app.Flag("vault-auth-method", "the Vault auth method.").Default(string(vault.AuthMethodToken)).EnumVar(&c.VaultAuthMethod, vaultAuthMethods()...)
+	app.Flag("vault-token", "the Vault token used with the token auth method.").Envar("VAULT_TOKEN").StringVar(&c.VaultToken)
+	app.Flag("vault-kubernetes-role", "the Vault role used with the kubernetes auth method.").StringVar(&c.VaultKubernetesRole)
+	app.Flag("vault-kubernetes-auth-mount", "the Vault kubernetes auth method mount path.").Default("kubernetes").StringVar(&c.VaultKubernetesAuthMount)
+	app.Flag("vault-poll-interval", "the interval to check for new versions of the Vault credentials.").Default("1m").DurationVar(&c.VaultPollInterval)
+
+	cmd, err := app.Parse(os.Args[1:])
 	if err != nil {
 		return nil, err
 	}
+	c.Command = cmd
+
+	flags, err := appFlags(app, os.Args[1:])
+	if err != nil {
+		return nil, err
+	}
+	c.Flags = flags
 
 	return c, nil
 }
+
+// appFlags returns the application flags (not the command ones) as they were received, this way
+// the same configuration can be rendered on the manifests.
+func appFlags(app *kingpin.Application, args []string) ([]string, error) {
+	pctx, err := app.ParseContext(args)
+	if err != nil {
+		return nil, err
+	}
+
+	appFlagNames := map[string]bool{}
+	for _, f := range app.Model().Flags {
+		appFlagNames[f.Name] = true
+	}
+
+	flags := []string{}
+	for _, e := range pctx.Elements {
+		clause, ok := e.Clause.(*kingpin.FlagClause)
+		if !ok || e.Value == nil {
+			continue
+		}
+
+		f := clause.Model()
+		if !appFlagNames[f.Name] {
+			continue
+		}
+
+		// Bool flags don't accept values.
+		if f.IsBoolFlag() {
+			if *e.Value == "true" {
+				flags = append(flags, "--"+f.Name)
+			} else {
+				flags = append(flags, "--no-"+f.Name)
+			}
+			continue
+		}
+
+		flags = append(flags, fmt.Sprintf("--%s=%s", f.Name, *e.Value))
+	}
+
+	return flags, nil
+}
+
+// Target cluster kubeconfig sources.
+const (
+	targetClusterSourceKubeconfig = "kubeconfig"
+	targetClusterSourceContext    = "context"
+	targetClusterSourceSecret     = "secret"
+)
+
+// targetCluster is a cluster, besides the one the controller is running on, where the
+// resources are propagated.
+type targetCluster struct {
+	Name   string
+	Source string
+	// KubeConfig is the kubeconfig file path, used with the kubeconfig and context sources.
+	KubeConfig string
+	// SecretNamespace, SecretName and SecretKey identify the secret that has the kubeconfig,
+	// used with the secret source.
+	SecretNamespace string
+	SecretName      string
+	SecretKey       string
+	Context         string
+}
+
+// TargetClustersConfig returns the extra clusters where the resources will be propagated.
+func (c CmdConfig) TargetClustersConfig() ([]targetCluster, error) {
+	clusters := []targetCluster{}
+	names := map[string]struct{}{c.ClusterName: {}}
+	for _, tc := range c.TargetClusters {
+		parts := strings.SplitN(tc, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid %q target cluster, `name=source:value` format required", tc)
+		}
+		if _, ok := names[parts[0]]; ok {
+			return nil, fmt.Errorf("duplicated %q cluster name", parts[0])
+		}
+		names[parts[0]] = struct{}{}
+
+		source := strings.SplitN(parts[1], ":", 2)
+		if len(source) != 2 || source[1] == "" {
+			return nil, fmt.Errorf("invalid %q target cluster, `name=source:value` format required", tc)
+		}
+
+		cluster := targetCluster{Name: parts[0], Source: source[0]}
+		value := source[1]
+		if i := strings.LastIndex(value, "#"); i >= 0 {
+			value, cluster.Context = value[:i], value[i+1:]
+		}
+
+		switch cluster.Source {
+		case targetClusterSourceKubeconfig:
+			cluster.KubeConfig = value
+		case targetClusterSourceContext:
+			cluster.KubeConfig, cluster.Context = c.KubeConfig, value
+		case targetClusterSourceSecret:
+			secret := strings.Split(value, "/")
+			if len(secret) < 2 || len(secret) > 3 || secret[0] == "" || secret[1] == "" {
+				return nil, fmt.Errorf("invalid %q target cluster secret, `namespace/name[/key]` format required", tc)
+			}
+			cluster.SecretNamespace, cluster.SecretName, cluster.SecretKey = secret[0], secret[1], "kubeconfig"
+			if len(secret) == 3 && secret[2] != "" {
+				cluster.SecretKey = secret[2]
+			}
+		default:
+			return nil, fmt.Errorf("invalid %q target cluster source, one of %q, %q or %q required", cluster.Source, targetClusterSourceKubeconfig, targetClusterSourceContext, targetClusterSourceSecret)
+		}
+
+		clusters = append(clusters, cluster)
+	}
+
+	return clusters, nil
+}
+
+// Resources returns the extra resources that will be replicated.
+func (c CmdConfig) Resources() []controllernamespace.Resource {
+	res := []controllernamespace.Resource{}
+	for _, r := range c.ReplicateSecrets {
+		name, target := splitResourceName(r)
+		res = append(res, controllernamespace.Resource{Kind: controllernamespace.ResourceKindSecret, Name: name, TargetName: target})
+	}
+	for _, r := range c.ReplicatePullSecrets {
+		name, target := splitResourceName(r)
+		res = append(res, controllernamespace.Resource{Kind: controllernamespace.ResourceKindSecret, Name: name, TargetName: target, ImagePullSecret: true})
+	}
+	for _, r := range c.ReplicateConfigMaps {
+		name, target := splitResourceName(r)
+		res = append(res, controllernamespace.Resource{Kind: controllernamespace.ResourceKindConfigMap, Name: name, TargetName: target})
+	}
+
+	return res
+}
+
+// RegistryAliasesConfig returns the registry aliases used to expand the docker config JSON secrets.
+func (c CmdConfig) RegistryAliasesConfig() (controllernamespace.RegistryAliases, error) {
+	aliases := map[string][]string{}
+	for _, ra := range c.RegistryAliases {
+		parts := strings.SplitN(ra, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return controllernamespace.RegistryAliases{}, fmt.Errorf("invalid %q registry alias, `registry=alias1,alias2` format required", ra)
+		}
+
+		for _, alias := range strings.Split(parts[1], ",") {
+			if alias = strings.TrimSpace(alias); alias != "" {
+				aliases[parts[0]] = append(aliases[parts[0]], alias)
+			}
+		}
+	}
+
+	return controllernamespace.RegistryAliases{Aliases: aliases, DockerHub: c.DockerHubAliases}, nil
+}
+
+// NotifyTargets returns the webhooks where the notifications will be sent.
+func (c CmdConfig) NotifyTargets() []notifywebhook.Target {
+	targets := []notifywebhook.Target{}
+	for _, u := range c.NotifyWebhookURLs {
+		targets = append(targets, notifywebhook.Target{URL: u, Format: notifywebhook.FormatGeneric})
+	}
+	for _, u := range c.NotifySlackWebhookURLs {
+		targets = append(targets, notifywebhook.Target{URL: u, Format: notifywebhook.FormatSlack})
+	}
+
+	return targets
+}
+
+func splitResourceName(s string) (name, target string) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return parts[0], ""
+}
+
+func conflictPolicies() []string {
+	ps := []string{}
+	for _, p := range controllernamespace.ConflictPolicies {
+		ps = append(ps, string(p))
+	}
+	return ps
+}
+
+func tracingExporters() []string {
+	es := []string{}
+	for _, e := range tracing.Exporters {
+		es = append(es, string(e))
+	}
+	return es
+}
+
+func vaultAuthMethods() []string {
+	ms := []string{}
+	for _, m := range vault.AuthMethods {
+		ms = append(ms, string(m))
+	}
+	return ms
+}
@@ -4,27 +4,41 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
 	"github.com/oklog/run"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	koopercontroller "github.com/spotahome/kooper/v2/controller"
 	kooperlog "github.com/spotahome/kooper/v2/log/logrus"
+	kooperprometheus "github.com/spotahome/kooper/v2/metrics/prometheus"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 
+	"github.com/slok/imagepull-controller-workshop/internal/admin"
+	"github.com/slok/imagepull-controller-workshop/internal/controller/drain"
 	controllernamespace "github.com/slok/imagepull-controller-workshop/internal/controller/namespace"
 	controllersecretcache "github.com/slok/imagepull-controller-workshop/internal/controller/secretcache"
+	"github.com/slok/imagepull-controller-workshop/internal/log"
 	loglogrus "github.com/slok/imagepull-controller-workshop/internal/log/logrus"
+	metricsprometheus "github.com/slok/imagepull-controller-workshop/internal/metrics/prometheus"
+	"github.com/slok/imagepull-controller-workshop/internal/notify"
+	notifywebhook "github.com/slok/imagepull-controller-workshop/internal/notify/webhook"
+	"github.com/slok/imagepull-controller-workshop/internal/preflight"
+	"github.com/slok/imagepull-controller-workshop/internal/registry"
+	"github.com/slok/imagepull-controller-workshop/internal/source/vault"
 	storagekubernetes "github.com/slok/imagepull-controller-workshop/internal/storage/kubernetes"
+	"github.com/slok/imagepull-controller-workshop/internal/tracing"
 )
 
 // Run runs the main application.
-func Run(ctx context.Context, stdin io.Writer, stdout, stderr io.Reader) error {
+func Run(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer) error {
 	// Load command flags and arguments.
 	cmdCfg, err := NewCmdConfig()
 	if err != nil {
@@ -40,6 +54,44 @@ func Run(ctx context.Context, stdin io.Writer, stdout, stderr io.Reader) error {
 		logrusLog.SetLevel(logrus.DebugLevel)
 	}
 
+	// Set up metrics.
+	promReg := prometheus.NewRegistry()
+	promReg.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	metricsRecorder := metricsprometheus.NewRecorder(prometheus.WrapRegistererWith(prometheus.Labels{"cluster": cmdCfg.ClusterName}, promReg))
+	kooperMetricsRecorder := kooperprometheus.New(kooperprometheus.Config{Registerer: promReg})
+
+	// Set up tracing.
+	tracingShutdown, err := tracing.Setup(ctx, tracing.Config{
+		Exporter:     tracing.Exporter(cmdCfg.TracingExporter),
+		OTLPEndpoint: cmdCfg.TracingOTLPEndpoint,
+		OTLPInsecure: cmdCfg.TracingOTLPInsecure,
+		Writer:       stdout,
+	})
+	if err != nil {
+		return fmt.Errorf("could not set up tracing: %w", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err := tracingShutdown(ctx)
+		if err != nil {
+			logger.Errorf("could not shutdown tracing: %s", err)
+		}
+	}()
+
+	targetClusters, err := cmdCfg.TargetClustersConfig()
+	if err != nil {
+		return fmt.Errorf("invalid target clusters: %w", err)
+	}
+
+	// Render the manifests, doesn't need the Kubernetes clients.
+	if cmdCfg.Command == commandManifests {
+		return renderManifests(*cmdCfg, targetClusters, stdout)
+	}
+
 	// Load Kubernetes clients.
 	logger.Infof("loading Kubernetes configuration...")
 	kcfg, err := loadKubernetesConfig(*cmdCfg)
@@ -54,7 +106,43 @@ func Run(ctx context.Context, stdin io.Writer, stdout, stderr io.Reader) error {
 
 	// Create dependencies
 	k8sRepo := storagekubernetes.NewRepository(kcli)
-	cachedSecretK8sRepo := storagekubernetes.NewSecretCachedRepository(k8sRepo)
+	cachedSecretK8sRepo := storagekubernetes.NewSecretCachedRepository(k8sRepo, cmdCfg.NamespaceRunning, []string{cmdCfg.SecretName})
+	eventRecorder := storagekubernetes.NewEventRecorder(kcli, "imagepull-controller-workshop")
+	defer eventRecorder.Stop()
+
+	// Preflight checks.
+	if cmdCfg.Command == commandPreflight {
+		local, targets := runPreflight(ctx, *cmdCfg, k8sRepo, targetClusters, logger)
+		failed := false
+		for _, r := range append([]preflight.Report{local}, targets...) {
+			fmt.Fprint(stdout, r.String())
+			failed = failed || r.Failed()
+		}
+		if failed {
+			return fmt.Errorf("preflight checks failed")
+		}
+		return nil
+	}
+
+	if cmdCfg.Preflight != preflightSkip {
+		local, targets := runPreflight(ctx, *cmdCfg, k8sRepo, targetClusters, logger)
+		if local.Failed() {
+			if cmdCfg.Preflight == preflightFail {
+				return fmt.Errorf("preflight checks failed:\n%s", local)
+			}
+			logger.Warningf("preflight checks failed:\n%s", local)
+		}
+
+		// The target clusters are isolated, their failures don't stop the controller.
+		for _, r := range targets {
+			if r.Failed() {
+				logger.Warningf("preflight checks failed:\n%s", r)
+			}
+		}
+	}
+
+	// Track the handlings so we can wait for them on shutdown.
+	drainer := drain.NewDrainer(logger)
 
 	// Prepare our run entrypoints.
 	var g run.Group
@@ -81,42 +169,285 @@ func Run(ctx context.Context, stdin io.Writer, stdout, stderr io.Reader) error {
 		)
 	}
 
+	// Metrics HTTP server.
+	{
+		mux := http.NewServeMux()
+		mux.Handle(cmdCfg.MetricsPath, promhttp.HandlerFor(promReg, promhttp.HandlerOpts{}))
+		server := &http.Server{
+			Addr:    cmdCfg.MetricsListenAddr,
+			Handler: mux,
+		}
+
+		g.Add(
+			func() error {
+				logger.Infof("metrics server listening on %s", cmdCfg.MetricsListenAddr)
+				return server.ListenAndServe()
+			},
+			func(_ error) {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				err := server.Shutdown(ctx)
+				if err != nil {
+					logger.Errorf("error shutting down metrics server: %s", err)
+				}
+			},
+		)
+	}
+
+	// Notifications.
+	var notifier notify.Notifier = notify.Noop
+	if targets := cmdCfg.NotifyTargets(); len(targets) > 0 {
+		webhookNotifier, err := notifywebhook.NewNotifier(notifywebhook.Config{
+			Targets:  targets,
+			Debounce: cmdCfg.NotifyDebounce,
+			MaxDelay: cmdCfg.NotifyMaxDelay,
+			Logger:   logger,
+		})
+		if err != nil {
+			return fmt.Errorf("could not create webhook notifier: %w", err)
+		}
+		notifier = webhookNotifier
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		g.Add(
+			func() error {
+				return webhookNotifier.Run(ctx)
+			},
+			func(_ error) {
+				cancel()
+			},
+		)
+	}
+
 	// Main controller for namespaces.
+	var rollout *controllernamespace.Rollout
+	var fanOut *controllernamespace.FanOutTracker
 	{
 		ctx, cancel := context.WithCancel(ctx)
 		defer cancel()
-		handler, err := controllernamespace.NewHandler(controllernamespace.HandlerConfig{
-			RunningNamespace:      cmdCfg.NamespaceRunning,
-			ImagePullSecretName:   cmdCfg.SecretName,
-			SaImagePullSecretName: cmdCfg.SaSecretName,
-			K8sRepo:               cachedSecretK8sRepo,
-			Logger:                logger,
+		nsRepo, err := newNamespaceRepository(*cmdCfg, k8sRepo)
+		if err != nil {
+			return fmt.Errorf("could not create namespace repository: %w", err)
+		}
+		nsRetriever, err := controllernamespace.NewRetriever(ctx, nsRepo)
+		if err != nil {
+			return fmt.Errorf("could not create namespace controller retriever: %w", err)
+		}
+
+		trigger, err := controllernamespace.NewTriggerQueue(controllernamespace.TriggerQueueConfig{
+			K8sRepo: nsRepo,
+			Workers: cmdCfg.Workers,
+			Logger:  logger,
 		})
 		if err != nil {
-			return fmt.Errorf("could not create namespace controller handler: %w", err)
+			return fmt.Errorf("could not create namespace controller trigger queue: %w", err)
 		}
 
-		retriever, err := controllernamespace.NewRetriever(k8sRepo)
+		fanOut, err = controllernamespace.NewFanOutTracker(controllernamespace.FanOutTrackerConfig{
+			SecretNamespace: cmdCfg.NamespaceRunning,
+			SecretName:      cmdCfg.SecretName,
+			K8sRepo:         nsRepo,
+			Notifier:        notifier,
+			Logger:          logger,
+		})
 		if err != nil {
-			return fmt.Errorf("could not create namespace controller retriever: %w", err)
+			return fmt.Errorf("could not create namespace fan-out tracker: %w", err)
 		}
 
-		ctrl, err := koopercontroller.New(&koopercontroller.Config{
-			Handler:              handler,
-			Retriever:            retriever,
-			Logger:               kooperLogger,
-			Name:                 "imagepull-workshop-namespace",
-			ConcurrentWorkers:    cmdCfg.Workers,
-			ProcessingJobRetries: 2,
-			ResyncInterval:       cmdCfg.ResyncInterval,
+		g.Add(
+			func() error {
+				return fanOut.Run(ctx)
+			},
+			func(_ error) {
+				cancel()
+			},
+		)
+
+		if len(cmdCfg.CanaryNamespaces) > 0 {
+			rollout, err = controllernamespace.NewRollout(controllernamespace.RolloutConfig{
+				SecretNamespace:    cmdCfg.NamespaceRunning,
+				SecretName:         cmdCfg.SecretName,
+				CanaryNamespaces:   cmdCfg.CanaryNamespaces,
+				VerificationPeriod: cmdCfg.CanaryVerificationPeriod,
+				CheckInterval:      cmdCfg.CanaryCheckInterval,
+				Verifiers:          []controllernamespace.RolloutVerifier{controllernamespace.ImagePullVerifier{K8sRepo: k8sRepo}},
+				K8sRepo:            nsRepo,
+				StateK8sRepo:       k8sRepo,
+				Trigger:            trigger,
+				Notifier:           notifier,
+				Logger:             logger,
+			})
+			if err != nil {
+				return fmt.Errorf("could not create canary rollout: %w", err)
+			}
+
+			g.Add(
+				func() error {
+					return rollout.Run(ctx)
+				},
+				func(_ error) {
+					cancel()
+				},
+			)
+		}
+
+		registryAliases, err := cmdCfg.RegistryAliasesConfig()
+		if err != nil {
+			return fmt.Errorf("invalid registry aliases: %w", err)
+		}
+
+		expressions, err := controllernamespace.NewExpressions(controllernamespace.ExpressionsConfig{
+			Select:          cmdCfg.SelectExpression,
+			SecretName:      cmdCfg.SecretNameExpression,
+			ServiceAccounts: cmdCfg.ServiceAccountsExpression,
 		})
 		if err != nil {
-			return fmt.Errorf("could not create namespace controller: %w", err)
+			return fmt.Errorf("invalid namespace expressions: %w", err)
+		}
+
+		tracker, err := addNamespaceController(ctx, &g, *cmdCfg, namespaceController{
+			K8sRepo:               k8sRepo,
+			HandlerK8sRepo:        cachedSecretK8sRepo,
+			Retriever:             nsRetriever,
+			Trigger:               trigger,
+			Rollout:               rollout,
+			FanOut:                fanOut,
+			Expressions:           expressions,
+			RegistryAliases:       registryAliases,
+			EventRecorder:         eventRecorder,
+			MetricsRecorder:       metricsRecorder,
+			KooperMetricsRecorder: kooperMetricsRecorder,
+			Notifier:              notifier,
+			Drainer:               drainer,
+			Logger:                logger.WithValues(log.Kv{"cluster": cmdCfg.ClusterName}),
+			KooperLogger:          kooperLogger,
+		})
+		if err != nil {
+			return err
+		}
+		metricsRecorder.SetClusterConnected(ctx, true)
+
+		// Target clusters, each one with its own controller fed from the source secret cache.
+		// The canary rollout is driven by the running cluster, the target clusters apply its
+		// decisions on their resyncs.
+		for _, cluster := range targetClusters {
+			tc := targetClusterController{
+				Cluster:       cluster,
+				CmdConfig:     *cmdCfg,
+				SourceK8sRepo: cachedSecretK8sRepo,
+				Controller: namespaceController{
+					Rollout:               rollout,
+					Expressions:           expressions,
+					RegistryAliases:       registryAliases,
+					MetricsRecorder:       metricsprometheus.NewRecorder(prometheus.WrapRegistererWith(prometheus.Labels{"cluster": cluster.Name}, promReg)),
+					KooperMetricsRecorder: kooperMetricsRecorder,
+					Notifier:              notifier,
+					Drainer:               drainer,
+					Logger:                logger.WithValues(log.Kv{"cluster": cluster.Name}),
+					KooperLogger:          kooperLogger,
+				},
+			}
+
+			g.Add(
+				func() error {
+					return tc.Run(ctx)
+				},
+				func(_ error) {
+					cancel()
+				},
+			)
+		}
+
+		// Admin HTTP server.
+		if cmdCfg.AdminListenAddr != "" {
+			adminHandler, err := admin.NewHandler(admin.Config{
+				Token:         cmdCfg.AdminToken,
+				SecretCache:   cachedSecretK8sRepo,
+				NamespaceRepo: nsRepo,
+				Results:       tracker,
+				Trigger:       trigger,
+				Logger:        logger,
+			})
+			if err != nil {
+				return fmt.Errorf("could not create admin handler: %w", err)
+			}
+
+			server := &http.Server{
+				Addr:    cmdCfg.AdminListenAddr,
+				Handler: adminHandler,
+			}
+
+			g.Add(
+				func() error {
+					logger.Infof("admin server listening on %s", cmdCfg.AdminListenAddr)
+					return server.ListenAndServe()
+				},
+				func(_ error) {
+					ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+					defer cancel()
+					err := server.Shutdown(ctx)
+					if err != nil {
+						logger.Errorf("error shutting down admin server: %s", err)
+					}
+				},
+			)
+		}
+	}
+
+	// Pprof HTTP server, on its own listener so the profiles are not exposed with the admin API.
+	if cmdCfg.PprofListenAddr != "" {
+		server := &http.Server{
+			Addr:    cmdCfg.PprofListenAddr,
+			Handler: admin.NewPprofHandler(),
 		}
 
 		g.Add(
 			func() error {
-				return ctrl.Run(ctx)
+				logger.Infof("pprof server listening on %s", cmdCfg.PprofListenAddr)
+				return server.ListenAndServe()
+			},
+			func(_ error) {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				err := server.Shutdown(ctx)
+				if err != nil {
+					logger.Errorf("error shutting down pprof server: %s", err)
+				}
+			},
+		)
+	}
+
+	// Registry credentials verification.
+	var registryVerifier *registry.Verifier
+	if cmdCfg.VerifyRegistryCredentials {
+		registryVerifier, err = registry.NewVerifier(registry.Config{
+			HTTPClient: &http.Client{Timeout: cmdCfg.RegistryVerifyTimeout},
+		})
+		if err != nil {
+			return fmt.Errorf("could not create registry credentials verifier: %w", err)
+		}
+	}
+
+	// Source credentials expiry tracking.
+	expiryTracker, err := controllersecretcache.NewExpiryTracker(controllersecretcache.ExpiryTrackerConfig{
+		Thresholds:      cmdCfg.CredentialsExpiryThresholds,
+		RejectExpired:   cmdCfg.RejectExpiredCredentials,
+		CheckInterval:   cmdCfg.CredentialsExpiryCheckInterval,
+		K8sRepo:         cachedSecretK8sRepo,
+		DockerConfig:    controllernamespace.DockerConfigJSON,
+		EventRecorder:   eventRecorder,
+		MetricsRecorder: metricsRecorder,
+		Logger:          logger,
+	})
+	if err != nil {
+		return fmt.Errorf("could not create credentials expiry tracker: %w", err)
+	}
+	{
+		ctx, cancel := context.WithCancel(ctx)
+		g.Add(
+			func() error {
+				return expiryTracker.Run(ctx)
 			},
 			func(_ error) {
 				cancel()
@@ -125,27 +456,101 @@ func Run(ctx context.Context, stdin io.Writer, stdout, stderr io.Reader) error {
 	}
 
 	// Secret cache controller optimization.
-	{
+	switch cmdCfg.CredentialsSource {
+	case credentialsSourceVault:
 		ctx, cancel := context.WithCancel(ctx)
 		defer cancel()
 
-		handler, err := controllersecretcache.NewHandler(cachedSecretK8sRepo, logger)
+		handler, err := controllersecretcache.NewHandler(cachedSecretK8sRepo, notifier, logger)
+		if err != nil {
+			return fmt.Errorf("could not create secret cache handler: %w", err)
+		}
+		if registryVerifier != nil {
+			handler, err = controllersecretcache.NewVerifyHandler(controllersecretcache.VerifyHandlerConfig{
+				Handler:         handler,
+				Verifier:        registryVerifier,
+				DockerConfig:    controllernamespace.DockerConfigJSON,
+				EventRecorder:   eventRecorder,
+				MetricsRecorder: metricsRecorder,
+				Logger:          logger,
+			})
+			if err != nil {
+				return fmt.Errorf("could not create registry credentials verify handler: %w", err)
+			}
+		}
+		handler = expiryTracker.Handler(handler)
+		handler = fanOut.SourceHandler(handler)
+		if rollout != nil {
+			handler = rollout.Handler(handler)
+		}
+
+		source, err := vault.NewSource(vault.Config{
+			Address:             cmdCfg.VaultAddress,
+			KVMount:             cmdCfg.VaultKVMount,
+			Path:                cmdCfg.VaultPath,
+			AuthMethod:          vault.AuthMethod(cmdCfg.VaultAuthMethod),
+			Token:               cmdCfg.VaultToken,
+			KubernetesRole:      cmdCfg.VaultKubernetesRole,
+			KubernetesAuthMount: cmdCfg.VaultKubernetesAuthMount,
+			PollInterval:        cmdCfg.VaultPollInterval,
+			SecretNamespace:     cmdCfg.NamespaceRunning,
+			SecretName:          cmdCfg.SecretName,
+			Handler:             drainer.Handler("secret-cache", handler),
+			Logger:              logger,
+		})
+		if err != nil {
+			return fmt.Errorf("could not create vault credentials source: %w", err)
+		}
+
+		g.Add(
+			func() error {
+				return source.Run(ctx)
+			},
+			func(_ error) {
+				cancel()
+			},
+		)
+
+	default:
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		handler, err := controllersecretcache.NewHandler(cachedSecretK8sRepo, notifier, logger)
 		if err != nil {
 			return fmt.Errorf("could not create secret cache controller handler: %w", err)
 		}
+		if registryVerifier != nil {
+			handler, err = controllersecretcache.NewVerifyHandler(controllersecretcache.VerifyHandlerConfig{
+				Handler:         handler,
+				Verifier:        registryVerifier,
+				DockerConfig:    controllernamespace.DockerConfigJSON,
+				EventRecorder:   eventRecorder,
+				MetricsRecorder: metricsRecorder,
+				Logger:          logger,
+			})
+			if err != nil {
+				return fmt.Errorf("could not create registry credentials verify handler: %w", err)
+			}
+		}
+		handler = expiryTracker.Handler(handler)
+		handler = fanOut.SourceHandler(handler)
+		if rollout != nil {
+			handler = rollout.Handler(handler)
+		}
 
-		retriever, err := controllersecretcache.NewRetriever(k8sRepo, cmdCfg.NamespaceRunning, cmdCfg.SecretName)
+		retriever, err := controllersecretcache.NewRetriever(ctx, k8sRepo, cmdCfg.NamespaceRunning, cmdCfg.SecretName)
 		if err != nil {
 			return fmt.Errorf("could not create secret cache controller retriever: %w", err)
 		}
 
 		ctrl, err := koopercontroller.New(&koopercontroller.Config{
-			Handler:              handler,
+			Handler:              drainer.Handler("secret-cache", handler),
 			Retriever:            retriever,
 			Logger:               kooperLogger,
+			MetricsRecorder:      kooperMetricsRecorder,
 			Name:                 "imagepull-workshop-secret-cache",
 			ConcurrentWorkers:    1,
-			ProcessingJobRetries: 1,
+			ProcessingJobRetries: cmdCfg.MaxRetries,
 			ResyncInterval:       5 * time.Minute,
 		})
 		if err != nil {
@@ -162,9 +567,19 @@ func Run(ctx context.Context, stdin io.Writer, stdout, stderr io.Reader) error {
 		)
 	}
 
-	err = g.Run()
+	runErr := g.Run()
+
+	// Let the in-flight handlings finish before exiting.
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), cmdCfg.ShutdownGracePeriod)
+	defer drainCancel()
+	logger.Infof("draining controllers (grace period %s)...", cmdCfg.ShutdownGracePeriod)
+	err = drainer.Drain(drainCtx)
 	if err != nil {
-		return err
+		logger.Warningf("could not drain controllers: %s", err)
+	}
+
+	if runErr != nil {
+		return runErr
 	}
 
 	return nil
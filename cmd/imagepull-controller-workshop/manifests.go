@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/slok/imagepull-controller-workshop/internal/manifests"
+	"github.com/slok/imagepull-controller-workshop/internal/preflight"
+	"github.com/slok/imagepull-controller-workshop/internal/source/vault"
+)
+
+// manifestsIgnoredFlags are the flags that are not rendered on the deployment, the secrets are
+// set as environment variables from a secret instead.
+var manifestsIgnoredFlags = []string{"development", "kube-config", "admin-token", "vault-token"}
+
+// renderManifests renders the manifests required by the controller with the command configuration,
+// the RBAC rules are the same ones checked by the preflight checks.
+func renderManifests(cmdCfg CmdConfig, targetClusters []targetCluster, out io.Writer) error {
+	args := []string{}
+	for _, f := range cmdCfg.Flags {
+		name := strings.SplitN(strings.TrimPrefix(f, "--"), "=", 2)[0]
+		if contains(manifestsIgnoredFlags, name) || contains(manifestsIgnoredFlags, strings.TrimPrefix(name, "no-")) {
+			continue
+		}
+		args = append(args, f)
+	}
+
+	secretEnv := []string{}
+	if cmdCfg.AdminToken != "" {
+		secretEnv = append(secretEnv, "ADMIN_TOKEN")
+	}
+	if cmdCfg.CredentialsSource == credentialsSourceVault && cmdCfg.VaultAuthMethod == string(vault.AuthMethodToken) {
+		secretEnv = append(secretEnv, "VAULT_TOKEN")
+	}
+
+	ports := []manifests.Port{}
+	for _, p := range []struct{ name, addr string }{
+		{name: "metrics", addr: cmdCfg.MetricsListenAddr},
+		{name: "admin", addr: cmdCfg.AdminListenAddr},
+	} {
+		if p.addr == "" {
+			continue
+		}
+
+		port, err := listenPort(p.addr)
+		if err != nil {
+			return fmt.Errorf("invalid %s listen address: %w", p.name, err)
+		}
+		ports = append(ports, manifests.Port{Name: p.name, Port: port})
+	}
+
+	data, err := manifests.Render(manifests.Config{
+		Name:        cmdCfg.ManifestsName,
+		Namespace:   cmdCfg.NamespaceRunning,
+		Image:       cmdCfg.ManifestsImage,
+		Args:        args,
+		SecretEnv:   secretEnv,
+		Ports:       ports,
+		Permissions: preflight.RequiredPermissions(cmdCfg.preflightConfig(targetClusters)),
+	})
+	if err != nil {
+		return fmt.Errorf("could not render manifests: %w", err)
+	}
+
+	_, err = out.Write(data)
+	return err
+}
+
+func listenPort(addr string) (int32, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0, err
+	}
+
+	p, err := strconv.ParseInt(port, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid port %q: %w", port, err)
+	}
+
+	return int32(p), nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/client-go/kubernetes"
+
+	controllernamespace "github.com/slok/imagepull-controller-workshop/internal/controller/namespace"
+	"github.com/slok/imagepull-controller-workshop/internal/log"
+	"github.com/slok/imagepull-controller-workshop/internal/preflight"
+	storagekubernetes "github.com/slok/imagepull-controller-workshop/internal/storage/kubernetes"
+)
+
+// preflightConfig returns the preflight configuration of the running cluster, without
+// repository, the target clusters only need the configuration of the target namespaces.
+func (c CmdConfig) preflightConfig(targetClusters []targetCluster) preflight.Config {
+	secrets, configMaps := []string{}, []string{}
+	for _, r := range c.Resources() {
+		switch r.Kind {
+		case controllernamespace.ResourceKindSecret:
+			secrets = append(secrets, r.Name)
+		case controllernamespace.ResourceKindConfigMap:
+			configMaps = append(configMaps, r.Name)
+		}
+	}
+
+	imagePullSecretName := c.SecretName
+	if c.CredentialsSource == credentialsSourceVault {
+		imagePullSecretName = ""
+	}
+
+	kubeConfigSecretNamespaces := []string{}
+	for _, tc := range targetClusters {
+		if tc.Source == targetClusterSourceSecret && !contains(kubeConfigSecretNamespaces, tc.SecretNamespace) {
+			kubeConfigSecretNamespaces = append(kubeConfigSecretNamespaces, tc.SecretNamespace)
+		}
+	}
+
+	return preflight.Config{
+		Cluster:                    c.ClusterName,
+		SourceNamespace:            c.NamespaceRunning,
+		ImagePullSecretName:        imagePullSecretName,
+		SecretNames:                secrets,
+		ConfigMapNames:             configMaps,
+		Namespaces:                 c.ScopedNamespaces,
+		NamespaceStatus:            !c.DisableNamespaceStatus && len(c.ScopedNamespaces) == 0,
+		CanaryNamespaces:           c.CanaryNamespaces,
+		KubeConfigSecretNamespaces: kubeConfigSecretNamespaces,
+		ValidateImagePullSecret:    controllernamespace.ValidateImagePullSecret,
+	}
+}
+
+// runPreflight runs the preflight checks on the running cluster and on the target clusters.
+func runPreflight(ctx context.Context, cmdCfg CmdConfig, k8sRepo storagekubernetes.Repository, targetClusters []targetCluster, logger log.Logger) (local preflight.Report, targets []preflight.Report) {
+	check := func(cfg preflight.Config) preflight.Report {
+		cfg.Logger = logger.WithValues(log.Kv{"cluster": cfg.Cluster})
+
+		checker, err := preflight.NewChecker(cfg)
+		if err != nil {
+			return preflight.Report{Cluster: cfg.Cluster, Results: []preflight.Result{{Check: "create preflight checker", Err: err}}}
+		}
+
+		return checker.Check(ctx)
+	}
+
+	localCfg := cmdCfg.preflightConfig(targetClusters)
+	localCfg.K8sRepo = k8sRepo
+	local = check(localCfg)
+
+	// The target clusters get the source resources from the running cluster.
+	for _, cluster := range targetClusters {
+		repo, err := targetClusterRepository(ctx, cluster, k8sRepo)
+		if err != nil {
+			targets = append(targets, preflight.Report{
+				Cluster: cluster.Name,
+				Results: []preflight.Result{{Check: "load cluster configuration", Err: err}},
+			})
+			continue
+		}
+
+		targets = append(targets, check(preflight.Config{
+			Cluster:         cluster.Name,
+			ConfigMapNames:  localCfg.ConfigMapNames,
+			Namespaces:      localCfg.Namespaces,
+			NamespaceStatus: localCfg.NamespaceStatus,
+			K8sRepo:         repo,
+		}))
+	}
+
+	return local, targets
+}
+
+func targetClusterRepository(ctx context.Context, cluster targetCluster, sourceRepo storagekubernetes.SourceRepository) (storagekubernetes.Repository, error) {
+	kcfg, err := loadTargetClusterConfig(ctx, cluster, sourceRepo)
+	if err != nil {
+		return storagekubernetes.Repository{}, err
+	}
+
+	kcli, err := kubernetes.NewForConfig(kcfg)
+	if err != nil {
+		return storagekubernetes.Repository{}, fmt.Errorf("could not create Kubernetes client: %w", err)
+	}
+
+	return storagekubernetes.NewRepository(kcli), nil
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,274 @@
+package admin
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	controllernamespace "github.com/slok/imagepull-controller-workshop/internal/controller/namespace"
+	"github.com/slok/imagepull-controller-workshop/internal/log"
+)
+
+// SecretCache is the service used to get the cached secrets.
+type SecretCache interface {
+	ListCachedSecrets(ctx context.Context) []*corev1.Secret
+}
+
+// NamespaceRepository is the service used to get the namespaces.
+type NamespaceRepository interface {
+	GetNamespace(ctx context.Context, name string) (*corev1.Namespace, error)
+	ListNamespaces(ctx context.Context, options metav1.ListOptions) (*corev1.NamespaceList, error)
+}
+
+// ResultGetter is the service used to get the last reconciliation results.
+type ResultGetter interface {
+	Results() []controllernamespace.ReconcileResult
+}
+
+// Config is the admin HTTP handler configuration.
+//
+// The admin API only covers the cluster the controller is running on, the namespaces of the
+// target clusters are not listed nor reconciled.
+type Config struct {
+	// Token is the bearer token required on the requests.
+	Token         string
+	SecretCache   SecretCache
+	NamespaceRepo NamespaceRepository
+	Results       ResultGetter
+	Trigger       controllernamespace.Trigger
+	Logger        log.Logger
+}
+
+func (c *Config) defaults() error {
+	if c.Token == "" {
+		return fmt.Errorf("token is required")
+	}
+
+	if c.SecretCache == nil {
+		return fmt.Errorf("secret cache is required")
+	}
+
+	if c.NamespaceRepo == nil {
+		return fmt.Errorf("namespace repository is required")
+	}
+
+	if c.Results == nil {
+		return fmt.Errorf("results getter is required")
+	}
+
+	if c.Trigger == nil {
+		return fmt.Errorf("trigger is required")
+	}
+
+	if c.Logger == nil {
+		c.Logger = log.Noop
+	}
+	c.Logger = c.Logger.WithValues(log.Kv{"svc": "admin.Handler"})
+
+	return nil
+}
+
+type handler struct {
+	// hashKey is the per process random key used to hash the secrets data.
+	hashKey       []byte
+	secretCache   SecretCache
+	namespaceRepo NamespaceRepository
+	results       ResultGetter
+	trigger       controllernamespace.Trigger
+	logger        log.Logger
+}
+
+// NewHandler returns the admin HTTP handler.
+func NewHandler(config Config) (http.Handler, error) {
+	err := config.defaults()
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	hashKey := make([]byte, 32)
+	_, err = rand.Read(hashKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate hash key: %w", err)
+	}
+
+	h := handler{
+		hashKey:       hashKey,
+		secretCache:   config.SecretCache,
+		namespaceRepo: config.NamespaceRepo,
+		results:       config.Results,
+		trigger:       config.Trigger,
+		logger:        config.Logger,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/cache/secrets", h.listCachedSecrets)
+	mux.HandleFunc("/api/v1/namespaces/results", h.listResults)
+	mux.HandleFunc("/api/v1/namespaces/reconcile", h.reconcileAll)
+	mux.HandleFunc("/api/v1/namespaces/", h.reconcileNamespace)
+
+	return authenticated(config.Token, mux), nil
+}
+
+// NewPprofHandler returns the HTTP handler with the pprof endpoints under `/debug/pprof`.
+// The profiles can keep the CPU busy for the requested duration and they are not
+// authenticated, so they need to be served on their own listener, only reachable by the
+// operators (e.g a loopback address and a port forward).
+func NewPprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	return mux
+}
+
+// authenticated only allows the requests with the expected bearer token.
+func authenticated(token string, next http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, expected) != 1 {
+			writeJSON(w, http.StatusUnauthorized, errorResponse{Error: "unauthorized"})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+type cachedSecret struct {
+	Namespace       string            `json:"namespace"`
+	Name            string            `json:"name"`
+	Type            string            `json:"type"`
+	ResourceVersion string            `json:"resourceVersion"`
+	DataHashes      map[string]string `json:"dataHashes"`
+}
+
+func (h handler) listCachedSecrets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+		return
+	}
+
+	secrets := h.secretCache.ListCachedSecrets(r.Context())
+	res := make([]cachedSecret, 0, len(secrets))
+	for _, s := range secrets {
+		// Never expose the secret data, only its keyed hashes, so the low entropy values
+		// can't be guessed from them. The hashes are only comparable on the same process.
+		hashes := map[string]string{}
+		for k, v := range s.Data {
+			mac := hmac.New(sha256.New, h.hashKey)
+			_, _ = mac.Write(v)
+			hashes[k] = hex.EncodeToString(mac.Sum(nil))
+		}
+
+		res = append(res, cachedSecret{
+			Namespace:       s.Namespace,
+			Name:            s.Name,
+			Type:            string(s.Type),
+			ResourceVersion: s.ResourceVersion,
+			DataHashes:      hashes,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Namespace+"/"+res[i].Name < res[j].Namespace+"/"+res[j].Name
+	})
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (h handler) listResults(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, h.results.Results())
+}
+
+type reconcileResponse struct {
+	Triggered []string          `json:"triggered"`
+	Errors    map[string]string `json:"errors,omitempty"`
+}
+
+func (h handler) reconcileAll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+		return
+	}
+
+	nsl, err := h.namespaceRepo.ListNamespaces(r.Context(), metav1.ListOptions{})
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: fmt.Sprintf("could not list namespaces: %s", err)})
+		return
+	}
+
+	res := reconcileResponse{Triggered: []string{}, Errors: map[string]string{}}
+	for _, ns := range nsl.Items {
+		err := h.trigger.Trigger(r.Context(), ns.Name)
+		if err != nil {
+			res.Errors[ns.Name] = err.Error()
+			continue
+		}
+		res.Triggered = append(res.Triggered, ns.Name)
+	}
+	h.logger.Infof("Reconciliation of %d namespaces triggered", len(res.Triggered))
+
+	writeJSON(w, http.StatusAccepted, res)
+}
+
+// reconcileNamespace handles `/api/v1/namespaces/{name}/reconcile` requests.
+func (h handler) reconcileNamespace(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/namespaces/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "reconcile" {
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: "not found"})
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+		return
+	}
+
+	ns := parts[0]
+	_, err := h.namespaceRepo.GetNamespace(r.Context(), ns)
+	if err == nil {
+		err = h.trigger.Trigger(r.Context(), ns)
+	}
+	switch {
+	case kubeerrors.IsNotFound(err):
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: fmt.Sprintf("namespace %q not found", ns)})
+		return
+	case err != nil:
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: fmt.Sprintf("could not trigger reconciliation: %s", err)})
+		return
+	}
+	h.logger.WithValues(log.Kv{"k8s-name": ns}).Infof("Reconciliation triggered")
+
+	writeJSON(w, http.StatusAccepted, reconcileResponse{Triggered: []string{ns}})
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
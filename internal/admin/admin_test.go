@@ -0,0 +1,327 @@
+package admin_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/slok/imagepull-controller-workshop/internal/admin"
+	controllernamespace "github.com/slok/imagepull-controller-workshop/internal/controller/namespace"
+)
+
+type fakeSecretCache []*corev1.Secret
+
+func (f fakeSecretCache) ListCachedSecrets(_ context.Context) []*corev1.Secret { return f }
+
+type fakeNamespaceRepo struct {
+	namespaces []string
+	err        error
+}
+
+func (f fakeNamespaceRepo) GetNamespace(_ context.Context, name string) (*corev1.Namespace, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	for _, ns := range f.namespaces {
+		if ns == name {
+			return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: ns}}, nil
+		}
+	}
+	return nil, kubeerrors.NewNotFound(corev1.Resource("namespaces"), name)
+}
+
+func (f fakeNamespaceRepo) ListNamespaces(_ context.Context, _ metav1.ListOptions) (*corev1.NamespaceList, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	nsl := &corev1.NamespaceList{}
+	for _, ns := range f.namespaces {
+		nsl.Items = append(nsl.Items, corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: ns}})
+	}
+	return nsl, nil
+}
+
+type fakeResults []controllernamespace.ReconcileResult
+
+func (f fakeResults) Results() []controllernamespace.ReconcileResult { return f }
+
+type fakeTrigger struct {
+	err       error
+	triggered []string
+}
+
+func (f *fakeTrigger) Trigger(_ context.Context, ns string) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.triggered = append(f.triggered, ns)
+	return nil
+}
+
+func TestHandler(t *testing.T) {
+	tests := map[string]struct {
+		method     string
+		path       string
+		auth       string
+		repoErr    error
+		triggerErr error
+		expStatus  int
+		expBody    string
+		// expTriggered are the triggered namespaces.
+		expTriggered []string
+	}{
+		"A request without token should be unauthorized.": {
+			method:    http.MethodGet,
+			path:      "/api/v1/namespaces/results",
+			expStatus: http.StatusUnauthorized,
+			expBody:   `{"error":"unauthorized"}`,
+		},
+
+		"A request with a wrong token should be unauthorized.": {
+			method:    http.MethodGet,
+			path:      "/api/v1/namespaces/results",
+			auth:      "Bearer wrong",
+			expStatus: http.StatusUnauthorized,
+			expBody:   `{"error":"unauthorized"}`,
+		},
+
+		"A request with a wrong auth scheme should be unauthorized.": {
+			method:    http.MethodGet,
+			path:      "/api/v1/namespaces/results",
+			auth:      "Basic test-token",
+			expStatus: http.StatusUnauthorized,
+			expBody:   `{"error":"unauthorized"}`,
+		},
+
+		"A request to an unknown path should be unauthorized without token.": {
+			method:    http.MethodGet,
+			path:      "/unknown",
+			expStatus: http.StatusUnauthorized,
+			expBody:   `{"error":"unauthorized"}`,
+		},
+
+		"The pprof endpoints should not be served on the admin API.": {
+			method:    http.MethodGet,
+			path:      "/debug/pprof/",
+			auth:      "Bearer test-token",
+			expStatus: http.StatusNotFound,
+		},
+
+		"Listing the results should return the results.": {
+			method:    http.MethodGet,
+			path:      "/api/v1/namespaces/results",
+			auth:      "Bearer test-token",
+			expStatus: http.StatusOK,
+			expBody:   `[{"namespace":"ns-1","time":"0001-01-01T00:00:00Z","duration":0,"success":false,"error":"something"}]`,
+		},
+
+		"Listing the results with a wrong method should fail.": {
+			method:    http.MethodPost,
+			path:      "/api/v1/namespaces/results",
+			auth:      "Bearer test-token",
+			expStatus: http.StatusMethodNotAllowed,
+			expBody:   `{"error":"method not allowed"}`,
+		},
+
+		"Listing the cached secrets should not return the secret data.": {
+			method:    http.MethodGet,
+			path:      "/api/v1/cache/secrets",
+			auth:      "Bearer test-token",
+			expStatus: http.StatusOK,
+		},
+
+		"Listing the cached secrets with a wrong method should fail.": {
+			method:    http.MethodDelete,
+			path:      "/api/v1/cache/secrets",
+			auth:      "Bearer test-token",
+			expStatus: http.StatusMethodNotAllowed,
+		},
+
+		"Reconciling all the namespaces should trigger all the namespaces.": {
+			method:       http.MethodPost,
+			path:         "/api/v1/namespaces/reconcile",
+			auth:         "Bearer test-token",
+			expStatus:    http.StatusAccepted,
+			expBody:      `{"triggered":["ns-1","ns-2"]}`,
+			expTriggered: []string{"ns-1", "ns-2"},
+		},
+
+		"Reconciling all the namespaces with a wrong method should fail.": {
+			method:    http.MethodGet,
+			path:      "/api/v1/namespaces/reconcile",
+			auth:      "Bearer test-token",
+			expStatus: http.StatusMethodNotAllowed,
+		},
+
+		"Reconciling all the namespaces failing to list them should fail.": {
+			method:    http.MethodPost,
+			path:      "/api/v1/namespaces/reconcile",
+			auth:      "Bearer test-token",
+			repoErr:   fmt.Errorf("something"),
+			expStatus: http.StatusInternalServerError,
+			expBody:   `{"error":"could not list namespaces: something"}`,
+		},
+
+		"Reconciling all the namespaces failing to trigger them should return the errors.": {
+			method:     http.MethodPost,
+			path:       "/api/v1/namespaces/reconcile",
+			auth:       "Bearer test-token",
+			triggerErr: fmt.Errorf("something"),
+			expStatus:  http.StatusAccepted,
+			expBody:    `{"triggered":[],"errors":{"ns-1":"something","ns-2":"something"}}`,
+		},
+
+		"Reconciling a namespace should trigger the namespace.": {
+			method:       http.MethodPost,
+			path:         "/api/v1/namespaces/ns-1/reconcile",
+			auth:         "Bearer test-token",
+			expStatus:    http.StatusAccepted,
+			expBody:      `{"triggered":["ns-1"]}`,
+			expTriggered: []string{"ns-1"},
+		},
+
+		"Reconciling a namespace with a wrong method should fail.": {
+			method:    http.MethodGet,
+			path:      "/api/v1/namespaces/ns-1/reconcile",
+			auth:      "Bearer test-token",
+			expStatus: http.StatusMethodNotAllowed,
+		},
+
+		"Reconciling a missing namespace should return not found.": {
+			method:    http.MethodPost,
+			path:      "/api/v1/namespaces/missing/reconcile",
+			auth:      "Bearer test-token",
+			expStatus: http.StatusNotFound,
+			expBody:   `{"error":"namespace \"missing\" not found"}`,
+		},
+
+		"Reconciling a namespace failing to get it should fail.": {
+			method:    http.MethodPost,
+			path:      "/api/v1/namespaces/ns-1/reconcile",
+			auth:      "Bearer test-token",
+			repoErr:   fmt.Errorf("something"),
+			expStatus: http.StatusInternalServerError,
+			expBody:   `{"error":"could not trigger reconciliation: something"}`,
+		},
+
+		"Reconciling a namespace failing to trigger it should fail.": {
+			method:     http.MethodPost,
+			path:       "/api/v1/namespaces/ns-1/reconcile",
+			auth:       "Bearer test-token",
+			triggerErr: fmt.Errorf("something"),
+			expStatus:  http.StatusInternalServerError,
+			expBody:    `{"error":"could not trigger reconciliation: something"}`,
+		},
+
+		"Reconciling a namespace with an empty name should not trigger anything.": {
+			method: http.MethodPost,
+			path:   "/api/v1/namespaces//reconcile",
+			auth:   "Bearer test-token",
+			// The mux cleans the path, redirecting instead of reaching the handler.
+			expStatus: http.StatusMovedPermanently,
+		},
+
+		"Reconciling a namespace with extra path segments should return not found.": {
+			method:    http.MethodPost,
+			path:      "/api/v1/namespaces/x/y/reconcile",
+			auth:      "Bearer test-token",
+			expStatus: http.StatusNotFound,
+			expBody:   `{"error":"not found"}`,
+		},
+
+		"An unknown namespace action should return not found.": {
+			method:    http.MethodPost,
+			path:      "/api/v1/namespaces/ns-1/delete",
+			auth:      "Bearer test-token",
+			expStatus: http.StatusNotFound,
+			expBody:   `{"error":"not found"}`,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			trigger := &fakeTrigger{err: test.triggerErr}
+			h, err := admin.NewHandler(admin.Config{
+				Token: "test-token",
+				SecretCache: fakeSecretCache{
+					{ObjectMeta: metav1.ObjectMeta{Namespace: "source-ns", Name: "creds"}, Data: map[string][]byte{"key": []byte("secret-value")}},
+				},
+				NamespaceRepo: fakeNamespaceRepo{namespaces: []string{"ns-1", "ns-2"}, err: test.repoErr},
+				Results:       fakeResults{{Namespace: "ns-1", Error: "something"}},
+				Trigger:       trigger,
+			})
+			require.NoError(err)
+
+			req := httptest.NewRequest(test.method, test.path, nil)
+			if test.auth != "" {
+				req.Header.Set("Authorization", test.auth)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			assert.Equal(test.expStatus, w.Code)
+			if test.expBody != "" {
+				assert.JSONEq(test.expBody, w.Body.String())
+			}
+			assert.Equal(test.expTriggered, trigger.triggered)
+			assert.NotContains(w.Body.String(), "secret-value")
+		})
+	}
+}
+
+func TestHandlerCachedSecrets(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	h, err := admin.NewHandler(admin.Config{
+		Token: "test-token",
+		SecretCache: fakeSecretCache{
+			{ObjectMeta: metav1.ObjectMeta{Namespace: "source-ns", Name: "b"}, Data: map[string][]byte{"key": []byte("v")}},
+			{ObjectMeta: metav1.ObjectMeta{Namespace: "source-ns", Name: "a"}, Data: map[string][]byte{"key": []byte("v")}},
+		},
+		NamespaceRepo: fakeNamespaceRepo{},
+		Results:       fakeResults{},
+		Trigger:       &fakeTrigger{},
+	})
+	require.NoError(err)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/cache/secrets", nil)
+	req.Header.Set("Authorization", "Bearer test-token")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	require.Equal(http.StatusOK, w.Code)
+
+	got := []struct {
+		Name       string            `json:"name"`
+		DataHashes map[string]string `json:"dataHashes"`
+	}{}
+	require.NoError(json.Unmarshal(w.Body.Bytes(), &got))
+	require.Len(got, 2)
+	// Sorted and with the same hash for the same data.
+	assert.Equal("a", got[0].Name)
+	assert.Equal("b", got[1].Name)
+	assert.Len(got[0].DataHashes["key"], 64)
+	assert.Equal(got[0].DataHashes["key"], got[1].DataHashes["key"])
+}
+
+func TestPprofHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil)
+	w := httptest.NewRecorder()
+	admin.NewPprofHandler().ServeHTTP(w, req)
+
+	assert.Equal(http.StatusOK, w.Code)
+}
@@ -0,0 +1,167 @@
+package drain
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/spotahome/kooper/v2/controller"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/slok/imagepull-controller-workshop/internal/log"
+)
+
+// Drainer tracks the in-flight handlings of the controller handlers so on shutdown we
+// can wait for them to finish instead of cutting them in the middle.
+type Drainer struct {
+	mu       sync.Mutex
+	draining bool
+	inFlight map[string]int
+	doneC    chan struct{}
+	abortC   chan struct{}
+	abort    sync.Once
+	logger   log.Logger
+}
+
+// NewDrainer returns a new Drainer.
+func NewDrainer(logger log.Logger) *Drainer {
+	if logger == nil {
+		logger = log.Noop
+	}
+
+	return &Drainer{
+		inFlight: map[string]int{},
+		abortC:   make(chan struct{}),
+		logger:   logger.WithValues(log.Kv{"svc": "controller.drain.Drainer"}),
+	}
+}
+
+// Handler wraps a controller handler so the drainer can track its executions.
+// Once the drain has started the new objects will not be handled.
+//
+// The handlings get a context that is only canceled when the drain grace period ends, the
+// cancellation of the received context (e.g the controller or queue stopping) is ignored so
+// the in-flight handlings can finish.
+func (d *Drainer) Handler(name string, next controller.Handler) controller.Handler {
+	return controller.HandlerFunc(func(ctx context.Context, obj runtime.Object) error {
+		id := fmt.Sprintf("%s:%s", name, objectKey(obj))
+
+		if !d.start(id) {
+			d.logger.Warningf("Shutting down, abandoning %q", id)
+			return nil
+		}
+		defer d.finish(id)
+
+		// Abort the handling only if the drain grace period has ended.
+		ctx, cancel := context.WithCancel(detachedContext{parent: ctx})
+		defer cancel()
+		go func() {
+			select {
+			case <-d.abortC:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		return next.Handle(ctx, obj)
+	})
+}
+
+// Drain stops accepting new handlings and waits until the in-flight ones have finished or the
+// context is done, in that case the in-flight handlings are aborted.
+func (d *Drainer) Drain(ctx context.Context) error {
+	d.mu.Lock()
+	d.draining = true
+	if len(d.inFlight) == 0 {
+		d.mu.Unlock()
+		return nil
+	}
+	d.doneC = make(chan struct{})
+	doneC := d.doneC
+	d.logger.Infof("Waiting for %d in-flight handlings to finish", d.countInFlight())
+	d.mu.Unlock()
+
+	select {
+	case <-doneC:
+		d.logger.Infof("All in-flight handlings finished")
+		return nil
+	case <-ctx.Done():
+	}
+
+	d.abort.Do(func() { close(d.abortC) })
+
+	d.mu.Lock()
+	abandoned := make([]string, 0, len(d.inFlight))
+	for id := range d.inFlight {
+		abandoned = append(abandoned, id)
+	}
+	d.mu.Unlock()
+	sort.Strings(abandoned)
+
+	for _, id := range abandoned {
+		d.logger.Warningf("Abandoned in-flight handling of %q", id)
+	}
+
+	return fmt.Errorf("drain grace period ended with %d in-flight handlings abandoned", len(abandoned))
+}
+
+func (d *Drainer) start(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.draining {
+		return false
+	}
+	d.inFlight[id]++
+
+	return true
+}
+
+func (d *Drainer) finish(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.inFlight[id]--
+	if d.inFlight[id] <= 0 {
+		delete(d.inFlight, id)
+	}
+
+	if d.draining && len(d.inFlight) == 0 && d.doneC != nil {
+		close(d.doneC)
+		d.doneC = nil
+	}
+}
+
+func (d *Drainer) countInFlight() int {
+	total := 0
+	for _, c := range d.inFlight {
+		total += c
+	}
+	return total
+}
+
+func objectKey(obj runtime.Object) string {
+	m, err := meta.Accessor(obj)
+	if err != nil {
+		return "unknown"
+	}
+
+	if m.GetNamespace() == "" {
+		return m.GetName()
+	}
+
+	return m.GetNamespace() + "/" + m.GetName()
+}
+
+// detachedContext is a context with the values of its parent but not its cancellation.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (d detachedContext) Value(key interface{}) interface{} { return d.parent.Value(key) }
@@ -0,0 +1,98 @@
+package drain_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/spotahome/kooper/v2/controller"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/slok/imagepull-controller-workshop/internal/controller/drain"
+)
+
+func TestDrainerDrain(t *testing.T) {
+	tests := map[string]struct {
+		gracePeriod time.Duration
+		release     bool
+		expErr      bool
+		expCtxErr   bool
+	}{
+		"An in-flight handling at shutdown should finish within the grace period.": {
+			gracePeriod: time.Minute,
+			release:     true,
+		},
+
+		"An in-flight handling should be aborted when the grace period ends.": {
+			gracePeriod: 10 * time.Millisecond,
+			expErr:      true,
+			expCtxErr:   true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			started := make(chan struct{})
+			release := make(chan struct{})
+			finished := make(chan error, 1)
+			drainer := drain.NewDrainer(nil)
+			h := drainer.Handler("test", controller.HandlerFunc(func(ctx context.Context, _ runtime.Object) error {
+				close(started)
+				select {
+				case <-release:
+				case <-ctx.Done():
+				}
+				finished <- ctx.Err()
+				return nil
+			}))
+
+			// The controller context is canceled on shutdown while the handling is in flight.
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() { _ = h.Handle(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "test"}}) }()
+			<-started
+			cancel()
+
+			drainCtx, drainCancel := context.WithTimeout(context.Background(), test.gracePeriod)
+			defer drainCancel()
+			if test.release {
+				go func() {
+					time.Sleep(10 * time.Millisecond)
+					close(release)
+				}()
+			}
+			err := drainer.Drain(drainCtx)
+			if test.expErr {
+				assert.Error(err)
+			} else {
+				assert.NoError(err)
+			}
+
+			select {
+			case ctxErr := <-finished:
+				assert.Equal(test.expCtxErr, ctxErr != nil)
+			case <-time.After(time.Second):
+				require.Fail("handling didn't finish")
+			}
+		})
+	}
+}
+
+func TestDrainerRejectsNewHandlings(t *testing.T) {
+	drainer := drain.NewDrainer(nil)
+	require.NoError(t, drainer.Drain(context.Background()))
+
+	handled := false
+	h := drainer.Handler("test", controller.HandlerFunc(func(context.Context, runtime.Object) error {
+		handled = true
+		return nil
+	}))
+	require.NoError(t, h.Handle(context.Background(), &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "test"}}))
+	assert.False(t, handled)
+}
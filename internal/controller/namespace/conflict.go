@@ -0,0 +1,77 @@
+package namespace
+
+import (
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	managedByKey   = "app.kubernetes.io/managed-by"
+	managedByValue = "imagepull-controller-workshop"
+)
+
+// ConflictPolicy is the policy used when the target secret already exists on a namespace
+// and is not managed by the controller.
+type ConflictPolicy string
+
+const (
+	// ConflictPolicySkip will not touch the existing secret.
+	ConflictPolicySkip ConflictPolicy = "skip"
+	// ConflictPolicyAdopt will take the ownership of the existing secret keeping its
+	// metadata (also on the next writes), and replacing the data.
+	ConflictPolicyAdopt ConflictPolicy = "adopt"
+	// ConflictPolicyOverwrite will replace the existing secret.
+	ConflictPolicyOverwrite ConflictPolicy = "overwrite"
+)
+
+// ConflictPolicies are the valid conflict policies.
+var ConflictPolicies = []ConflictPolicy{ConflictPolicySkip, ConflictPolicyAdopt, ConflictPolicyOverwrite}
+
+func (c ConflictPolicy) validate() error {
+	for _, p := range ConflictPolicies {
+		if c == p {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown %q conflict policy", c)
+}
+
+// Conflict decisions.
+const (
+	conflictDecisionSkipped     = "skipped"
+	conflictDecisionAdopted     = "adopted"
+	conflictDecisionOverwritten = "overwritten"
+)
+
+// isManaged returns true if the object is managed by the controller.
+func isManaged(obj metav1.Object) bool {
+	return obj.GetLabels()[managedByKey] == managedByValue || obj.GetAnnotations()[managedByKey] == managedByValue
+}
+
+// mergeMeta returns the metadata that the controller will set in place of the stored one
+// when writing an existing object (adopted or managed), the stored metadata is kept and the
+// desired one merged on top. The controller owned keys that are not desired anymore (e.g
+// superseded immutable versions rolled back) are removed.
+func mergeMeta(stored, desired metav1.ObjectMeta) metav1.ObjectMeta {
+	merged := *stored.DeepCopy()
+	merged.Labels = mergeKV(merged.Labels, desired.Labels)
+	merged.Annotations = mergeKV(merged.Annotations, desired.Annotations)
+
+	return merged
+}
+
+func mergeKV(stored, desired map[string]string) map[string]string {
+	merged := map[string]string{}
+	for k, v := range stored {
+		if !isOwnedKey(k) {
+			merged[k] = v
+		}
+	}
+	for k, v := range desired {
+		merged[k] = v
+	}
+
+	return merged
+}
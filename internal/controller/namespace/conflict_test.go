@@ -0,0 +1,86 @@
+package namespace_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/slok/imagepull-controller-workshop/internal/controller/namespace"
+)
+
+func TestHandlerConflictPolicyResync(t *testing.T) {
+	tests := map[string]struct {
+		policy         namespace.ConflictPolicy
+		expWrites      int
+		expManaged     bool
+		expForeignMeta bool
+	}{
+		"Skip policy should not touch the existing secret.": {
+			policy:         namespace.ConflictPolicySkip,
+			expWrites:      0,
+			expForeignMeta: true,
+		},
+
+		"Adopt policy should keep the existing metadata on the adoption and the next resyncs, without rewriting it.": {
+			policy:         namespace.ConflictPolicyAdopt,
+			expWrites:      1,
+			expManaged:     true,
+			expForeignMeta: true,
+		},
+
+		"Overwrite policy should replace the existing secret once.": {
+			policy:     namespace.ConflictPolicyOverwrite,
+			expWrites:  1,
+			expManaged: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			repo := newFakeRepo()
+			repo.addNamespace(testNamespace("test-ns"))
+			repo.addSecret(testSourceSecret("source-ns", "creds", "dXNlcjpwYXNz"))
+			repo.addServiceAccount(&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "test-ns", Name: "default"}})
+			repo.addSecret(&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "test-ns",
+					Name:        "creds",
+					Labels:      map[string]string{"team": "a"},
+					Annotations: map[string]string{"owner": "someone"},
+				},
+				Type: corev1.SecretTypeDockerConfigJson,
+				Data: map[string][]byte{corev1.DockerConfigJsonKey: []byte(`{"auths":{}}`)},
+			})
+
+			h, err := namespace.NewHandler(namespace.HandlerConfig{
+				RunningNamespace:       "source-ns",
+				ImagePullSecretName:    "creds",
+				ConflictPolicy:         test.policy,
+				DisableNamespaceStatus: true,
+				K8sRepo:                repo,
+			})
+			require.NoError(err)
+
+			// Adoption and resync.
+			for i := 0; i < 2; i++ {
+				err := h.Handle(context.TODO(), testNamespace("test-ns"))
+				require.NoError(err)
+			}
+
+			assert.Equal(test.expWrites, repo.writeCount("EnsureSecret"))
+
+			secret, err := repo.GetSecret(context.TODO(), "test-ns", "creds")
+			require.NoError(err)
+			assert.Equal(test.expManaged, secret.Labels["app.kubernetes.io/managed-by"] == "imagepull-controller-workshop")
+			assert.Equal(test.expForeignMeta, secret.Labels["team"] == "a")
+			assert.Equal(test.expForeignMeta, secret.Annotations["owner"] == "someone")
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package namespace
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Keys of the username and password secrets used as image pull secret sources.
+const (
+	credentialsKeyServer = "server"
+	credentialsKeyEmail  = "email"
+)
+
+type dockerConfigJSON struct {
+	Auths map[string]dockerConfigAuth `json:"auths"`
+}
+
+type dockerConfigAuth struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Email    string `json:"email,omitempty"`
+	Auth     string `json:"auth"`
+}
+
+// normalizeDockerConfig returns the type and data of a secret normalized to the
+// `kubernetes.io/dockerconfigjson` format, supporting:
+// - `kubernetes.io/dockerconfigjson`: used as it is.
+// - `kubernetes.io/dockercfg`: the legacy format is converted.
+// - `kubernetes.io/basic-auth` or `Opaque` with `username`, `password` and `server` keys: converted.
+// - `Opaque` with a `.dockerconfigjson` key: used as it is.
+//
+// Other secrets are returned as they are.
+func normalizeDockerConfig(secret *corev1.Secret) (corev1.SecretType, map[string][]byte, error) {
+	switch {
+	case secret.Type == corev1.SecretTypeDockerConfigJson:
+		return secret.Type, secret.Data, nil
+
+	case secret.Type == corev1.SecretTypeDockercfg:
+		cfg, ok := secret.Data[corev1.DockerConfigKey]
+		if !ok {
+			return "", nil, fmt.Errorf("missing %q key", corev1.DockerConfigKey)
+		}
+
+		// The legacy format is the `auths` content of the new format.
+		auths := map[string]json.RawMessage{}
+		err := json.Unmarshal(cfg, &auths)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid %q: %w", corev1.DockerConfigKey, err)
+		}
+
+		data, err := json.Marshal(map[string]interface{}{"auths": auths})
+		if err != nil {
+			return "", nil, fmt.Errorf("could not marshal docker config JSON: %w", err)
+		}
+
+		return corev1.SecretTypeDockerConfigJson, map[string][]byte{corev1.DockerConfigJsonKey: data}, nil
+
+	case secret.Type == corev1.SecretTypeBasicAuth || hasCredentialKeys(secret):
+		username := string(secret.Data[corev1.BasicAuthUsernameKey])
+		password := string(secret.Data[corev1.BasicAuthPasswordKey])
+		server := string(secret.Data[credentialsKeyServer])
+		if username == "" || password == "" || server == "" {
+			return "", nil, fmt.Errorf("%q, %q and %q keys are required", corev1.BasicAuthUsernameKey, corev1.BasicAuthPasswordKey, credentialsKeyServer)
+		}
+
+		data, err := json.Marshal(dockerConfigJSON{Auths: map[string]dockerConfigAuth{
+			server: {
+				Username: username,
+				Password: password,
+				Email:    string(secret.Data[credentialsKeyEmail]),
+				Auth:     base64.StdEncoding.EncodeToString([]byte(username + ":" + password)),
+			},
+		}})
+		if err != nil {
+			return "", nil, fmt.Errorf("could not marshal docker config JSON: %w", err)
+		}
+
+		return corev1.SecretTypeDockerConfigJson, map[string][]byte{corev1.DockerConfigJsonKey: data}, nil
+
+	case secret.Type == corev1.SecretTypeOpaque || secret.Type == "":
+		if cfg, ok := secret.Data[corev1.DockerConfigJsonKey]; ok {
+			return corev1.SecretTypeDockerConfigJson, map[string][]byte{corev1.DockerConfigJsonKey: cfg}, nil
+		}
+	}
+
+	return secret.Type, secret.Data, nil
+}
+
+// ValidateImagePullSecret returns an error if the secret can't be used as an image pull
+// secret source, it needs to be normalizable to a docker config JSON with credentials
+// for every registry, either a base64 `auth` with `username:password` or the username
+// and password.
+func ValidateImagePullSecret(secret *corev1.Secret) error {
+	secretType, data, err := normalizeDockerConfig(secret)
+	if err != nil {
+		return err
+	}
+
+	if secretType != corev1.SecretTypeDockerConfigJson {
+		return fmt.Errorf("unsupported %q secret type without docker credentials", secret.Type)
+	}
+
+	cfg := dockerConfigJSON{}
+	err = json.Unmarshal(data[corev1.DockerConfigJsonKey], &cfg)
+	if err != nil {
+		return fmt.Errorf("invalid docker config JSON: %w", err)
+	}
+
+	if len(cfg.Auths) == 0 {
+		return fmt.Errorf("docker config JSON without registries")
+	}
+
+	for registry, auth := range cfg.Auths {
+		if normalizeRegistry(registry) == "" {
+			return fmt.Errorf("docker config JSON with an empty registry")
+		}
+
+		err := auth.validate()
+		if err != nil {
+			return fmt.Errorf("invalid %q registry credentials: %w", registry, err)
+		}
+	}
+
+	return nil
+}
+
+func (d dockerConfigAuth) validate() error {
+	if d.Auth == "" {
+		if d.Username == "" || d.Password == "" {
+			return fmt.Errorf("auth or username and password are required")
+		}
+		return nil
+	}
+
+	auth, err := base64.StdEncoding.DecodeString(d.Auth)
+	if err != nil {
+		return fmt.Errorf("invalid auth: %w", err)
+	}
+	if !strings.Contains(string(auth), ":") {
+		return fmt.Errorf("invalid auth: missing username and password separator")
+	}
+
+	return nil
+}
+
+// DockerConfigJSON returns the docker config JSON of a secret normalized like the image pull
+// secret sources, if the secret doesn't have docker credentials it returns nil.
+func DockerConfigJSON(secret *corev1.Secret) ([]byte, error) {
+	secretType, data, err := normalizeDockerConfig(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	if secretType != corev1.SecretTypeDockerConfigJson {
+		return nil, nil
+	}
+
+	return data[corev1.DockerConfigJsonKey], nil
+}
+
+// hasCredentialKeys returns true if the secret is an opaque secret with the username, password
+// and server keys.
+func hasCredentialKeys(secret *corev1.Secret) bool {
+	if secret.Type != corev1.SecretTypeOpaque && secret.Type != "" {
+		return false
+	}
+
+	for _, k := range []string{corev1.BasicAuthUsernameKey, corev1.BasicAuthPasswordKey, credentialsKeyServer} {
+		if _, ok := secret.Data[k]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
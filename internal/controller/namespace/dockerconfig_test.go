@@ -0,0 +1,218 @@
+package namespace_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/slok/imagepull-controller-workshop/internal/controller/namespace"
+)
+
+func TestDockerConfigJSON(t *testing.T) {
+	tests := map[string]struct {
+		secret  *corev1.Secret
+		expJSON string
+		expErr  bool
+	}{
+		"A docker config JSON secret should be used as it is.": {
+			secret: &corev1.Secret{
+				Type: corev1.SecretTypeDockerConfigJson,
+				Data: map[string][]byte{corev1.DockerConfigJsonKey: []byte(`{"auths": {"r.io": {"auth": "dTpw"}}}`)},
+			},
+			expJSON: `{"auths": {"r.io": {"auth": "dTpw"}}}`,
+		},
+
+		"A legacy docker config secret should be converted.": {
+			secret: &corev1.Secret{
+				Type: corev1.SecretTypeDockercfg,
+				Data: map[string][]byte{corev1.DockerConfigKey: []byte(`{"r.io":{"auth":"dTpw","email":"e@r.io"}}`)},
+			},
+			expJSON: `{"auths":{"r.io":{"auth":"dTpw","email":"e@r.io"}}}`,
+		},
+
+		"A legacy docker config secret should be converted with the registries sorted.": {
+			secret: &corev1.Secret{
+				Type: corev1.SecretTypeDockercfg,
+				Data: map[string][]byte{corev1.DockerConfigKey: []byte(`{"b.io":{"auth":"dTpw"},"a.io":{"auth":"dTpw"}}`)},
+			},
+			expJSON: `{"auths":{"a.io":{"auth":"dTpw"},"b.io":{"auth":"dTpw"}}}`,
+		},
+
+		"A legacy docker config secret without the config key should fail.": {
+			secret: &corev1.Secret{
+				Type: corev1.SecretTypeDockercfg,
+				Data: map[string][]byte{"other": []byte(`{}`)},
+			},
+			expErr: true,
+		},
+
+		"A legacy docker config secret with malformed JSON should fail.": {
+			secret: &corev1.Secret{
+				Type: corev1.SecretTypeDockercfg,
+				Data: map[string][]byte{corev1.DockerConfigKey: []byte(`{"r.io":`)},
+			},
+			expErr: true,
+		},
+
+		"A basic auth secret should be converted.": {
+			secret: &corev1.Secret{
+				Type: corev1.SecretTypeBasicAuth,
+				Data: map[string][]byte{"username": []byte("u"), "password": []byte("p"), "server": []byte("r.io")},
+			},
+			expJSON: `{"auths":{"r.io":{"username":"u","password":"p","auth":"dTpw"}}}`,
+		},
+
+		"An opaque secret with credential keys should be converted.": {
+			secret: &corev1.Secret{
+				Type: corev1.SecretTypeOpaque,
+				Data: map[string][]byte{"username": []byte("u"), "password": []byte("p"), "server": []byte("r.io"), "email": []byte("e@r.io")},
+			},
+			expJSON: `{"auths":{"r.io":{"username":"u","password":"p","email":"e@r.io","auth":"dTpw"}}}`,
+		},
+
+		"A basic auth secret without server should fail.": {
+			secret: &corev1.Secret{
+				Type: corev1.SecretTypeBasicAuth,
+				Data: map[string][]byte{"username": []byte("u"), "password": []byte("p")},
+			},
+			expErr: true,
+		},
+
+		"An opaque secret with a docker config JSON key should be used as it is.": {
+			secret: &corev1.Secret{
+				Type: corev1.SecretTypeOpaque,
+				Data: map[string][]byte{corev1.DockerConfigJsonKey: []byte(`{"auths":{"r.io":{"auth":"dTpw"}}}`)},
+			},
+			expJSON: `{"auths":{"r.io":{"auth":"dTpw"}}}`,
+		},
+
+		"An opaque secret without docker credentials should not have docker config JSON.": {
+			secret: &corev1.Secret{
+				Type: corev1.SecretTypeOpaque,
+				Data: map[string][]byte{"token": []byte("t")},
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			got, err := namespace.DockerConfigJSON(test.secret)
+			if test.expErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(test.expJSON, string(got))
+
+			// The content hash of the copies depends on the same result every time.
+			for i := 0; i < 10; i++ {
+				again, err := namespace.DockerConfigJSON(test.secret)
+				assert.NoError(err)
+				assert.Equal(got, again)
+			}
+		})
+	}
+}
+
+func TestValidateImagePullSecret(t *testing.T) {
+	dockerConfigJSON := func(cfg string) *corev1.Secret {
+		return &corev1.Secret{
+			Type: corev1.SecretTypeDockerConfigJson,
+			Data: map[string][]byte{corev1.DockerConfigJsonKey: []byte(cfg)},
+		}
+	}
+
+	tests := map[string]struct {
+		secret *corev1.Secret
+		expErr bool
+	}{
+		"A docker config JSON with auth should be valid.": {
+			secret: dockerConfigJSON(`{"auths":{"r.io":{"auth":"dTpw"}}}`),
+		},
+
+		"A docker config JSON with username and password should be valid.": {
+			secret: dockerConfigJSON(`{"auths":{"https://r.io/v1/":{"username":"u","password":"p"}}}`),
+		},
+
+		"A legacy docker config should be valid.": {
+			secret: &corev1.Secret{
+				Type: corev1.SecretTypeDockercfg,
+				Data: map[string][]byte{corev1.DockerConfigKey: []byte(`{"r.io":{"auth":"dTpw"}}`)},
+			},
+		},
+
+		"A basic auth secret should be valid.": {
+			secret: &corev1.Secret{
+				Type: corev1.SecretTypeBasicAuth,
+				Data: map[string][]byte{"username": []byte("u"), "password": []byte("p"), "server": []byte("r.io")},
+			},
+		},
+
+		"A docker config JSON with malformed JSON should fail.": {
+			secret: dockerConfigJSON(`{"auths":`),
+			expErr: true,
+		},
+
+		"A docker config JSON without auths should fail.": {
+			secret: dockerConfigJSON(`{"credsStore":"desktop"}`),
+			expErr: true,
+		},
+
+		"A docker config JSON with empty auths should fail.": {
+			secret: dockerConfigJSON(`{"auths":{}}`),
+			expErr: true,
+		},
+
+		"A docker config JSON with malformed base64 auth should fail.": {
+			secret: dockerConfigJSON(`{"auths":{"r.io":{"auth":"not base64!"}}}`),
+			expErr: true,
+		},
+
+		"A docker config JSON with an auth without the separator should fail.": {
+			secret: dockerConfigJSON(`{"auths":{"r.io":{"auth":"dXNlcg=="}}}`),
+			expErr: true,
+		},
+
+		"A docker config JSON without credentials should fail.": {
+			secret: dockerConfigJSON(`{"auths":{"r.io":{"username":"u"}}}`),
+			expErr: true,
+		},
+
+		"A docker config JSON with an empty registry should fail.": {
+			secret: dockerConfigJSON(`{"auths":{"":{"auth":"dTpw"}}}`),
+			expErr: true,
+		},
+
+		"A legacy docker config with malformed JSON should fail.": {
+			secret: &corev1.Secret{
+				Type: corev1.SecretTypeDockercfg,
+				Data: map[string][]byte{corev1.DockerConfigKey: []byte(`[]`)},
+			},
+			expErr: true,
+		},
+
+		"A secret without docker credentials should fail.": {
+			secret: &corev1.Secret{
+				Type: corev1.SecretTypeOpaque,
+				Data: map[string][]byte{"token": []byte("t")},
+			},
+			expErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			err := namespace.ValidateImagePullSecret(test.secret)
+			if test.expErr {
+				assert.Error(err)
+			} else {
+				assert.NoError(err)
+			}
+		})
+	}
+}
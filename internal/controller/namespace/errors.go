@@ -0,0 +1,87 @@
+package namespace
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// ErrorKind is the kind of an error returned by the handler.
+type ErrorKind string
+
+const (
+	// ErrorKindTransient errors could be fixed by themselves, so it's worth retrying.
+	ErrorKindTransient ErrorKind = "transient"
+	// ErrorKindPermanent errors will not be fixed by retrying.
+	ErrorKindPermanent ErrorKind = "permanent"
+)
+
+// HandlerError is a classified error returned by the handler.
+type HandlerError struct {
+	Kind   ErrorKind
+	Reason string
+	// RequeueAfter if set, the handling should be retried after this duration instead
+	// of using a backoff.
+	RequeueAfter time.Duration
+	Err          error
+}
+
+func (h *HandlerError) Error() string {
+	return fmt.Sprintf("%s error (%s): %s", h.Kind, h.Reason, h.Err)
+}
+
+func (h *HandlerError) Unwrap() error { return h.Err }
+
+const reasonNamespaceTerminating = "namespace-terminating"
+
+func transientError(reason string, err error) error {
+	return &HandlerError{Kind: ErrorKindTransient, Reason: reason, Err: err}
+}
+
+func requeueError(reason string, after time.Duration, err error) error {
+	return &HandlerError{Kind: ErrorKindTransient, Reason: reason, RequeueAfter: after, Err: err}
+}
+
+func permanentError(reason string, err error) error {
+	return &HandlerError{Kind: ErrorKindPermanent, Reason: reason, Err: err}
+}
+
+// IsPermanentError returns true if the error is a permanent handler error.
+func IsPermanentError(err error) bool {
+	var herr *HandlerError
+	return errors.As(err, &herr) && herr.Kind == ErrorKindPermanent
+}
+
+// classifyError will return the error as a HandlerError based on the error cause.
+// If is already classified it will return the same error.
+// By default the unknown errors will be classified as transient.
+func classifyError(err error) *HandlerError {
+	var herr *HandlerError
+	if errors.As(err, &herr) {
+		return herr
+	}
+
+	switch {
+	case kubeerrors.HasStatusCause(err, corev1.NamespaceTerminatingCause):
+		return &HandlerError{Kind: ErrorKindPermanent, Reason: reasonNamespaceTerminating, Err: err}
+	case kubeerrors.IsForbidden(err):
+		return &HandlerError{Kind: ErrorKindPermanent, Reason: "forbidden", Err: err}
+	case kubeerrors.IsUnauthorized(err):
+		return &HandlerError{Kind: ErrorKindPermanent, Reason: "unauthorized", Err: err}
+	case kubeerrors.IsInvalid(err), kubeerrors.IsBadRequest(err):
+		return &HandlerError{Kind: ErrorKindPermanent, Reason: "invalid", Err: err}
+	case kubeerrors.IsConflict(err):
+		return &HandlerError{Kind: ErrorKindTransient, Reason: "conflict", Err: err}
+	case kubeerrors.IsTooManyRequests(err):
+		return &HandlerError{Kind: ErrorKindTransient, Reason: "too-many-requests", Err: err}
+	case kubeerrors.IsServerTimeout(err), kubeerrors.IsTimeout(err):
+		return &HandlerError{Kind: ErrorKindTransient, Reason: "timeout", Err: err}
+	case kubeerrors.IsInternalError(err), kubeerrors.IsServiceUnavailable(err), kubeerrors.IsUnexpectedServerError(err):
+		return &HandlerError{Kind: ErrorKindTransient, Reason: "server-error", Err: err}
+	}
+
+	return &HandlerError{Kind: ErrorKindTransient, Reason: "unknown", Err: err}
+}
@@ -0,0 +1,333 @@
+package namespace
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/operators"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Variables available on the CEL expressions.
+const (
+	// expressionVarNamespace is the complete namespace object (e.g `object.metadata.creationTimestamp`).
+	expressionVarNamespace = "object"
+	// expressionVarName is the namespace name.
+	expressionVarName = "name"
+	// expressionVarLabels are the namespace labels, always set, even if the namespace doesn't have labels.
+	expressionVarLabels = "labels"
+	// expressionVarAnnotations are the namespace annotations, always set, even if the namespace doesn't have annotations.
+	expressionVarAnnotations = "annotations"
+)
+
+// ExpressionsConfig are the CEL expressions evaluated over each namespace, the empty
+// expressions are not evaluated.
+type ExpressionsConfig struct {
+	// Select returns a bool, if false the namespace will be ignored.
+	Select string
+	// SecretName returns a string with the image pull secret name on the namespace, if
+	// empty the default will be used.
+	SecretName string
+	// ServiceAccounts returns a list of strings with the service accounts that will reference
+	// the image pull secret, if empty the default will be used.
+	ServiceAccounts string
+}
+
+// Expressions are the compiled CEL expressions used to make per-namespace decisions.
+// The namespace annotations have priority over the expressions.
+type Expressions struct {
+	selectPrg          *expression
+	secretNamePrg      *expression
+	serviceAccountsPrg *expression
+}
+
+// expression is a compiled CEL expression.
+type expression struct {
+	prg cel.Program
+	// paths are the constant key paths accessed by the expression (e.g `labels.team`).
+	paths []accessPath
+}
+
+// accessPath is a constant key path accessed on a variable, like `labels["team"]` or
+// `object.metadata.name`.
+type accessPath struct {
+	variable string
+	keys     []string
+}
+
+// NewExpressions compiles the CEL expressions.
+func NewExpressions(config ExpressionsConfig) (*Expressions, error) {
+	env, err := cel.NewEnv(
+		cel.Variable(expressionVarNamespace, cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable(expressionVarName, cel.StringType),
+		cel.Variable(expressionVarLabels, cel.MapType(cel.StringType, cel.StringType)),
+		cel.Variable(expressionVarAnnotations, cel.MapType(cel.StringType, cel.StringType)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not create CEL environment: %w", err)
+	}
+
+	e := &Expressions{}
+	e.selectPrg, err = compileExpression(env, config.Select, cel.BoolType)
+	if err != nil {
+		return nil, fmt.Errorf("invalid select expression: %w", err)
+	}
+
+	e.secretNamePrg, err = compileExpression(env, config.SecretName, cel.StringType)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret name expression: %w", err)
+	}
+
+	e.serviceAccountsPrg, err = compileExpression(env, config.ServiceAccounts, cel.ListType(cel.StringType))
+	if err != nil {
+		return nil, fmt.Errorf("invalid service accounts expression: %w", err)
+	}
+
+	return e, nil
+}
+
+// compileExpression compiles the expression checking the result type, empty expressions
+// return a nil expression.
+func compileExpression(env *cel.Env, expr string, resultType *cel.Type) (*expression, error) {
+	if expr == "" {
+		return nil, nil
+	}
+
+	ast, iss := env.Compile(expr)
+	if iss.Err() != nil {
+		return nil, iss.Err()
+	}
+
+	// Dynamic results (e.g fields of the namespace object) are checked on evaluation.
+	t := ast.OutputType()
+	if t.String() != resultType.String() && t.String() != cel.DynType.String() {
+		return nil, fmt.Errorf("expression must return %s, got %s", resultType, t)
+	}
+
+	prg, err := env.Program(ast)
+	if err != nil {
+		return nil, fmt.Errorf("could not create program: %w", err)
+	}
+
+	return &expression{prg: prg, paths: accessPaths(ast.Expr())}, nil
+}
+
+// accessPaths returns the constant key paths accessed by the expression, the presence
+// tests (`has(...)`) are not accesses.
+func accessPaths(e *exprpb.Expr) []accessPath {
+	paths := []accessPath{}
+	var walk func(e *exprpb.Expr)
+	walk = func(e *exprpb.Expr) {
+		if e == nil {
+			return
+		}
+
+		if path, ok := exprAccessPath(e); ok && len(path.keys) > 0 {
+			paths = append(paths, path)
+		}
+
+		switch k := e.ExprKind.(type) {
+		case *exprpb.Expr_SelectExpr:
+			walk(k.SelectExpr.Operand)
+		case *exprpb.Expr_CallExpr:
+			walk(k.CallExpr.Target)
+			for _, arg := range k.CallExpr.Args {
+				walk(arg)
+			}
+		case *exprpb.Expr_ListExpr:
+			for _, elem := range k.ListExpr.Elements {
+				walk(elem)
+			}
+		case *exprpb.Expr_StructExpr:
+			for _, entry := range k.StructExpr.Entries {
+				walk(entry.GetMapKey())
+				walk(entry.Value)
+			}
+		case *exprpb.Expr_ComprehensionExpr:
+			c := k.ComprehensionExpr
+			walk(c.IterRange)
+			walk(c.AccuInit)
+			walk(c.LoopCondition)
+			walk(c.LoopStep)
+			walk(c.Result)
+		}
+	}
+	walk(e)
+
+	return paths
+}
+
+// exprAccessPath returns the access path of a field selection or constant index chain
+// starting on a variable.
+func exprAccessPath(e *exprpb.Expr) (accessPath, bool) {
+	switch k := e.ExprKind.(type) {
+	case *exprpb.Expr_IdentExpr:
+		return accessPath{variable: k.IdentExpr.Name}, true
+
+	case *exprpb.Expr_SelectExpr:
+		if k.SelectExpr.TestOnly {
+			return accessPath{}, false
+		}
+		path, ok := exprAccessPath(k.SelectExpr.Operand)
+		if !ok {
+			return accessPath{}, false
+		}
+		return accessPath{variable: path.variable, keys: append(append([]string{}, path.keys...), k.SelectExpr.Field)}, true
+
+	case *exprpb.Expr_CallExpr:
+		call := k.CallExpr
+		if call.Function != operators.Index || len(call.Args) != 2 {
+			return accessPath{}, false
+		}
+		key, ok := call.Args[1].ExprKind.(*exprpb.Expr_ConstExpr)
+		if !ok {
+			return accessPath{}, false
+		}
+		keyStr, ok := key.ConstExpr.ConstantKind.(*exprpb.Constant_StringValue)
+		if !ok {
+			return accessPath{}, false
+		}
+		path, ok := exprAccessPath(call.Args[0])
+		if !ok {
+			return accessPath{}, false
+		}
+		return accessPath{variable: path.variable, keys: append(append([]string{}, path.keys...), keyStr.StringValue)}, true
+	}
+
+	return accessPath{}, false
+}
+
+// missing returns true if the path is not present on the variables. The paths that go
+// through values that are not maps (e.g lists) are considered present.
+func (a accessPath) missing(vars map[string]interface{}) bool {
+	v, ok := vars[a.variable]
+	if !ok {
+		return false
+	}
+
+	for _, key := range a.keys {
+		switch m := v.(type) {
+		case map[string]interface{}:
+			v, ok = m[key]
+		case map[string]string:
+			v, ok = m[key]
+		default:
+			return false
+		}
+		if !ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// namespaceDecision is the result of evaluating the expressions over a namespace, the
+// empty values mean the expression was not set or didn't return a value.
+type namespaceDecision struct {
+	selected        bool
+	secretName      string
+	serviceAccounts []string
+}
+
+// validate validates the values returned by the expressions.
+func (n namespaceDecision) validate() error {
+	if n.secretName != "" {
+		if msgs := validation.IsDNS1123Subdomain(n.secretName); len(msgs) > 0 {
+			return fmt.Errorf("invalid secret name %q: %s", n.secretName, strings.Join(msgs, ", "))
+		}
+	}
+
+	for _, sa := range n.serviceAccounts {
+		if msgs := validation.IsDNS1123Subdomain(sa); len(msgs) > 0 {
+			return fmt.Errorf("invalid service account %q: %s", sa, strings.Join(msgs, ", "))
+		}
+	}
+
+	return nil
+}
+
+// eval evaluates the expressions over the namespace.
+//
+// The expressions accessing missing keys (e.g `labels.team` on a namespace without that
+// label) don't match: the namespace is not selected and the defaults are used. This way
+// the namespace is evaluated again when its metadata changes, instead of failing for good.
+func (e *Expressions) eval(ns *corev1.Namespace) (namespaceDecision, error) {
+	decision := namespaceDecision{selected: true}
+	if e == nil {
+		return decision, nil
+	}
+
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(ns)
+	if err != nil {
+		return decision, fmt.Errorf("could not convert namespace: %w", err)
+	}
+	vars := map[string]interface{}{
+		expressionVarNamespace:   obj,
+		expressionVarName:        ns.Name,
+		expressionVarLabels:      nonNilKV(ns.Labels),
+		expressionVarAnnotations: nonNilKV(ns.Annotations),
+	}
+
+	if e.selectPrg != nil {
+		err := evalExpression(e.selectPrg, vars, &decision.selected)
+		if err != nil {
+			return decision, fmt.Errorf("could not evaluate select expression: %w", err)
+		}
+		if !decision.selected {
+			return decision, nil
+		}
+	}
+
+	if e.secretNamePrg != nil {
+		err := evalExpression(e.secretNamePrg, vars, &decision.secretName)
+		if err != nil {
+			return decision, fmt.Errorf("could not evaluate secret name expression: %w", err)
+		}
+	}
+
+	if e.serviceAccountsPrg != nil {
+		err := evalExpression(e.serviceAccountsPrg, vars, &decision.serviceAccounts)
+		if err != nil {
+			return decision, fmt.Errorf("could not evaluate service accounts expression: %w", err)
+		}
+	}
+
+	return decision, nil
+}
+
+// evalExpression evaluates the expression and stores the result on the received pointer.
+// If the evaluation fails accessing keys missing on the variables, the zero value is stored.
+func evalExpression(expr *expression, vars map[string]interface{}, res interface{}) error {
+	target := reflect.ValueOf(res).Elem()
+	out, _, err := expr.prg.Eval(vars)
+	if err != nil {
+		for _, path := range expr.paths {
+			if path.missing(vars) {
+				target.Set(reflect.Zero(target.Type()))
+				return nil
+			}
+		}
+		return err
+	}
+
+	v, err := out.ConvertToNative(target.Type())
+	if err != nil {
+		return fmt.Errorf("invalid result: %w", err)
+	}
+	target.Set(reflect.ValueOf(v))
+
+	return nil
+}
+
+func nonNilKV(kv map[string]string) map[string]string {
+	if kv == nil {
+		return map[string]string{}
+	}
+	return kv
+}
@@ -0,0 +1,186 @@
+package namespace_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/slok/imagepull-controller-workshop/internal/controller/namespace"
+)
+
+func TestNewExpressions(t *testing.T) {
+	tests := map[string]struct {
+		config namespace.ExpressionsConfig
+		expErr bool
+	}{
+		"Valid expressions should compile.": {
+			config: namespace.ExpressionsConfig{
+				Select:          `labels.team == "a" && has(annotations.owner)`,
+				SecretName:      `name + "-creds"`,
+				ServiceAccounts: `["default", labels["team"]]`,
+			},
+		},
+
+		"Dynamic results should compile, they are checked on evaluation.": {
+			config: namespace.ExpressionsConfig{
+				Select: `object.metadata.name`,
+			},
+		},
+
+		"A select expression with a syntax error should fail.": {
+			config: namespace.ExpressionsConfig{Select: `labels.team ==`},
+			expErr: true,
+		},
+
+		"An expression with unknown variables should fail.": {
+			config: namespace.ExpressionsConfig{Select: `team == "a"`},
+			expErr: true,
+		},
+
+		"A select expression not returning a bool should fail.": {
+			config: namespace.ExpressionsConfig{Select: `name`},
+			expErr: true,
+		},
+
+		"A secret name expression not returning a string should fail.": {
+			config: namespace.ExpressionsConfig{SecretName: `name == "a"`},
+			expErr: true,
+		},
+
+		"A service accounts expression not returning a list of strings should fail.": {
+			config: namespace.ExpressionsConfig{ServiceAccounts: `[1, 2]`},
+			expErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			_, err := namespace.NewExpressions(test.config)
+			if test.expErr {
+				assert.Error(err)
+			} else {
+				assert.NoError(err)
+			}
+		})
+	}
+}
+
+func TestHandlerExpressions(t *testing.T) {
+	tests := map[string]struct {
+		labels      map[string]string
+		annotations map[string]string
+		config      namespace.ExpressionsConfig
+		// expSecretName is the replicated secret name, empty if not replicated.
+		expSecretName string
+		expErr        bool
+	}{
+		"A namespace selected by the expression should be handled.": {
+			labels:        map[string]string{"team": "a"},
+			config:        namespace.ExpressionsConfig{Select: `labels.team == "a"`},
+			expSecretName: "creds",
+		},
+
+		"A namespace not selected by the expression should be ignored.": {
+			labels: map[string]string{"team": "b"},
+			config: namespace.ExpressionsConfig{Select: `labels.team == "a"`},
+		},
+
+		"A select expression on a missing label should not match.": {
+			config: namespace.ExpressionsConfig{Select: `labels.team == "a"`},
+		},
+
+		"A select expression indexing a missing label should not match.": {
+			labels: map[string]string{"other": "a"},
+			config: namespace.ExpressionsConfig{Select: `labels["team"] == "a"`},
+		},
+
+		"A select expression on a missing annotation should not match.": {
+			config: namespace.ExpressionsConfig{Select: `annotations.owner == "a"`},
+		},
+
+		"A select expression on a missing object field should not match.": {
+			config: namespace.ExpressionsConfig{Select: `object.metadata.labels.team == "a"`},
+		},
+
+		"A select expression guarding a missing label should be evaluated.": {
+			config:        namespace.ExpressionsConfig{Select: `!has(labels.team) || labels.team == "a"`},
+			expSecretName: "creds",
+		},
+
+		"A select expression with a dynamic non bool result should fail.": {
+			config: namespace.ExpressionsConfig{Select: `object.metadata.name`},
+			expErr: true,
+		},
+
+		"A select expression failing without missing keys should fail.": {
+			labels: map[string]string{"team": "a"},
+			config: namespace.ExpressionsConfig{Select: `int(labels.team) > 0`},
+			expErr: true,
+		},
+
+		"A secret name expression should set the secret name.": {
+			labels:        map[string]string{"team": "a"},
+			config:        namespace.ExpressionsConfig{SecretName: `labels.team + "-creds"`},
+			expSecretName: "a-creds",
+		},
+
+		"A secret name expression on a missing label should use the default secret name.": {
+			config:        namespace.ExpressionsConfig{SecretName: `labels.team + "-creds"`},
+			expSecretName: "creds",
+		},
+
+		"A secret name expression returning an invalid name should fail.": {
+			config: namespace.ExpressionsConfig{SecretName: `"Invalid_Name"`},
+			expErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			ns := testNamespace("test-ns")
+			ns.Labels = test.labels
+			ns.Annotations = test.annotations
+
+			repo := newFakeRepo()
+			repo.addNamespace(ns)
+			repo.addSecret(testSourceSecret("source-ns", "creds", "dXNlcjpwYXNz"))
+			repo.addServiceAccount(&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "test-ns", Name: "default"}})
+
+			exprs, err := namespace.NewExpressions(test.config)
+			require.NoError(err)
+			h, err := namespace.NewHandler(namespace.HandlerConfig{
+				RunningNamespace:       "source-ns",
+				ImagePullSecretName:    "creds",
+				DisableNamespaceStatus: true,
+				Expressions:            exprs,
+				K8sRepo:                repo,
+			})
+			require.NoError(err)
+
+			err = h.Handle(context.TODO(), ns)
+			if test.expErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+
+			sl, err := repo.ListSecrets(context.TODO(), "test-ns", metav1.ListOptions{})
+			require.NoError(err)
+			if test.expSecretName == "" {
+				assert.Empty(sl.Items)
+				return
+			}
+			require.Len(sl.Items, 1)
+			assert.Equal(test.expSecretName, sl.Items[0].Name)
+		})
+	}
+}
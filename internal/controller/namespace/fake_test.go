@@ -0,0 +1,237 @@
+package namespace_test
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// fakeRepo is an in memory Kubernetes repository that counts the writes.
+type fakeRepo struct {
+	mu         sync.Mutex
+	namespaces map[string]*corev1.Namespace
+	secrets    map[string]*corev1.Secret
+	configMaps map[string]*corev1.ConfigMap
+	sas        map[string]*corev1.ServiceAccount
+	pods       map[string][]corev1.Pod
+	// writes are the number of write calls by method.
+	writes map[string]int
+}
+
+func newFakeRepo() *fakeRepo {
+	return &fakeRepo{
+		namespaces: map[string]*corev1.Namespace{},
+		secrets:    map[string]*corev1.Secret{},
+		configMaps: map[string]*corev1.ConfigMap{},
+		sas:        map[string]*corev1.ServiceAccount{},
+		pods:       map[string][]corev1.Pod{},
+		writes:     map[string]int{},
+	}
+}
+
+func key(ns, name string) string { return ns + "/" + name }
+
+func notFound(resource, name string) error {
+	return kubeerrors.NewNotFound(corev1.Resource(resource), name)
+}
+
+func (f *fakeRepo) writeCount(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.writes[method]
+}
+
+func (f *fakeRepo) addNamespace(ns *corev1.Namespace) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.namespaces[ns.Name] = ns.DeepCopy()
+}
+
+func (f *fakeRepo) addSecret(s *corev1.Secret) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.secrets[key(s.Namespace, s.Name)] = s.DeepCopy()
+}
+
+func (f *fakeRepo) addServiceAccount(sa *corev1.ServiceAccount) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sas[key(sa.Namespace, sa.Name)] = sa.DeepCopy()
+}
+
+func (f *fakeRepo) GetNamespace(_ context.Context, name string) (*corev1.Namespace, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ns, ok := f.namespaces[name]
+	if !ok {
+		return nil, notFound("namespaces", name)
+	}
+	return ns.DeepCopy(), nil
+}
+
+func (f *fakeRepo) ListNamespaces(_ context.Context, _ metav1.ListOptions) (*corev1.NamespaceList, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	nsl := &corev1.NamespaceList{}
+	for _, ns := range f.namespaces {
+		nsl.Items = append(nsl.Items, *ns.DeepCopy())
+	}
+	return nsl, nil
+}
+
+func (f *fakeRepo) PatchNamespaceAnnotations(_ context.Context, name string, annotations map[string]*string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.writes["PatchNamespaceAnnotations"]++
+	ns, ok := f.namespaces[name]
+	if !ok {
+		return notFound("namespaces", name)
+	}
+	if ns.Annotations == nil {
+		ns.Annotations = map[string]string{}
+	}
+	for k, v := range annotations {
+		if v == nil {
+			delete(ns.Annotations, k)
+			continue
+		}
+		ns.Annotations[k] = *v
+	}
+	return nil
+}
+
+func (f *fakeRepo) GetSecret(_ context.Context, ns, name string) (*corev1.Secret, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.secrets[key(ns, name)]
+	if !ok {
+		return nil, notFound("secrets", name)
+	}
+	return s.DeepCopy(), nil
+}
+
+func (f *fakeRepo) ListSecrets(_ context.Context, ns string, options metav1.ListOptions) (*corev1.SecretList, error) {
+	selector, err := labels.Parse(options.LabelSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sl := &corev1.SecretList{}
+	for _, s := range f.secrets {
+		if s.Namespace == ns && selector.Matches(labels.Set(s.Labels)) {
+			sl.Items = append(sl.Items, *s.DeepCopy())
+		}
+	}
+	return sl, nil
+}
+
+func (f *fakeRepo) EnsureSecret(_ context.Context, s *corev1.Secret) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.writes["EnsureSecret"]++
+	f.secrets[key(s.Namespace, s.Name)] = s.DeepCopy()
+	return nil
+}
+
+func (f *fakeRepo) DeleteSecret(_ context.Context, ns, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.writes["DeleteSecret"]++
+	if _, ok := f.secrets[key(ns, name)]; !ok {
+		return notFound("secrets", name)
+	}
+	delete(f.secrets, key(ns, name))
+	return nil
+}
+
+func (f *fakeRepo) GetConfigMap(_ context.Context, ns, name string) (*corev1.ConfigMap, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cm, ok := f.configMaps[key(ns, name)]
+	if !ok {
+		return nil, notFound("configmaps", name)
+	}
+	return cm.DeepCopy(), nil
+}
+
+func (f *fakeRepo) EnsureConfigMap(_ context.Context, cm *corev1.ConfigMap) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.writes["EnsureConfigMap"]++
+	f.configMaps[key(cm.Namespace, cm.Name)] = cm.DeepCopy()
+	return nil
+}
+
+func (f *fakeRepo) GetServiceAccount(_ context.Context, ns, name string) (*corev1.ServiceAccount, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sa, ok := f.sas[key(ns, name)]
+	if !ok {
+		return nil, notFound("serviceaccounts", name)
+	}
+	return sa.DeepCopy(), nil
+}
+
+func (f *fakeRepo) EnsureServiceAccount(_ context.Context, sa *corev1.ServiceAccount) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.writes["EnsureServiceAccount"]++
+	f.sas[key(sa.Namespace, sa.Name)] = sa.DeepCopy()
+	return nil
+}
+
+func (f *fakeRepo) ListPods(_ context.Context, ns string, _ metav1.ListOptions) (*corev1.PodList, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &corev1.PodList{Items: append([]corev1.Pod{}, f.pods[ns]...)}, nil
+}
+
+// fakeTrigger records the triggered namespaces.
+type fakeTrigger struct {
+	mu        sync.Mutex
+	triggered []string
+	afters    []time.Duration
+}
+
+func (f *fakeTrigger) Trigger(ctx context.Context, ns string) error {
+	return f.TriggerAfter(ctx, ns, 0)
+}
+
+func (f *fakeTrigger) TriggerAfter(_ context.Context, ns string, after time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.triggered = append(f.triggered, ns)
+	f.afters = append(f.afters, after)
+	return nil
+}
+
+// pop returns and removes the triggered namespaces.
+func (f *fakeTrigger) pop() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := f.triggered
+	f.triggered, f.afters = nil, nil
+	return t
+}
+
+func testNamespace(name string) *corev1.Namespace {
+	return &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status:     corev1.NamespaceStatus{Phase: corev1.NamespaceActive},
+	}
+}
+
+func testSourceSecret(ns, name, value string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name, UID: "source-uid", ResourceVersion: "1"},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data:       map[string][]byte{corev1.DockerConfigJsonKey: []byte(`{"auths":{"registry.example.com":{"auth":"` + value + `"}}}`)},
+	}
+}
@@ -0,0 +1,229 @@
+package namespace
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/spotahome/kooper/v2/controller"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/slok/imagepull-controller-workshop/internal/log"
+	"github.com/slok/imagepull-controller-workshop/internal/notify"
+)
+
+// FanOutRepository is the service used by the fan-out tracker to get the namespaces.
+type FanOutRepository interface {
+	ListNamespaces(ctx context.Context, options metav1.ListOptions) (*corev1.NamespaceList, error)
+}
+
+// FanOutTrackerConfig is the fan-out tracker configuration.
+type FanOutTrackerConfig struct {
+	// SecretNamespace and SecretName identify the image pull secret source.
+	SecretNamespace string
+	SecretName      string
+	// CheckInterval is the interval between the fan-out completion checks.
+	CheckInterval time.Duration
+	K8sRepo       FanOutRepository
+	Notifier      notify.Notifier
+	Logger        log.Logger
+}
+
+func (c *FanOutTrackerConfig) defaults() error {
+	if c.SecretNamespace == "" || c.SecretName == "" {
+		return fmt.Errorf("secret namespace and name are required")
+	}
+
+	if c.CheckInterval <= 0 {
+		c.CheckInterval = 10 * time.Second
+	}
+
+	if c.K8sRepo == nil {
+		return fmt.Errorf("kubernetes repository is required")
+	}
+
+	if c.Notifier == nil {
+		c.Notifier = notify.Noop
+	}
+
+	if c.Logger == nil {
+		c.Logger = log.Noop
+	}
+	c.Logger = c.Logger.WithValues(log.Kv{"svc": "controller.namespace.FanOutTracker"})
+
+	return nil
+}
+
+// fanOut is the propagation of a source version to the namespaces.
+type fanOut struct {
+	startedAt time.Time
+	// handled are the namespaces handled successfully since the fan-out started.
+	handled map[string]struct{}
+}
+
+// FanOutTracker tracks the propagation of the image pull secret source changes and
+// notifies once, when the new version has been handled successfully on all the namespaces
+// of the cluster.
+//
+// A namespace is handled when a handling started after the source change succeeds, the
+// namespaces ignored by the handler (e.g opted out) count as handled. The namespaces deleted
+// during the fan-out are not waited for, and a new source change replaces the fan-out in
+// progress.
+type FanOutTracker struct {
+	secretNamespace string
+	secretName      string
+	checkInterval   time.Duration
+	k8sRepo         FanOutRepository
+	notifier        notify.Notifier
+	logger          log.Logger
+
+	mu       sync.Mutex
+	lastHash string
+	current  *fanOut
+}
+
+// NewFanOutTracker returns a new FanOutTracker.
+func NewFanOutTracker(config FanOutTrackerConfig) (*FanOutTracker, error) {
+	err := config.defaults()
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	return &FanOutTracker{
+		secretNamespace: config.SecretNamespace,
+		secretName:      config.SecretName,
+		checkInterval:   config.CheckInterval,
+		k8sRepo:         config.K8sRepo,
+		notifier:        config.Notifier,
+		logger:          config.Logger,
+	}, nil
+}
+
+// SourceHandler wraps the source secret handler (e.g the secret cache handler) so the fan-out
+// starts once the source change is available to the namespace handlings.
+func (f *FanOutTracker) SourceHandler(next controller.Handler) controller.Handler {
+	return controller.HandlerFunc(func(ctx context.Context, obj runtime.Object) error {
+		err := next.Handle(ctx, obj)
+		if err != nil {
+			return err
+		}
+
+		secret, ok := obj.(*corev1.Secret)
+		if !ok || secret.Namespace != f.secretNamespace || secret.Name != f.secretName {
+			return nil
+		}
+
+		hash := secretContentHash(secret)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		// The first version seen is not a change.
+		if f.lastHash == "" || f.lastHash == hash {
+			f.lastHash = hash
+			return nil
+		}
+		f.lastHash = hash
+
+		if f.current != nil {
+			f.logger.Infof("Source changed again before the fan-out completion, restarting the fan-out")
+		}
+		f.current = &fanOut{startedAt: time.Now(), handled: map[string]struct{}{}}
+
+		return nil
+	})
+}
+
+// NamespaceHandler wraps the namespace handler so the tracker knows the namespaces handled.
+// It needs to wrap the handler before the retries, so the requeued handlings are not
+// considered handled.
+func (f *FanOutTracker) NamespaceHandler(next controller.Handler) controller.Handler {
+	return controller.HandlerFunc(func(ctx context.Context, obj runtime.Object) error {
+		ns, ok := obj.(*corev1.Namespace)
+		if !ok {
+			return next.Handle(ctx, obj)
+		}
+
+		start := time.Now()
+		err := next.Handle(ctx, obj)
+		if err != nil {
+			return err
+		}
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.current != nil && !start.Before(f.current.startedAt) {
+			f.current.handled[ns.Name] = struct{}{}
+		}
+
+		return nil
+	})
+}
+
+// Run checks the completion of the fan-out in progress until the context is done.
+func (f *FanOutTracker) Run(ctx context.Context) error {
+	t := time.NewTicker(f.checkInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+			err := f.check(ctx)
+			if err != nil {
+				f.logger.Warningf("could not check fan-out completion, retrying on next check: %s", err)
+			}
+		}
+	}
+}
+
+// check notifies the completion of the fan-out in progress if all the current namespaces
+// have been handled.
+func (f *FanOutTracker) check(ctx context.Context) error {
+	f.mu.Lock()
+	current := f.current
+	f.mu.Unlock()
+	if current == nil {
+		return nil
+	}
+
+	nsl, err := f.k8sRepo.ListNamespaces(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list namespaces: %w", err)
+	}
+
+	f.mu.Lock()
+	// The fan-out could have been replaced while listing.
+	if f.current != current {
+		f.mu.Unlock()
+		return nil
+	}
+	total := 0
+	for _, ns := range nsl.Items {
+		// Terminating namespaces are not handled.
+		if ns.Status.Phase == corev1.NamespaceTerminating || ns.DeletionTimestamp != nil {
+			continue
+		}
+		if _, ok := current.handled[ns.Name]; !ok {
+			f.mu.Unlock()
+			return nil
+		}
+		total++
+	}
+	f.current = nil
+	f.mu.Unlock()
+
+	duration := time.Since(current.startedAt).Round(time.Second)
+	f.logger.Infof("Source change handled on all the %d namespaces in %s", total, duration)
+	f.notifier.Notify(ctx, notify.Event{
+		Type:      notify.EventTypeFanOutCompleted,
+		Namespace: f.secretNamespace,
+		Kind:      string(ResourceKindSecret),
+		Name:      f.secretName,
+		Message:   fmt.Sprintf("handled on %d namespaces in %s", total, duration),
+	})
+
+	return nil
+}
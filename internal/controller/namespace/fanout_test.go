@@ -0,0 +1,134 @@
+package namespace_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spotahome/kooper/v2/controller"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/slok/imagepull-controller-workshop/internal/controller/namespace"
+	"github.com/slok/imagepull-controller-workshop/internal/notify"
+)
+
+// fakeNotifier records the notified events.
+type fakeNotifier struct {
+	mu     sync.Mutex
+	events []notify.Event
+}
+
+func (f *fakeNotifier) Notify(_ context.Context, e notify.Event) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events = append(f.events, e)
+}
+
+func (f *fakeNotifier) notified() []notify.Event {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]notify.Event{}, f.events...)
+}
+
+func TestFanOutTracker(t *testing.T) {
+	tests := map[string]struct {
+		// changeSource changes the source secret after the first version.
+		changeSource bool
+		// failing are the namespaces failing the handlings.
+		failing map[string]bool
+		// deleted are the namespaces deleted after the source change.
+		deleted      []string
+		expCompleted bool
+	}{
+		"The first version of the source should not start a fan-out.": {
+			changeSource: false,
+		},
+
+		"A source change handled on all the namespaces should notify the completion.": {
+			changeSource: true,
+			expCompleted: true,
+		},
+
+		"A source change with a namespace failing should not notify the completion.": {
+			changeSource: true,
+			failing:      map[string]bool{"ns-2": true},
+		},
+
+		"A source change with a failing namespace deleted should notify the completion.": {
+			changeSource: true,
+			failing:      map[string]bool{"ns-2": true},
+			deleted:      []string{"ns-2"},
+			expCompleted: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			repo := newFakeRepo()
+			for _, ns := range []string{"ns-1", "ns-2", "ns-3"} {
+				repo.addNamespace(testNamespace(ns))
+			}
+
+			notifier := &fakeNotifier{}
+			tracker, err := namespace.NewFanOutTracker(namespace.FanOutTrackerConfig{
+				SecretNamespace: "source-ns",
+				SecretName:      "creds",
+				CheckInterval:   time.Millisecond,
+				K8sRepo:         repo,
+				Notifier:        notifier,
+			})
+			require.NoError(err)
+
+			sourceHandler := tracker.SourceHandler(noopHandler)
+			nsHandler := tracker.NamespaceHandler(controller.HandlerFunc(func(_ context.Context, obj runtime.Object) error {
+				if test.failing[obj.(*corev1.Namespace).Name] {
+					return fmt.Errorf("something")
+				}
+				return nil
+			}))
+
+			err = sourceHandler.Handle(context.TODO(), testSourceSecret("source-ns", "creds", "djE6djE="))
+			require.NoError(err)
+			if test.changeSource {
+				err = sourceHandler.Handle(context.TODO(), testSourceSecret("source-ns", "creds", "djI6djI="))
+				require.NoError(err)
+			}
+			for _, ns := range test.deleted {
+				repo.mu.Lock()
+				delete(repo.namespaces, ns)
+				repo.mu.Unlock()
+			}
+
+			for _, ns := range []string{"ns-1", "ns-2", "ns-3"} {
+				_ = nsHandler.Handle(context.TODO(), testNamespace(ns))
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go func() { _ = tracker.Run(ctx) }()
+
+			if !test.expCompleted {
+				time.Sleep(50 * time.Millisecond)
+				assert.Empty(notifier.notified())
+				return
+			}
+
+			require.Eventually(func() bool { return len(notifier.notified()) > 0 }, time.Second, time.Millisecond)
+			// Only once.
+			time.Sleep(20 * time.Millisecond)
+			events := notifier.notified()
+			require.Len(events, 1)
+			assert.Equal(notify.EventTypeFanOutCompleted, events[0].Type)
+			assert.Equal("source-ns", events[0].Namespace)
+			assert.Equal("creds", events[0].Name)
+		})
+	}
+}
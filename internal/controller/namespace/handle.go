@@ -3,30 +3,79 @@ package namespace
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/spotahome/kooper/v2/controller"
+	"go.opentelemetry.io/otel/attribute"
 	corev1 "k8s.io/api/core/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 
 	"github.com/slok/imagepull-controller-workshop/internal/log"
+	"github.com/slok/imagepull-controller-workshop/internal/metrics"
+	"github.com/slok/imagepull-controller-workshop/internal/notify"
+	"github.com/slok/imagepull-controller-workshop/internal/tracing"
 )
 
 // HandlerRepository is the service to manage k8s resources by the Kubernetes controller handler.
 type HandlerRepository interface {
 	GetSecret(ctx context.Context, ns string, name string) (*corev1.Secret, error)
+	ListSecrets(ctx context.Context, ns string, options metav1.ListOptions) (*corev1.SecretList, error)
 	EnsureSecret(ctx context.Context, secret *corev1.Secret) error
+	DeleteSecret(ctx context.Context, ns string, name string) error
+	GetConfigMap(ctx context.Context, ns string, name string) (*corev1.ConfigMap, error)
+	EnsureConfigMap(ctx context.Context, cm *corev1.ConfigMap) error
 	GetServiceAccount(ctx context.Context, ns string, name string) (*corev1.ServiceAccount, error)
 	EnsureServiceAccount(ctx context.Context, sa *corev1.ServiceAccount) error
+	PatchNamespaceAnnotations(ctx context.Context, name string, annotations map[string]*string) error
 }
 
+// EventRecorder knows how to record Kubernetes events.
+type EventRecorder interface {
+	Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{})
+}
+
+type noopEventRecorder struct{}
+
+func (noopEventRecorder) Eventf(runtime.Object, string, string, string, ...interface{}) {}
+
 // HandlerConfig is the handler configuration.
 type HandlerConfig struct {
 	RunningNamespace      string
 	ImagePullSecretName   string
 	SaImagePullSecretName string
-	K8sRepo               HandlerRepository
-	Logger                log.Logger
+	// Resources are the resources replicated on the namespaces besides the image pull secret.
+	Resources           []Resource
+	ServiceAccountNames []string
+	// ServiceAccountWaitDelay is the delay used to requeue the namespace when the service
+	// accounts don't exist yet.
+	ServiceAccountWaitDelay time.Duration
+	ConflictPolicy          ConflictPolicy
+	// DisableNamespaceStatus disables writing the sync status annotations on the namespaces.
+	DisableNamespaceStatus bool
+	LabelFilter            MetadataFilter
+	AnnotationFilter       MetadataFilter
+	// ImmutableSecrets enables the blue/green mode, the image pull secrets are replicated as
+	// immutable secrets named with their content hash and the service accounts are switched
+	// to the new version on every change.
+	ImmutableSecrets bool
+	// ImmutableSecretsGracePeriod is the duration the replaced immutable secrets are kept
+	// before being garbage collected.
+	ImmutableSecretsGracePeriod time.Duration
+	// Rollout when set, rolls out the image pull secret source changes using canary namespaces.
+	Rollout *Rollout
+	// Expressions are the CEL expressions evaluated over each namespace to decide
+	// the handling, optional.
+	Expressions *Expressions
+	// RegistryAliases are used to expand the registries of the replicated docker config JSON secrets.
+	RegistryAliases RegistryAliases
+	K8sRepo         HandlerRepository
+	EventRecorder   EventRecorder
+	MetricsRecorder metrics.Recorder
+	// Notifier is notified when a resource copy is written on a namespace.
+	Notifier notify.Notifier
+	Logger   log.Logger
 }
 
 func (c *HandlerConfig) defaults() error {
@@ -42,10 +91,55 @@ func (c *HandlerConfig) defaults() error {
 		c.SaImagePullSecretName = c.ImagePullSecretName
 	}
 
+	for i := range c.Resources {
+		if err := c.Resources[i].defaults(); err != nil {
+			return fmt.Errorf("invalid %q resource: %w", c.Resources[i].Name, err)
+		}
+	}
+
+	if len(c.ServiceAccountNames) == 0 {
+		c.ServiceAccountNames = []string{"default"}
+	}
+
+	if c.ServiceAccountWaitDelay <= 0 {
+		c.ServiceAccountWaitDelay = 5 * time.Second
+	}
+
+	if c.ImmutableSecretsGracePeriod <= 0 {
+		c.ImmutableSecretsGracePeriod = time.Hour
+	}
+
+	if c.ConflictPolicy == "" {
+		c.ConflictPolicy = ConflictPolicySkip
+	}
+	if err := c.ConflictPolicy.validate(); err != nil {
+		return err
+	}
+
+	if c.LabelFilter.Deny == nil {
+		c.LabelFilter.Deny = DefaultLabelDenyList
+	}
+
+	if c.AnnotationFilter.Deny == nil {
+		c.AnnotationFilter.Deny = DefaultAnnotationDenyList
+	}
+
 	if c.K8sRepo == nil {
 		return fmt.Errorf("kubernetes repository is required")
 	}
 
+	if c.EventRecorder == nil {
+		c.EventRecorder = noopEventRecorder{}
+	}
+
+	if c.MetricsRecorder == nil {
+		c.MetricsRecorder = metrics.Noop
+	}
+
+	if c.Notifier == nil {
+		c.Notifier = notify.Noop
+	}
+
 	if c.Logger == nil {
 		c.Logger = log.Noop
 	}
@@ -55,11 +149,26 @@ func (c *HandlerConfig) defaults() error {
 }
 
 type handler struct {
-	runningNamespace      string
-	imagePullSecretName   string
-	saImagePullSecretName string
-	k8sRepo               HandlerRepository
-	logger                log.Logger
+	runningNamespace            string
+	imagePullSecretName         string
+	saImagePullSecretName       string
+	resources                   []Resource
+	serviceAccountNames         []string
+	serviceAccountWaitDelay     time.Duration
+	conflictPolicy              ConflictPolicy
+	disableNamespaceStatus      bool
+	labelFilter                 MetadataFilter
+	annotationFilter            MetadataFilter
+	immutableSecrets            bool
+	immutableSecretsGracePeriod time.Duration
+	rollout                     *Rollout
+	expressions                 *Expressions
+	registryAliases             RegistryAliases
+	k8sRepo                     HandlerRepository
+	eventRecorder               EventRecorder
+	metricsRecorder             metrics.Recorder
+	notifier                    notify.Notifier
+	logger                      log.Logger
 }
 
 // NewHandler returns the handler for the controller.
@@ -70,79 +179,209 @@ func NewHandler(config HandlerConfig) (controller.Handler, error) {
 	}
 
 	return handler{
-		runningNamespace:      config.RunningNamespace,
-		imagePullSecretName:   config.ImagePullSecretName,
-		saImagePullSecretName: config.SaImagePullSecretName,
-		k8sRepo:               config.K8sRepo,
-		logger:                config.Logger,
+		runningNamespace:            config.RunningNamespace,
+		imagePullSecretName:         config.ImagePullSecretName,
+		saImagePullSecretName:       config.SaImagePullSecretName,
+		resources:                   config.Resources,
+		serviceAccountNames:         config.ServiceAccountNames,
+		serviceAccountWaitDelay:     config.ServiceAccountWaitDelay,
+		conflictPolicy:              config.ConflictPolicy,
+		disableNamespaceStatus:      config.DisableNamespaceStatus,
+		labelFilter:                 config.LabelFilter,
+		annotationFilter:            config.AnnotationFilter,
+		immutableSecrets:            config.ImmutableSecrets,
+		immutableSecretsGracePeriod: config.ImmutableSecretsGracePeriod,
+		rollout:                     config.Rollout,
+		expressions:                 config.Expressions,
+		registryAliases:             config.RegistryAliases,
+		k8sRepo:                     config.K8sRepo,
+		eventRecorder:               config.EventRecorder,
+		metricsRecorder:             config.MetricsRecorder,
+		notifier:                    config.Notifier,
+		logger:                      config.Logger,
 	}, nil
 }
 
-func (h handler) Handle(ctx context.Context, obj runtime.Object) error {
+func (h handler) Handle(ctx context.Context, obj runtime.Object) (err error) {
 	ns, ok := obj.(*corev1.Namespace)
 	if !ok {
 		h.logger.Warningf("controller received object that is not a namespace")
 		return nil
 	}
-	logger := h.logger.WithValues(log.Kv{"k8s-name": ns.Name})
+
+	ctx, span := tracing.Start(ctx, "controller.namespace.Handle", attribute.String("k8s.namespace", ns.Name))
+	defer func() { tracing.End(span, err) }()
+	ctx = tracing.CtxWithLogValues(ctx)
+
+	logger := h.logger.WithCtxValues(ctx).WithValues(log.Kv{"k8s-name": ns.Name})
 
 	// If is our same namespace, ignore handling.
 	if ns.Name == h.runningNamespace {
 		return nil
 	}
 
+	// Terminating namespaces will reject the new resources, nothing to do.
+	if ns.Status.Phase == corev1.NamespaceTerminating || ns.DeletionTimestamp != nil {
+		logger.Debugf("Namespace terminating, ignoring")
+		span.SetAttributes(attribute.String("skip.reason", "terminating"))
+		return nil
+	}
+
 	// Make a copy just in case of global mutation.
 	ns = ns.DeepCopy()
 
-	logger.Infof("Handling namespace")
-
-	// Get secret from running namespace with docker registry credentials.
-	secret, err := h.k8sRepo.GetSecret(ctx, h.runningNamespace, h.imagePullSecretName)
+	// Evaluate the expressions, these set the namespace defaults.
+	decision, err := h.expressions.eval(ns)
+	if err == nil {
+		err = decision.validate()
+	}
 	if err != nil {
-		return fmt.Errorf("could not retrieve docker registry credentials secret: %w", err)
+		h.eventRecorder.Eventf(ns, corev1.EventTypeWarning, "InvalidExpression", "Could not evaluate expressions: %s", err)
+		return permanentError("invalid-expression", err)
 	}
 
-	// Ensure secret on expected namespace.
-	annotations := map[string]string{}
-	for k, v := range secret.Annotations {
-		annotations[k] = v
+	if !decision.selected {
+		logger.Debugf("Namespace not selected by the expression, ignoring")
+		span.SetAttributes(attribute.String("skip.reason", "not-selected"))
+		return nil
 	}
-	annotations["app.kubernetes.io/managed-by"] = "imagepull-controller-workshop"
 
-	newNsSecret := &corev1.Secret{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:        h.saImagePullSecretName,
-			Namespace:   ns.Name,
-			Labels:      secret.Labels,
-			Annotations: annotations,
-		},
-		Data: secret.Data,
-		Type: secret.Type,
+	secretName := h.saImagePullSecretName
+	if decision.secretName != "" {
+		secretName = decision.secretName
+	}
+	serviceAccounts := h.serviceAccountNames
+	if len(decision.serviceAccounts) > 0 {
+		serviceAccounts = decision.serviceAccounts
 	}
 
-	err = h.k8sRepo.EnsureSecret(ctx, newNsSecret)
-	if err != nil {
-		return fmt.Errorf("could not ensure docker registry credentials secret on namespace: %w", err)
+	// Load the namespace specific settings.
+	policy, errs := newNamespacePolicy(ns, secretName, serviceAccounts)
+	for _, err := range errs {
+		logger.Warningf("Ignoring namespace annotation: %s", err)
+		h.eventRecorder.Eventf(ns, corev1.EventTypeWarning, "InvalidAnnotation", "Ignoring annotation: %s", err)
 	}
 
-	// Patch `default` service account on expected namespace.
-	sa, err := h.k8sRepo.GetServiceAccount(ctx, ns.Name, "default")
-	if err != nil {
-		return fmt.Errorf("could not retrieve default service account from namespace: %w", err)
+	if policy.optOut {
+		logger.Debugf("Namespace opted out, ignoring")
+		span.SetAttributes(attribute.String("skip.reason", "opt-out"))
+		return nil
 	}
-	if containsLocalObjectRef(sa.ImagePullSecrets, h.saImagePullSecretName) {
-		// Already set, move along.
-		h.logger.Debugf("'default' service account image pull secet already set")
+
+	if policy.paused {
+		logger.Infof("Namespace handling paused, ignoring")
+		span.SetAttributes(attribute.String("skip.reason", "paused"))
 		return nil
 	}
 
-	sa.ImagePullSecrets = append(sa.ImagePullSecrets, corev1.LocalObjectReference{Name: h.saImagePullSecretName})
-	err = h.k8sRepo.EnsureServiceAccount(ctx, sa)
-	if err != nil {
-		return fmt.Errorf("could not ensure default service account: %w", err)
+	logger.Infof("Handling namespace")
+
+	status, err := h.sync(ctx, ns, policy, logger)
+	if !h.disableNamespaceStatus {
+		h.writeStatus(ctx, ns, status, err, logger)
 	}
 
-	return nil
+	return err
+}
+
+// sync syncs the namespace resources based on the namespace policy.
+func (h handler) sync(ctx context.Context, ns *corev1.Namespace, policy namespacePolicy, logger log.Logger) (syncStatus, error) {
+	status := syncStatus{}
+
+	// Replicate the resources, the image pull secret target name can be overridden by the namespace.
+	resources := append([]Resource{{
+		Kind:            ResourceKindSecret,
+		Name:            h.imagePullSecretName,
+		TargetName:      policy.secretName,
+		ImagePullSecret: true,
+	}}, h.resources...)
+
+	imagePullSecrets := []string{}
+	replacedSecrets := []string{}
+	for i, res := range resources {
+		rep, err := h.replicate(ctx, ns, res, logger)
+		if err != nil {
+			return status, err
+		}
+
+		if rep.updated {
+			h.notifier.Notify(ctx, notify.Event{
+				Type:      notify.EventTypeResourcePropagated,
+				Namespace: ns.Name,
+				Kind:      string(res.Kind),
+				Name:      res.TargetName,
+			})
+		}
+
+		if i == 0 && !rep.skipped {
+			status.secretName = rep.name
+			status.sourceContentHash = rep.contentHash
+		}
+
+		if !rep.skipped && res.ImagePullSecret {
+			imagePullSecrets = append(imagePullSecrets, rep.name)
+			replacedSecrets = append(replacedSecrets, rep.replaced...)
+		}
+	}
+
+	if len(imagePullSecrets) == 0 {
+		logger.Debugf("No image pull secrets replicated, service accounts not patched")
+		return status, nil
+	}
+
+	// Patch service accounts on expected namespace.
+	missingSAs := []string{}
+	for _, saName := range policy.serviceAccounts {
+		sa, err := h.k8sRepo.GetServiceAccount(ctx, ns.Name, saName)
+		if err != nil {
+			// Service accounts could not be created yet (e.g new namespace `default` SA).
+			if kubeerrors.IsNotFound(err) {
+				missingSAs = append(missingSAs, saName)
+				continue
+			}
+			return status, fmt.Errorf("could not retrieve %q service account from namespace: %w", saName, err)
+		}
+
+		// Switch the service accounts from the replaced secrets to the new ones.
+		patched := false
+		refs := []corev1.LocalObjectReference{}
+		for _, ref := range sa.ImagePullSecrets {
+			if contains(replacedSecrets, ref.Name) {
+				patched = true
+				continue
+			}
+			refs = append(refs, ref)
+		}
+		sa.ImagePullSecrets = refs
+
+		for _, secretName := range imagePullSecrets {
+			if containsLocalObjectRef(sa.ImagePullSecrets, secretName) {
+				continue
+			}
+			sa.ImagePullSecrets = append(sa.ImagePullSecrets, corev1.LocalObjectReference{Name: secretName})
+			patched = true
+		}
+
+		if !patched {
+			// Already set, move along.
+			logger.Debugf("%q service account image pull secrets already set", saName)
+			status.serviceAccounts = append(status.serviceAccounts, saName)
+			continue
+		}
+
+		err = h.k8sRepo.EnsureServiceAccount(ctx, sa)
+		if err != nil {
+			return status, fmt.Errorf("could not ensure %q service account: %w", saName, err)
+		}
+		status.serviceAccounts = append(status.serviceAccounts, saName)
+	}
+
+	if len(missingSAs) > 0 {
+		logger.Infof("Service accounts %v missing, waiting for them", missingSAs)
+		return status, requeueError("service-account-missing", h.serviceAccountWaitDelay, fmt.Errorf("service accounts %v missing", missingSAs))
+	}
+
+	return status, nil
 }
 
 func containsLocalObjectRef(refs []corev1.LocalObjectReference, name string) bool {
@@ -153,3 +392,12 @@ func containsLocalObjectRef(refs []corev1.LocalObjectReference, name string) boo
 	}
 	return false
 }
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package namespace
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/slok/imagepull-controller-workshop/internal/log"
+)
+
+// Annotations set on the immutable secret copies.
+const (
+	// AnnotationSecretGroup is the target name of the immutable secret copy, all the versions of
+	// the same secret have the same group.
+	AnnotationSecretGroup = annotationPrefix + "secret-group"
+	// AnnotationSupersededAt is the time an immutable secret copy was replaced by a new version.
+	AnnotationSupersededAt = annotationPrefix + "superseded-at"
+)
+
+// immutableHashLength is the length of the content hash suffix used on the immutable secret copy names.
+const immutableHashLength = 10
+
+// immutableSecretName returns the name of an immutable secret copy based on the content hash.
+func immutableSecretName(targetName, hash string) string {
+	if len(hash) > immutableHashLength {
+		hash = hash[:immutableHashLength]
+	}
+	return fmt.Sprintf("%s-%s", targetName, hash)
+}
+
+// replicateImmutableSecret replicates the source secret on the namespace as an immutable secret
+// with the content hash as the name suffix (blue/green). The previous versions are returned
+// as replaced, so the service accounts are switched to the new version, and are garbage
+// collected after the grace period, until then, rolling back the source reuses them.
+func (h handler) replicateImmutableSecret(ctx context.Context, ns *corev1.Namespace, source *corev1.Secret, targetName string, logger log.Logger) (replication, error) {
+	desired, err := h.desiredSecret(ns, source, targetName, true)
+	if err != nil {
+		return replication{}, err
+	}
+
+	immutable := true
+	desired.Name = immutableSecretName(targetName, desired.Annotations[AnnotationContentHash])
+	desired.Annotations[AnnotationSecretGroup] = targetName
+	desired.Immutable = &immutable
+
+	rep, err := h.writeSecret(ctx, ns, desired, logger)
+	if err != nil {
+		return replication{}, err
+	}
+	rep.contentHash = secretContentHash(source)
+	if rep.skipped {
+		return rep, nil
+	}
+
+	rep.replaced, err = h.gcSecretVersions(ctx, ns, targetName, desired.Name, logger)
+	if err != nil {
+		return replication{}, fmt.Errorf("could not garbage collect %q secret versions: %w", targetName, err)
+	}
+
+	return rep, nil
+}
+
+// gcSecretVersions marks the previous versions of an immutable secret as superseded and
+// deletes the ones superseded for longer than the grace period. Returns all the previous
+// versions names.
+func (h handler) gcSecretVersions(ctx context.Context, ns *corev1.Namespace, group, current string, logger log.Logger) ([]string, error) {
+	secrets, err := h.k8sRepo.ListSecrets(ctx, ns.Name, metav1.ListOptions{
+		LabelSelector: managedByKey + "=" + managedByValue,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not list secrets: %w", err)
+	}
+
+	now := time.Now().UTC()
+	previous := []string{}
+	for _, s := range secrets.Items {
+		// The mutable copy (same name as the group) is also a previous version, this way
+		// enabling the immutable mode migrates the namespaces.
+		if s.Name == current || (s.Annotations[AnnotationSecretGroup] != group && s.Name != group) {
+			continue
+		}
+		previous = append(previous, s.Name)
+
+		supersededAt, err := time.Parse(time.RFC3339, s.Annotations[AnnotationSupersededAt])
+		if err != nil {
+			// Only the metadata can be changed on immutable secrets.
+			s := s.DeepCopy()
+			s.Annotations[AnnotationSupersededAt] = now.Format(time.RFC3339)
+			err := h.k8sRepo.EnsureSecret(ctx, s)
+			if err != nil {
+				return nil, fmt.Errorf("could not mark %q secret as superseded: %w", s.Name, err)
+			}
+			logger.Infof("Secret %q superseded by %q", s.Name, current)
+			continue
+		}
+
+		if now.Sub(supersededAt) < h.immutableSecretsGracePeriod {
+			continue
+		}
+
+		err = h.k8sRepo.DeleteSecret(ctx, ns.Name, s.Name)
+		if err != nil && !kubeerrors.IsNotFound(err) {
+			return nil, fmt.Errorf("could not delete %q secret: %w", s.Name, err)
+		}
+		logger.Infof("Superseded secret %q garbage collected", s.Name)
+	}
+	sort.Strings(previous)
+
+	return previous, nil
+}
@@ -0,0 +1,192 @@
+package namespace_test
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/slok/imagepull-controller-workshop/internal/controller/namespace"
+)
+
+func TestHandlerImmutableSecretsGC(t *testing.T) {
+	const gracePeriod = time.Hour
+	supersededLongAgo := time.Now().Add(-2 * gracePeriod).UTC().Format(time.RFC3339)
+
+	tests := map[string]struct {
+		changeSource bool
+		// supersededAge is the age of the previous version superseded mark, zero if not marked
+		// before the handling.
+		supersededAge time.Duration
+		expPrevious   bool
+		expMarked     bool
+	}{
+		"The current version should be kept.": {
+			expPrevious: true,
+		},
+
+		"A superseded version should be marked and kept.": {
+			changeSource: true,
+			expPrevious:  true,
+			expMarked:    true,
+		},
+
+		"A superseded version should be kept before the grace period.": {
+			changeSource:  true,
+			supersededAge: gracePeriod - time.Minute,
+			expPrevious:   true,
+			expMarked:     true,
+		},
+
+		"A superseded version should be deleted after the grace period.": {
+			changeSource:  true,
+			supersededAge: gracePeriod + time.Minute,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			repo := newFakeRepo()
+			repo.addNamespace(testNamespace("test-ns"))
+			repo.addServiceAccount(&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "test-ns", Name: "default"}})
+			repo.addSecret(testSourceSecret("source-ns", "creds", "djE6djE="))
+
+			// Secrets that are not versions of the image pull secret, never garbage collected.
+			repo.addSecret(&corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "test-ns",
+				Name:        "other-1234567890",
+				Labels:      map[string]string{"app.kubernetes.io/managed-by": "imagepull-controller-workshop"},
+				Annotations: map[string]string{namespace.AnnotationSecretGroup: "other", namespace.AnnotationSupersededAt: supersededLongAgo},
+			}})
+			repo.addSecret(&corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "test-ns",
+				Name:        "creds-unmanaged",
+				Annotations: map[string]string{namespace.AnnotationSecretGroup: "creds", namespace.AnnotationSupersededAt: supersededLongAgo},
+			}})
+
+			h, err := namespace.NewHandler(namespace.HandlerConfig{
+				RunningNamespace:            "source-ns",
+				ImagePullSecretName:         "creds",
+				DisableNamespaceStatus:      true,
+				ImmutableSecrets:            true,
+				ImmutableSecretsGracePeriod: gracePeriod,
+				K8sRepo:                     repo,
+			})
+			require.NoError(err)
+			handle := func() {
+				err := h.Handle(context.TODO(), testNamespace("test-ns"))
+				require.NoError(err)
+			}
+			versions := func() []string {
+				sl, err := repo.ListSecrets(context.TODO(), "test-ns", metav1.ListOptions{})
+				require.NoError(err)
+				names := []string{}
+				for _, s := range sl.Items {
+					if s.Annotations[namespace.AnnotationSecretGroup] == "creds" && s.Labels["app.kubernetes.io/managed-by"] != "" {
+						names = append(names, s.Name)
+					}
+				}
+				sort.Strings(names)
+				return names
+			}
+
+			handle()
+			require.Len(versions(), 1)
+			previous := versions()[0]
+			current := previous
+
+			if test.changeSource {
+				repo.addSecret(testSourceSecret("source-ns", "creds", "djI6djI="))
+				handle()
+				for _, v := range versions() {
+					if v != previous {
+						current = v
+					}
+				}
+				require.NotEqual(previous, current)
+			}
+
+			if test.supersededAge > 0 {
+				s, err := repo.GetSecret(context.TODO(), "test-ns", previous)
+				require.NoError(err)
+				s.Annotations[namespace.AnnotationSupersededAt] = time.Now().Add(-test.supersededAge).UTC().Format(time.RFC3339)
+				repo.addSecret(s)
+				handle()
+			}
+
+			// The current version is always kept and referenced.
+			got, err := repo.GetSecret(context.TODO(), "test-ns", current)
+			require.NoError(err)
+			assert.Empty(got.Annotations[namespace.AnnotationSupersededAt])
+			sa, err := repo.GetServiceAccount(context.TODO(), "test-ns", "default")
+			require.NoError(err)
+			assert.Equal([]corev1.LocalObjectReference{{Name: current}}, sa.ImagePullSecrets)
+
+			if current != previous {
+				got, err := repo.GetSecret(context.TODO(), "test-ns", previous)
+				if !test.expPrevious {
+					assert.Error(err)
+				} else {
+					require.NoError(err)
+					assert.Equal(test.expMarked, got.Annotations[namespace.AnnotationSupersededAt] != "")
+				}
+			}
+
+			_, err = repo.GetSecret(context.TODO(), "test-ns", "other-1234567890")
+			assert.NoError(err)
+			_, err = repo.GetSecret(context.TODO(), "test-ns", "creds-unmanaged")
+			assert.NoError(err)
+		})
+	}
+}
+
+func TestHandlerImmutableSecretsMigration(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	repo := newFakeRepo()
+	repo.addNamespace(testNamespace("test-ns"))
+	repo.addServiceAccount(&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "test-ns", Name: "default"}})
+	repo.addSecret(testSourceSecret("source-ns", "creds", "djE6djE="))
+
+	// Replicate the mutable copy first.
+	h, err := namespace.NewHandler(namespace.HandlerConfig{
+		RunningNamespace:       "source-ns",
+		ImagePullSecretName:    "creds",
+		DisableNamespaceStatus: true,
+		K8sRepo:                repo,
+	})
+	require.NoError(err)
+	err = h.Handle(context.TODO(), testNamespace("test-ns"))
+	require.NoError(err)
+
+	h, err = namespace.NewHandler(namespace.HandlerConfig{
+		RunningNamespace:            "source-ns",
+		ImagePullSecretName:         "creds",
+		DisableNamespaceStatus:      true,
+		ImmutableSecrets:            true,
+		ImmutableSecretsGracePeriod: time.Hour,
+		K8sRepo:                     repo,
+	})
+	require.NoError(err)
+	err = h.Handle(context.TODO(), testNamespace("test-ns"))
+	require.NoError(err)
+
+	// The mutable copy is superseded by the immutable version but not deleted yet.
+	mutable, err := repo.GetSecret(context.TODO(), "test-ns", "creds")
+	require.NoError(err)
+	assert.NotEmpty(mutable.Annotations[namespace.AnnotationSupersededAt])
+	sa, err := repo.GetServiceAccount(context.TODO(), "test-ns", "default")
+	require.NoError(err)
+	require.Len(sa.ImagePullSecrets, 1)
+	assert.NotEqual("creds", sa.ImagePullSecrets[0].Name)
+	assert.Equal(0, repo.writeCount("DeleteSecret"))
+}
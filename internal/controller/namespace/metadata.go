@@ -0,0 +1,159 @@
+package namespace
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Provenance annotations set on every copy.
+const (
+	// AnnotationSourceNamespace is the namespace of the resource used as the source of the copy.
+	AnnotationSourceNamespace = annotationPrefix + "source-namespace"
+	// AnnotationSourceName is the name of the resource used as the source of the copy.
+	AnnotationSourceName = annotationPrefix + "source-name"
+	// AnnotationSourceUID is the UID of the resource used as the source of the copy.
+	AnnotationSourceUID = annotationPrefix + "source-uid"
+	// AnnotationSourceResourceVersion is the resource version of the resource used as the source of the copy.
+	AnnotationSourceResourceVersion = annotationPrefix + "source-resource-version"
+	// AnnotationContentHash is the hash of the copy content.
+	AnnotationContentHash = annotationPrefix + "content-hash"
+	// AnnotationLastSync is the last time the copy was written by the controller.
+	AnnotationLastSync = annotationPrefix + "last-sync"
+)
+
+// DefaultLabelDenyList are the labels that are not propagated by default.
+var DefaultLabelDenyList = []string{
+	"app.kubernetes.io/instance",
+	"argocd.argoproj.io/*",
+	"kustomize.toolkit.fluxcd.io/*",
+	"helm.toolkit.fluxcd.io/*",
+}
+
+// DefaultAnnotationDenyList are the annotations that are not propagated by default.
+var DefaultAnnotationDenyList = []string{
+	"kubectl.kubernetes.io/last-applied-configuration",
+	"argocd.argoproj.io/*",
+	"kustomize.toolkit.fluxcd.io/*",
+	"helm.toolkit.fluxcd.io/*",
+	annotationPrefix + "*",
+}
+
+// MetadataFilter knows which metadata keys (labels or annotations) can be propagated.
+// The entries ending with `*` are used as prefixes.
+//
+// An empty allow list allows everything, the deny list has priority over the allow list.
+type MetadataFilter struct {
+	Allow []string
+	Deny  []string
+}
+
+// Filter returns a copy of the received metadata without the filtered keys.
+func (m MetadataFilter) Filter(kv map[string]string) map[string]string {
+	res := map[string]string{}
+	for k, v := range kv {
+		if len(m.Allow) > 0 && !matchesAny(k, m.Allow) {
+			continue
+		}
+
+		if matchesAny(k, m.Deny) {
+			continue
+		}
+
+		res[k] = v
+	}
+
+	return res
+}
+
+func matchesAny(key string, patterns []string) bool {
+	for _, p := range patterns {
+		if strings.HasSuffix(p, "*") {
+			if strings.HasPrefix(key, strings.TrimSuffix(p, "*")) {
+				return true
+			}
+			continue
+		}
+
+		if key == p {
+			return true
+		}
+	}
+
+	return false
+}
+
+// secretContentHash returns a hash based on the secret type and data.
+func secretContentHash(secret *corev1.Secret) string {
+	return contentHash(string(secret.Type), secret.Data)
+}
+
+// configMapContentHash returns a hash based on the configmap data.
+func configMapContentHash(cm *corev1.ConfigMap) string {
+	data := map[string][]byte{}
+	for k, v := range cm.Data {
+		data[k] = []byte(v)
+	}
+	for k, v := range cm.BinaryData {
+		data["binary:"+k] = v
+	}
+
+	return contentHash("", data)
+}
+
+func contentHash(kind string, data map[string][]byte) string {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	_, _ = h.Write([]byte(kind))
+	for _, k := range keys {
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(k))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write(data[k])
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// isOwnedKey returns true if the metadata key (label or annotation) is owned by the controller.
+func isOwnedKey(k string) bool {
+	return k == managedByKey || strings.HasPrefix(k, annotationPrefix)
+}
+
+// metaUpToDate returns true if the stored object metadata doesn't need to be updated with
+// the desired metadata. Only the controller owned keys are compared, the keys set by others
+// (e.g kept when adopting) are ignored, and the last sync annotation is ignored.
+func metaUpToDate(stored, desired metav1.Object) bool {
+	return kvUpToDate(stored.GetLabels(), desired.GetLabels()) &&
+		kvUpToDate(stored.GetAnnotations(), desired.GetAnnotations())
+}
+
+// kvUpToDate returns true if the stored keys have the desired values and there are no
+// controller owned keys that are not desired anymore.
+func kvUpToDate(stored, desired map[string]string) bool {
+	for k, v := range desired {
+		if k == AnnotationLastSync {
+			continue
+		}
+		if sv, ok := stored[k]; !ok || sv != v {
+			return false
+		}
+	}
+
+	for k := range stored {
+		if _, ok := desired[k]; !ok && isOwnedKey(k) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,115 @@
+package namespace
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Namespace annotations that can be used to override the controller behaviour on a
+// specific namespace.
+const (
+	annotationPrefix = "imagepull-controller-workshop.slok.dev/"
+
+	// AnnotationSecretName overrides the name of the secret created on the namespace.
+	AnnotationSecretName = annotationPrefix + "secret-name"
+	// AnnotationServiceAccounts overrides the service accounts (comma separated) that will be
+	// patched with the image pull secret.
+	AnnotationServiceAccounts = annotationPrefix + "service-accounts"
+	// AnnotationOptOut when `true` the controller will ignore the namespace.
+	AnnotationOptOut = annotationPrefix + "opt-out"
+	// AnnotationPaused when `true` the controller will not touch the namespace resources until
+	// the annotation is removed or set to `false`.
+	AnnotationPaused = annotationPrefix + "paused"
+)
+
+// namespacePolicy is the handling policy of a single namespace.
+type namespacePolicy struct {
+	secretName      string
+	serviceAccounts []string
+	optOut          bool
+	paused          bool
+}
+
+// annotationError is an error on an invalid namespace annotation.
+type annotationError struct {
+	annotation string
+	value      string
+	err        error
+}
+
+func (a annotationError) Error() string {
+	return fmt.Sprintf("invalid %q annotation value %q: %s", a.annotation, a.value, a.err)
+}
+
+// newNamespacePolicy returns the namespace policy based on the defaults and the namespace annotations.
+// The invalid annotations will be ignored (using the default) and returned as errors.
+func newNamespacePolicy(ns *corev1.Namespace, defaultSecretName string, defaultServiceAccounts []string) (namespacePolicy, []error) {
+	policy := namespacePolicy{
+		secretName:      defaultSecretName,
+		serviceAccounts: defaultServiceAccounts,
+	}
+
+	var errs []error
+	for k, v := range ns.Annotations {
+		switch k {
+		case AnnotationSecretName:
+			v = strings.TrimSpace(v)
+			if msgs := validation.IsDNS1123Subdomain(v); len(msgs) > 0 {
+				errs = append(errs, annotationError{annotation: k, value: v, err: fmt.Errorf("%s", strings.Join(msgs, ", "))})
+				continue
+			}
+			policy.secretName = v
+
+		case AnnotationServiceAccounts:
+			sas, err := parseServiceAccountList(v)
+			if err != nil {
+				errs = append(errs, annotationError{annotation: k, value: v, err: err})
+				continue
+			}
+			policy.serviceAccounts = sas
+
+		case AnnotationOptOut:
+			b, err := strconv.ParseBool(strings.TrimSpace(v))
+			if err != nil {
+				errs = append(errs, annotationError{annotation: k, value: v, err: err})
+				continue
+			}
+			policy.optOut = b
+
+		case AnnotationPaused:
+			b, err := strconv.ParseBool(strings.TrimSpace(v))
+			if err != nil {
+				errs = append(errs, annotationError{annotation: k, value: v, err: err})
+				continue
+			}
+			policy.paused = b
+		}
+	}
+
+	return policy, errs
+}
+
+func parseServiceAccountList(s string) ([]string, error) {
+	sas := []string{}
+	for _, sa := range strings.Split(s, ",") {
+		sa = strings.TrimSpace(sa)
+		if sa == "" {
+			continue
+		}
+
+		if msgs := validation.IsDNS1123Subdomain(sa); len(msgs) > 0 {
+			return nil, fmt.Errorf("invalid service account %q: %s", sa, strings.Join(msgs, ", "))
+		}
+		sas = append(sas, sa)
+	}
+
+	if len(sas) == 0 {
+		return nil, fmt.Errorf("at least one service account is required")
+	}
+
+	return sas, nil
+}
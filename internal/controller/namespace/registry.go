@@ -0,0 +1,163 @@
+package namespace
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// dockerHubRegistries are the Docker Hub registry keys, all of them are valid for the same
+// credentials and depending on the client one or another is used.
+var dockerHubRegistries = []string{
+	"docker.io",
+	"index.docker.io",
+	"registry-1.docker.io",
+	"https://index.docker.io/v1/",
+}
+
+// RegistryAliases knows how to expand the registries of a docker config JSON secret with
+// their aliases (e.g pull-through mirrors).
+type RegistryAliases struct {
+	// Aliases are the aliases of each registry host, the aliases will get the same
+	// credentials as the registry.
+	Aliases map[string][]string
+	// DockerHub expands any Docker Hub registry with all the Docker Hub canonical forms.
+	DockerHub bool
+}
+
+func (r RegistryAliases) enabled() bool {
+	return len(r.Aliases) > 0 || r.DockerHub
+}
+
+// aliasesOf returns the aliases of a docker config auths key.
+func (r RegistryAliases) aliasesOf(registry string) []string {
+	host := normalizeRegistry(registry)
+	aliases := []string{}
+	for k, as := range r.Aliases {
+		if normalizeRegistry(k) == host {
+			aliases = append(aliases, as...)
+		}
+	}
+
+	if r.DockerHub {
+		for _, dh := range dockerHubRegistries {
+			if normalizeRegistry(dh) == host {
+				aliases = append(aliases, dockerHubRegistries...)
+				break
+			}
+		}
+	}
+
+	return aliases
+}
+
+// expand returns the secret data with the docker config auths expanded with the registry
+// aliases. Only docker config JSON secrets are expanded and the already present registries
+// are never replaced. If nothing needs to be expanded, the same data is returned.
+func (r RegistryAliases) expand(secretType corev1.SecretType, data map[string][]byte) (map[string][]byte, error) {
+	if !r.enabled() || secretType != corev1.SecretTypeDockerConfigJson {
+		return data, nil
+	}
+
+	// Use raw messages so we don't lose any field we don't know about.
+	config := map[string]json.RawMessage{}
+	err := json.Unmarshal(data[corev1.DockerConfigJsonKey], &config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid docker config JSON: %w", err)
+	}
+
+	auths := map[string]json.RawMessage{}
+	if raw, ok := config["auths"]; ok {
+		err := json.Unmarshal(raw, &auths)
+		if err != nil {
+			return nil, fmt.Errorf("invalid docker config JSON auths: %w", err)
+		}
+	}
+
+	present := map[string]struct{}{}
+	for registry := range auths {
+		present[normalizeRegistry(registry)] = struct{}{}
+	}
+
+	// Sorted so the first registry gets the alias in a deterministic way, otherwise
+	// the copy content could change on every sync.
+	registries := make([]string, 0, len(auths))
+	for registry := range auths {
+		registries = append(registries, registry)
+	}
+	sort.Strings(registries)
+
+	expanded := map[string]json.RawMessage{}
+	for _, registry := range registries {
+		for _, alias := range r.aliasesOf(registry) {
+			if _, ok := auths[alias]; ok {
+				continue
+			}
+			if _, ok := expanded[alias]; ok {
+				continue
+			}
+			// Don't add aliases of already present hosts in other forms, except the Docker Hub
+			// canonical forms that are the same host but different keys on purpose.
+			if _, ok := present[normalizeRegistry(alias)]; ok && !r.isDockerHub(alias) {
+				continue
+			}
+			expanded[alias] = auths[registry]
+		}
+	}
+
+	if len(expanded) == 0 {
+		return data, nil
+	}
+
+	for alias, auth := range expanded {
+		auths[alias] = auth
+	}
+	rawAuths, err := json.Marshal(auths)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal docker config JSON auths: %w", err)
+	}
+	config["auths"] = rawAuths
+
+	rawConfig, err := json.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal docker config JSON: %w", err)
+	}
+
+	res := map[string][]byte{}
+	for k, v := range data {
+		res[k] = v
+	}
+	res[corev1.DockerConfigJsonKey] = rawConfig
+
+	return res, nil
+}
+
+func (r RegistryAliases) isDockerHub(registry string) bool {
+	if !r.DockerHub {
+		return false
+	}
+
+	for _, dh := range dockerHubRegistries {
+		if dh == registry {
+			return true
+		}
+	}
+
+	return false
+}
+
+// normalizeRegistry returns the registry host of a docker config auths key, the keys can be
+// hosts or URLs (e.g `https://index.docker.io/v1/`).
+func normalizeRegistry(registry string) string {
+	r := strings.ToLower(strings.TrimSpace(registry))
+	r = strings.TrimPrefix(r, "https://")
+	r = strings.TrimPrefix(r, "http://")
+	if i := strings.Index(r, "/"); i >= 0 {
+		r = r[:i]
+	}
+
+	return r
+}
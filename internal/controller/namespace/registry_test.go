@@ -0,0 +1,120 @@
+package namespace_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/slok/imagepull-controller-workshop/internal/controller/namespace"
+)
+
+func TestHandlerRegistryAliases(t *testing.T) {
+	tests := map[string]struct {
+		aliases namespace.RegistryAliases
+		source  string
+		expJSON string
+	}{
+		"Without aliases the docker config should be replicated as it is.": {
+			source:  `{"auths": {"r.io": {"auth": "dTpw"}}}`,
+			expJSON: `{"auths": {"r.io": {"auth": "dTpw"}}}`,
+		},
+
+		"A registry should be expanded with its aliases.": {
+			aliases: namespace.RegistryAliases{Aliases: map[string][]string{"r.io": {"mirror.r.io", "mirror2.r.io"}}},
+			source:  `{"auths":{"r.io":{"auth":"dTpw"}}}`,
+			expJSON: `{"auths":{"mirror.r.io":{"auth":"dTpw"},"mirror2.r.io":{"auth":"dTpw"},"r.io":{"auth":"dTpw"}}}`,
+		},
+
+		"A registry without aliases should be replicated as it is.": {
+			aliases: namespace.RegistryAliases{Aliases: map[string][]string{"other.io": {"mirror.other.io"}}},
+			source:  `{"auths": {"r.io": {"auth": "dTpw"}}}`,
+			expJSON: `{"auths": {"r.io": {"auth": "dTpw"}}}`,
+		},
+
+		"The registries should match the aliases ignoring the scheme, path, trailing slash and case.": {
+			aliases: namespace.RegistryAliases{Aliases: map[string][]string{"https://R.io/": {"mirror.r.io"}}},
+			source:  `{"auths":{"http://r.io/v2/":{"auth":"dTpw"}}}`,
+			expJSON: `{"auths":{"http://r.io/v2/":{"auth":"dTpw"},"mirror.r.io":{"auth":"dTpw"}}}`,
+		},
+
+		"The registries should match the aliases with the same port.": {
+			aliases: namespace.RegistryAliases{Aliases: map[string][]string{"https://r.io:5000/": {"mirror.r.io"}}},
+			source:  `{"auths":{"r.io:5000":{"auth":"dTpw"}}}`,
+			expJSON: `{"auths":{"mirror.r.io":{"auth":"dTpw"},"r.io:5000":{"auth":"dTpw"}}}`,
+		},
+
+		"The registries should not match the aliases with a different port.": {
+			aliases: namespace.RegistryAliases{Aliases: map[string][]string{"r.io": {"mirror.r.io"}}},
+			source:  `{"auths": {"r.io:5000": {"auth": "dTpw"}}}`,
+			expJSON: `{"auths": {"r.io:5000": {"auth": "dTpw"}}}`,
+		},
+
+		"An alias already present should not be replaced.": {
+			aliases: namespace.RegistryAliases{Aliases: map[string][]string{"r.io": {"mirror.r.io"}}},
+			source:  `{"auths": {"mirror.r.io": {"auth": "bTpt"}, "r.io": {"auth": "dTpw"}}}`,
+			expJSON: `{"auths": {"mirror.r.io": {"auth": "bTpt"}, "r.io": {"auth": "dTpw"}}}`,
+		},
+
+		"An alias already present in another form should not be added.": {
+			aliases: namespace.RegistryAliases{Aliases: map[string][]string{"r.io": {"mirror.r.io"}}},
+			source:  `{"auths": {"https://mirror.r.io/": {"auth": "bTpt"}, "r.io": {"auth": "dTpw"}}}`,
+			expJSON: `{"auths": {"https://mirror.r.io/": {"auth": "bTpt"}, "r.io": {"auth": "dTpw"}}}`,
+		},
+
+		"An alias shared by multiple registries should get the credentials of the first sorted registry.": {
+			aliases: namespace.RegistryAliases{Aliases: map[string][]string{"b.io": {"mirror.io"}, "a.io": {"mirror.io"}}},
+			source:  `{"auths":{"b.io":{"auth":"YjpC"},"a.io":{"auth":"YTpB"}}}`,
+			expJSON: `{"auths":{"a.io":{"auth":"YTpB"},"b.io":{"auth":"YjpC"},"mirror.io":{"auth":"YTpB"}}}`,
+		},
+
+		"A Docker Hub registry should be expanded with all the Docker Hub forms.": {
+			aliases: namespace.RegistryAliases{DockerHub: true},
+			source:  `{"auths":{"docker.io":{"auth":"dTpw"}}}`,
+			expJSON: `{"auths":{"docker.io":{"auth":"dTpw"},"https://index.docker.io/v1/":{"auth":"dTpw"},"index.docker.io":{"auth":"dTpw"},"registry-1.docker.io":{"auth":"dTpw"}}}`,
+		},
+
+		"The unknown docker config fields should be kept.": {
+			aliases: namespace.RegistryAliases{Aliases: map[string][]string{"r.io": {"mirror.r.io"}}},
+			source:  `{"auths":{"r.io":{"auth":"dTpw","identitytoken":"t"}},"credHelpers":{"x.io":"helper"}}`,
+			expJSON: `{"auths":{"mirror.r.io":{"auth":"dTpw","identitytoken":"t"},"r.io":{"auth":"dTpw","identitytoken":"t"}},"credHelpers":{"x.io":"helper"}}`,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			repo := newFakeRepo()
+			repo.addNamespace(testNamespace("test-ns"))
+			repo.addServiceAccount(&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "test-ns", Name: "default"}})
+			source := testSourceSecret("source-ns", "creds", "")
+			source.Data[corev1.DockerConfigJsonKey] = []byte(test.source)
+			repo.addSecret(source)
+
+			h, err := namespace.NewHandler(namespace.HandlerConfig{
+				RunningNamespace:       "source-ns",
+				ImagePullSecretName:    "creds",
+				DisableNamespaceStatus: true,
+				RegistryAliases:        test.aliases,
+				K8sRepo:                repo,
+			})
+			require.NoError(err)
+
+			// Handled multiple times the content (and its hash) should be the same.
+			for i := 0; i < 3; i++ {
+				err = h.Handle(context.TODO(), testNamespace("test-ns"))
+				require.NoError(err)
+			}
+
+			secret, err := repo.GetSecret(context.TODO(), "test-ns", "creds")
+			require.NoError(err)
+			assert.Equal(test.expJSON, string(secret.Data[corev1.DockerConfigJsonKey]))
+			assert.Equal(1, repo.writeCount("EnsureSecret"))
+		})
+	}
+}
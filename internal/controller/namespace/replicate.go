@@ -0,0 +1,281 @@
+package namespace
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/slok/imagepull-controller-workshop/internal/log"
+)
+
+// ResourceKind is the kind of a replicated resource.
+type ResourceKind string
+
+const (
+	// ResourceKindSecret is the secret resource kind.
+	ResourceKindSecret ResourceKind = "Secret"
+	// ResourceKindConfigMap is the configmap resource kind.
+	ResourceKindConfigMap ResourceKind = "ConfigMap"
+)
+
+// Resource is a resource of the running namespace that will be replicated on the namespaces.
+type Resource struct {
+	// Kind is the kind of the resource.
+	Kind ResourceKind
+	// Name is the name of the resource on the running namespace.
+	Name string
+	// TargetName is the name of the copy, by default the same as the source.
+	TargetName string
+	// ImagePullSecret when enabled the copy will be referenced by the namespace service
+	// accounts as an image pull secret, only valid for secrets.
+	ImagePullSecret bool
+}
+
+func (r *Resource) defaults() error {
+	if r.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+
+	if r.TargetName == "" {
+		r.TargetName = r.Name
+	}
+
+	switch r.Kind {
+	case ResourceKindSecret:
+	case ResourceKindConfigMap:
+		if r.ImagePullSecret {
+			return fmt.Errorf("configmaps can't be used as image pull secrets")
+		}
+	default:
+		return fmt.Errorf("unknown %q resource kind", r.Kind)
+	}
+
+	return nil
+}
+
+// replication is the result of a resource replication.
+type replication struct {
+	// name is the name of the copy.
+	name string
+	// replaced are the names of previous copies replaced by this one.
+	replaced []string
+	// skipped is true when the copy has not been written.
+	skipped bool
+	// updated is true when the copy has been created or updated.
+	updated bool
+	// contentHash is the hash of the source content.
+	contentHash string
+}
+
+// desiredMeta returns the metadata of a copy based on the source metadata.
+func (h handler) desiredMeta(source metav1.ObjectMeta, ns, name, hash string) metav1.ObjectMeta {
+	annotations := h.annotationFilter.Filter(source.Annotations)
+	annotations[managedByKey] = managedByValue
+	annotations[AnnotationSourceNamespace] = source.Namespace
+	annotations[AnnotationSourceName] = source.Name
+	annotations[AnnotationSourceUID] = string(source.UID)
+	annotations[AnnotationSourceResourceVersion] = source.ResourceVersion
+	annotations[AnnotationContentHash] = hash
+	annotations[AnnotationLastSync] = time.Now().UTC().Format(time.RFC3339)
+
+	labels := h.labelFilter.Filter(source.Labels)
+	labels[managedByKey] = managedByValue
+
+	return metav1.ObjectMeta{
+		Name:        name,
+		Namespace:   ns,
+		Labels:      labels,
+		Annotations: annotations,
+	}
+}
+
+// resolveConflict returns the decision to take based on the conflict policy when a resource
+// already exists and is not managed by the controller.
+func (h handler) resolveConflict(ctx context.Context, ns *corev1.Namespace, kind ResourceKind, name string, logger log.Logger) string {
+	var decision string
+	switch h.conflictPolicy {
+	case ConflictPolicyAdopt:
+		decision = conflictDecisionAdopted
+	case ConflictPolicyOverwrite:
+		decision = conflictDecisionOverwritten
+	default:
+		decision = conflictDecisionSkipped
+	}
+
+	h.metricsRecorder.IncNamespaceResourceConflict(ctx, string(kind), string(h.conflictPolicy), decision)
+	logger.Warningf("%s %q already exists and is not managed by the controller, %s", kind, name, decision)
+	h.eventRecorder.Eventf(ns, corev1.EventTypeWarning, string(kind)+"Conflict", "%s %q already exists and is not managed by the controller, %s", kind, name, decision)
+
+	return decision
+}
+
+// desiredSecret returns the desired copy of the source secret, the image pull secrets are
+// normalized to the docker config JSON format.
+func (h handler) desiredSecret(ns *corev1.Namespace, source *corev1.Secret, targetName string, imagePullSecret bool) (*corev1.Secret, error) {
+	secretType, data := source.Type, source.Data
+	if imagePullSecret {
+		var err error
+		secretType, data, err = normalizeDockerConfig(source)
+		if err != nil {
+			return nil, permanentError("invalid-source", fmt.Errorf("could not convert %q source secret to docker config JSON: %w", source.Name, err))
+		}
+	}
+
+	data, err := h.registryAliases.expand(secretType, data)
+	if err != nil {
+		return nil, permanentError("invalid-source", fmt.Errorf("could not expand %q source secret registries: %w", source.Name, err))
+	}
+
+	// The copy content hash is based on the copy content, not the source, so it can be checked
+	// against the copy itself.
+	desired := &corev1.Secret{Data: data, Type: secretType}
+	desired.ObjectMeta = h.desiredMeta(source.ObjectMeta, ns.Name, targetName, secretContentHash(desired))
+
+	return desired, nil
+}
+
+// replicateSecret replicates the source secret on the namespace.
+func (h handler) replicateSecret(ctx context.Context, ns *corev1.Namespace, source *corev1.Secret, targetName string, imagePullSecret bool, logger log.Logger) (replication, error) {
+	desired, err := h.desiredSecret(ns, source, targetName, imagePullSecret)
+	if err != nil {
+		return replication{}, err
+	}
+
+	rep, err := h.writeSecret(ctx, ns, desired, logger)
+	if err != nil {
+		return replication{}, err
+	}
+	rep.contentHash = secretContentHash(source)
+
+	return rep, nil
+}
+
+// writeSecret writes the desired secret on the namespace if required.
+func (h handler) writeSecret(ctx context.Context, ns *corev1.Namespace, desired *corev1.Secret, logger log.Logger) (replication, error) {
+	name := desired.Name
+
+	// Check we are not replacing a secret that is not ours.
+	stored, err := h.k8sRepo.GetSecret(ctx, ns.Name, name)
+	if err != nil && !kubeerrors.IsNotFound(err) {
+		return replication{}, fmt.Errorf("could not retrieve current secret from namespace: %w", err)
+	}
+	exists := err == nil
+	overwrite := false
+	if exists && !isManaged(stored) {
+		switch h.resolveConflict(ctx, ns, ResourceKindSecret, name, logger) {
+		case conflictDecisionSkipped:
+			return replication{skipped: true}, nil
+		case conflictDecisionOverwritten:
+			overwrite = true
+		}
+	}
+
+	// Only write the secret if required, this way we don't update the secret on every resync.
+	if exists && isManaged(stored) && stored.Type == desired.Type &&
+		secretContentHash(stored) == secretContentHash(desired) && metaUpToDate(stored, desired) {
+		logger.Debugf("Secret %q already up to date", name)
+		return replication{name: name}, nil
+	}
+
+	// Keep the metadata set by others (e.g adopted).
+	if exists && !overwrite {
+		desired.ObjectMeta = mergeMeta(stored.ObjectMeta, desired.ObjectMeta)
+	}
+
+	err = h.k8sRepo.EnsureSecret(ctx, desired)
+	if err != nil {
+		return replication{}, fmt.Errorf("could not ensure %q secret on namespace: %w", name, err)
+	}
+
+	return replication{name: name, updated: true}, nil
+}
+
+// replicateConfigMap replicates the source configmap on the namespace.
+func (h handler) replicateConfigMap(ctx context.Context, ns *corev1.Namespace, source *corev1.ConfigMap, targetName string, logger log.Logger) (replication, error) {
+	hash := configMapContentHash(source)
+	desired := &corev1.ConfigMap{
+		ObjectMeta: h.desiredMeta(source.ObjectMeta, ns.Name, targetName, hash),
+		Data:       source.Data,
+		BinaryData: source.BinaryData,
+	}
+
+	// Check we are not replacing a configmap that is not ours.
+	stored, err := h.k8sRepo.GetConfigMap(ctx, ns.Name, targetName)
+	if err != nil && !kubeerrors.IsNotFound(err) {
+		return replication{}, fmt.Errorf("could not retrieve current configmap from namespace: %w", err)
+	}
+	exists := err == nil
+	overwrite := false
+	if exists && !isManaged(stored) {
+		switch h.resolveConflict(ctx, ns, ResourceKindConfigMap, targetName, logger) {
+		case conflictDecisionSkipped:
+			return replication{skipped: true}, nil
+		case conflictDecisionOverwritten:
+			overwrite = true
+		}
+	}
+
+	// Only write the configmap if required, this way we don't update the configmap on every resync.
+	if exists && isManaged(stored) && configMapContentHash(stored) == configMapContentHash(desired) && metaUpToDate(stored, desired) {
+		logger.Debugf("ConfigMap %q already up to date", targetName)
+		return replication{name: targetName, contentHash: hash}, nil
+	}
+
+	// Keep the metadata set by others (e.g adopted).
+	if exists && !overwrite {
+		desired.ObjectMeta = mergeMeta(stored.ObjectMeta, desired.ObjectMeta)
+	}
+
+	err = h.k8sRepo.EnsureConfigMap(ctx, desired)
+	if err != nil {
+		return replication{}, fmt.Errorf("could not ensure %q configmap on namespace: %w", targetName, err)
+	}
+
+	return replication{name: targetName, updated: true, contentHash: hash}, nil
+}
+
+// replicate replicates the resource on the namespace.
+func (h handler) replicate(ctx context.Context, ns *corev1.Namespace, res Resource, logger log.Logger) (replication, error) {
+	switch res.Kind {
+	case ResourceKindConfigMap:
+		source, err := h.k8sRepo.GetConfigMap(ctx, h.runningNamespace, res.Name)
+		if err != nil {
+			if kubeerrors.IsNotFound(err) {
+				return replication{}, transientError("source-not-found", fmt.Errorf("could not retrieve %q source configmap: %w", res.Name, err))
+			}
+			return replication{}, fmt.Errorf("could not retrieve %q source configmap: %w", res.Name, err)
+		}
+
+		return h.replicateConfigMap(ctx, ns, source, res.TargetName, logger)
+
+	default:
+		source, err := h.k8sRepo.GetSecret(ctx, h.runningNamespace, res.Name)
+		if err != nil {
+			if kubeerrors.IsNotFound(err) {
+				return replication{}, transientError("source-not-found", fmt.Errorf("could not retrieve %q source secret: %w", res.Name, err))
+			}
+			return replication{}, fmt.Errorf("could not retrieve %q source secret: %w", res.Name, err)
+		}
+		if len(source.Data) == 0 {
+			return replication{}, permanentError("invalid-source", fmt.Errorf("%q source secret has no data", res.Name))
+		}
+
+		// Namespaces could get a different version of the image pull secret while a rollout is in progress.
+		if h.rollout != nil && res.Name == h.imagePullSecretName {
+			source, err = h.rollout.source(ctx, ns.Name, source)
+			if err != nil {
+				return replication{}, transientError("rollout-not-ready", err)
+			}
+		}
+
+		if h.immutableSecrets && res.ImagePullSecret {
+			return h.replicateImmutableSecret(ctx, ns, source, res.TargetName, logger)
+		}
+
+		return h.replicateSecret(ctx, ns, source, res.TargetName, res.ImagePullSecret, logger)
+	}
+}
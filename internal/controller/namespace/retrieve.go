@@ -13,18 +13,23 @@ import (
 
 // RetrieverRepository is the service to manage k8s resources by the Kubernetes retrievers.
 type RetrieverRepository interface {
-	ListNamespaces(ctx context.Context, labelSelector map[string]string) (*corev1.NamespaceList, error)
-	WatchNamespaces(ctx context.Context, labelSelector map[string]string) (watch.Interface, error)
+	ListNamespaces(ctx context.Context, options metav1.ListOptions) (*corev1.NamespaceList, error)
+	WatchNamespaces(ctx context.Context, options metav1.ListOptions) (watch.Interface, error)
 }
 
 // NewRetriever returns the retriever for the controller.
-func NewRetriever(k8sRepo RetrieverRepository) (controller.Retriever, error) {
+//
+// The list options received from the informer (resource version, pagination, timeouts,
+// bookmarks...) are forwarded so we don't lose events between the list and the watch
+// and big clusters are listed in pages. The list and watch requests will end when the
+// received context is done.
+func NewRetriever(ctx context.Context, k8sRepo RetrieverRepository) (controller.Retriever, error) {
 	return controller.RetrieverFromListerWatcher(&cache.ListWatch{
 		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
-			return k8sRepo.ListNamespaces(context.Background(), map[string]string{})
+			return k8sRepo.ListNamespaces(ctx, options)
 		},
 		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
-			return k8sRepo.WatchNamespaces(context.Background(), map[string]string{})
+			return k8sRepo.WatchNamespaces(ctx, options)
 		},
 	})
 }
@@ -0,0 +1,288 @@
+package namespace
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/spotahome/kooper/v2/controller"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/slok/imagepull-controller-workshop/internal/log"
+	"github.com/slok/imagepull-controller-workshop/internal/metrics"
+	"github.com/slok/imagepull-controller-workshop/internal/notify"
+)
+
+// RetryTrigger knows how to trigger the reconciliation of a namespace after a duration.
+type RetryTrigger interface {
+	TriggerAfter(ctx context.Context, ns string, after time.Duration) error
+}
+
+// RetryHandlerConfig is the retry handler configuration.
+type RetryHandlerConfig struct {
+	// Handler is the wrapped namespace handler.
+	Handler controller.Handler
+	// Trigger is used to requeue the namespaces, the trigger queues them (e.g rate limited
+	// queue), so the retries are not lost.
+	Trigger RetryTrigger
+	// MaxRetries is the max number of retries for a namespace with transient errors.
+	MaxRetries int
+	// MaxRequeues is the max number of consecutive requeues for a namespace (e.g waiting
+	// for the service accounts), the requeues are not counted as retries.
+	MaxRequeues int
+	// InitialBackoff is the backoff used on the first retry.
+	InitialBackoff time.Duration
+	// MaxBackoff is the max backoff duration between retries.
+	MaxBackoff time.Duration
+	// Jitter is the factor [0, 1) of random time added to the backoff.
+	Jitter float64
+	// FailureThreshold is the number of consecutive failures of a namespace that will
+	// notify the namespace propagation is failing.
+	FailureThreshold int
+	MetricsRecorder  metrics.Recorder
+	Notifier         notify.Notifier
+	Logger           log.Logger
+}
+
+func (c *RetryHandlerConfig) defaults() error {
+	if c.Handler == nil {
+		return fmt.Errorf("handler is required")
+	}
+
+	if c.Trigger == nil {
+		return fmt.Errorf("trigger is required")
+	}
+
+	if c.MaxRetries < 0 {
+		c.MaxRetries = 0
+	}
+
+	if c.MaxRequeues <= 0 {
+		c.MaxRequeues = 360
+	}
+
+	if c.InitialBackoff <= 0 {
+		c.InitialBackoff = time.Second
+	}
+
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = 5 * time.Minute
+	}
+
+	if c.Jitter < 0 || c.Jitter >= 1 {
+		return fmt.Errorf("jitter must be in the [0, 1) range")
+	}
+
+	if c.FailureThreshold <= 0 {
+		c.FailureThreshold = 3
+	}
+
+	if c.MetricsRecorder == nil {
+		c.MetricsRecorder = metrics.Noop
+	}
+
+	if c.Notifier == nil {
+		c.Notifier = notify.Noop
+	}
+
+	if c.Logger == nil {
+		c.Logger = log.Noop
+	}
+	c.Logger = c.Logger.WithValues(log.Kv{"svc": "controller.namespace.RetryHandler"})
+
+	return nil
+}
+
+// retryHandler knows how to retry the namespace handlings based on the error classification:
+// - Transient errors will be retried (non blocking) per namespace with exponential backoff and jitter.
+// - Requeue errors will be retried after the requested duration, without counting as retries.
+// - Permanent errors will not be retried.
+type retryHandler struct {
+	next             controller.Handler
+	trigger          RetryTrigger
+	maxRetries       int
+	maxRequeues      int
+	initialBackoff   time.Duration
+	maxBackoff       time.Duration
+	jitter           float64
+	failureThreshold int
+	metricsRec       metrics.Recorder
+	notifier         notify.Notifier
+	logger           log.Logger
+
+	mu       sync.Mutex
+	attempts map[string]int
+	requeues map[string]int
+	failures map[string]int
+	rand     *rand.Rand
+}
+
+// NewRetryHandler returns a new namespace handler that retries the wrapped handler
+// based on the error classification.
+func NewRetryHandler(config RetryHandlerConfig) (controller.Handler, error) {
+	err := config.defaults()
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	return &retryHandler{
+		next:             config.Handler,
+		trigger:          config.Trigger,
+		maxRetries:       config.MaxRetries,
+		maxRequeues:      config.MaxRequeues,
+		initialBackoff:   config.InitialBackoff,
+		maxBackoff:       config.MaxBackoff,
+		jitter:           config.Jitter,
+		failureThreshold: config.FailureThreshold,
+		metricsRec:       config.MetricsRecorder,
+		notifier:         config.Notifier,
+		logger:           config.Logger,
+		attempts:         map[string]int{},
+		requeues:         map[string]int{},
+		failures:         map[string]int{},
+		rand:             rand.New(rand.NewSource(time.Now().UnixNano())),
+	}, nil
+}
+
+func (r *retryHandler) Handle(ctx context.Context, obj runtime.Object) error {
+	ns, ok := obj.(*corev1.Namespace)
+	if !ok {
+		return r.next.Handle(ctx, obj)
+	}
+	logger := r.logger.WithValues(log.Kv{"k8s-name": ns.Name})
+
+	err := r.next.Handle(ctx, obj)
+	if err == nil {
+		r.resetAttempts(ns.Name)
+		r.resetRequeues(ns.Name)
+		r.resetFailures(ns.Name)
+		return nil
+	}
+
+	herr := classifyError(err)
+	r.metricsRec.IncNamespaceHandlerError(ctx, string(herr.Kind), herr.Reason)
+
+	// Requeues and terminating namespaces are not failures.
+	if herr.RequeueAfter <= 0 && herr.Reason != reasonNamespaceTerminating {
+		r.trackFailure(ctx, ns.Name, herr)
+	}
+
+	if herr.Kind == ErrorKindPermanent {
+		r.resetAttempts(ns.Name)
+		r.resetRequeues(ns.Name)
+		if herr.Reason == reasonNamespaceTerminating {
+			logger.Debugf("Namespace terminating, not retrying: %s", herr)
+			return nil
+		}
+		logger.Errorf("Permanent error, not retrying: %s", herr)
+		return nil
+	}
+
+	// Requeues wait for something expected (e.g service accounts created by Kubernetes),
+	// they don't use the retries.
+	if herr.RequeueAfter > 0 {
+		requeue := r.incRequeues(ns.Name)
+		if requeue > r.maxRequeues {
+			r.resetRequeues(ns.Name)
+			r.metricsRec.IncNamespaceHandlerRetry(ctx, "exhausted")
+			return fmt.Errorf("max requeues reached: %w", herr)
+		}
+
+		r.metricsRec.IncNamespaceHandlerRetry(ctx, "requeued")
+		logger.Infof("Requeued (%d/%d) in %s: %s", requeue, r.maxRequeues, herr.RequeueAfter, herr)
+		err = r.trigger.TriggerAfter(ctx, ns.Name, herr.RequeueAfter)
+		if err != nil {
+			r.resetRequeues(ns.Name)
+			return fmt.Errorf("could not requeue namespace: %s: %w", err, herr)
+		}
+
+		return nil
+	}
+
+	attempt := r.incAttempts(ns.Name)
+	if attempt > r.maxRetries {
+		r.resetAttempts(ns.Name)
+		r.metricsRec.IncNamespaceHandlerRetry(ctx, "exhausted")
+		return fmt.Errorf("max retries reached: %w", herr)
+	}
+
+	r.metricsRec.IncNamespaceHandlerRetry(ctx, "requeued")
+	backoff := r.backoff(attempt)
+	logger.Warningf("Transient error, retrying (%d/%d) in %s: %s", attempt, r.maxRetries, backoff, herr)
+	err = r.trigger.TriggerAfter(ctx, ns.Name, backoff)
+	if err != nil {
+		r.resetAttempts(ns.Name)
+		return fmt.Errorf("could not requeue namespace: %s: %w", err, herr)
+	}
+
+	return nil
+}
+
+// backoff returns the exponential backoff for the attempt with jitter.
+func (r *retryHandler) backoff(attempt int) time.Duration {
+	d := float64(r.initialBackoff) * math.Pow(2, float64(attempt-1))
+	if d > float64(r.maxBackoff) {
+		d = float64(r.maxBackoff)
+	}
+
+	r.mu.Lock()
+	j := r.rand.Float64()
+	r.mu.Unlock()
+
+	return time.Duration(d + d*r.jitter*j)
+}
+
+func (r *retryHandler) incAttempts(ns string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.attempts[ns]++
+	return r.attempts[ns]
+}
+
+func (r *retryHandler) resetAttempts(ns string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.attempts, ns)
+}
+
+func (r *retryHandler) incRequeues(ns string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requeues[ns]++
+	return r.requeues[ns]
+}
+
+func (r *retryHandler) resetRequeues(ns string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.requeues, ns)
+}
+
+// trackFailure counts the consecutive failures of the namespace and notifies once when
+// they reach the failure threshold.
+func (r *retryHandler) trackFailure(ctx context.Context, ns string, err error) {
+	r.mu.Lock()
+	r.failures[ns]++
+	failures := r.failures[ns]
+	r.mu.Unlock()
+
+	if failures != r.failureThreshold {
+		return
+	}
+
+	r.notifier.Notify(ctx, notify.Event{
+		Type:      notify.EventTypePropagationFailing,
+		Namespace: ns,
+		Message:   fmt.Sprintf("%d consecutive failures: %s", failures, err),
+	})
+}
+
+func (r *retryHandler) resetFailures(ns string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.failures, ns)
+}
@@ -0,0 +1,157 @@
+package namespace_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/spotahome/kooper/v2/controller"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/slok/imagepull-controller-workshop/internal/controller/namespace"
+)
+
+func TestRetryHandlerServiceAccountWait(t *testing.T) {
+	const maxRetries = 3
+
+	tests := map[string]struct {
+		maxRequeues int
+		// saAfter is the number of handlings after the service account is created.
+		saAfter    int
+		expPatched bool
+		expErr     bool
+	}{
+		"A service account created before the max retries should be patched.": {
+			saAfter:    2,
+			expPatched: true,
+		},
+
+		"A service account created after more requeues than the max retries should be patched.": {
+			saAfter:    maxRetries * 4,
+			expPatched: true,
+		},
+
+		"A service account missing after the max requeues should stop the requeues.": {
+			maxRequeues: 5,
+			saAfter:     100,
+			expErr:      true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			repo := newFakeRepo()
+			repo.addNamespace(testNamespace("test-ns"))
+			repo.addSecret(testSourceSecret("source-ns", "creds", "dXNlcjpwYXNz"))
+
+			h, err := namespace.NewHandler(namespace.HandlerConfig{
+				RunningNamespace:       "source-ns",
+				ImagePullSecretName:    "creds",
+				DisableNamespaceStatus: true,
+				K8sRepo:                repo,
+			})
+			require.NoError(err)
+
+			trigger := &fakeTrigger{}
+			rh, err := namespace.NewRetryHandler(namespace.RetryHandlerConfig{
+				Handler:     h,
+				Trigger:     trigger,
+				MaxRetries:  maxRetries,
+				MaxRequeues: test.maxRequeues,
+			})
+			require.NoError(err)
+
+			// Handle until the namespace is not requeued anymore, like the trigger queue.
+			var gotErr error
+			for handlings := 0; ; handlings++ {
+				if handlings == test.saAfter {
+					repo.addServiceAccount(&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "test-ns", Name: "default"}})
+				}
+
+				gotErr = rh.Handle(context.TODO(), testNamespace("test-ns"))
+				if len(trigger.pop()) == 0 {
+					break
+				}
+			}
+
+			if test.expErr {
+				assert.Error(gotErr)
+			} else {
+				assert.NoError(gotErr)
+			}
+
+			sa, err := repo.GetServiceAccount(context.TODO(), "test-ns", "default")
+			if !test.expPatched {
+				assert.Error(err)
+				return
+			}
+			require.NoError(err)
+			assert.Equal([]corev1.LocalObjectReference{{Name: "creds"}}, sa.ImagePullSecrets)
+		})
+	}
+}
+
+func TestRetryHandlerTransientErrors(t *testing.T) {
+	tests := map[string]struct {
+		failures int
+		expErr   bool
+	}{
+		"Transient errors below the max retries should be retried until success.": {
+			failures: 3,
+		},
+
+		"Transient errors above the max retries should stop the retries.": {
+			failures: 10,
+			expErr:   true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			calls := 0
+			next := controller.HandlerFunc(func(_ context.Context, _ runtime.Object) error {
+				calls++
+				if calls <= test.failures {
+					return fmt.Errorf("something")
+				}
+				return nil
+			})
+
+			trigger := &fakeTrigger{}
+			rh, err := namespace.NewRetryHandler(namespace.RetryHandlerConfig{
+				Handler:        next,
+				Trigger:        trigger,
+				MaxRetries:     3,
+				InitialBackoff: time.Millisecond,
+			})
+			require.NoError(err)
+
+			var gotErr error
+			for {
+				gotErr = rh.Handle(context.TODO(), testNamespace("test-ns"))
+				if len(trigger.pop()) == 0 {
+					break
+				}
+			}
+
+			if test.expErr {
+				assert.Error(gotErr)
+				assert.Equal(4, calls)
+			} else {
+				assert.NoError(gotErr)
+				assert.Equal(test.failures+1, calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,573 @@
+package namespace
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/spotahome/kooper/v2/controller"
+	corev1 "k8s.io/api/core/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/slok/imagepull-controller-workshop/internal/log"
+	"github.com/slok/imagepull-controller-workshop/internal/notify"
+)
+
+// ErrRolloutVerificationFailed is returned by the rollout verifiers when the new credentials
+// are not valid.
+var ErrRolloutVerificationFailed = errors.New("rollout verification failed")
+
+// Rollout state annotations, set on the rollout state secret.
+const (
+	// AnnotationRolloutPhase is the phase of the rollout.
+	AnnotationRolloutPhase = annotationPrefix + "rollout-phase"
+	// AnnotationRolloutCandidateHash is the content hash of the credentials being rolled out.
+	AnnotationRolloutCandidateHash = annotationPrefix + "rollout-candidate-hash"
+	// AnnotationRolloutStartedAt is the time the rollout of the candidate started.
+	AnnotationRolloutStartedAt = annotationPrefix + "rollout-started-at"
+)
+
+// rolloutStateStableKey is the rollout state secret data key with the stable secret.
+const rolloutStateStableKey = "stable"
+
+// RolloutVerifier knows how to verify the new credentials on the canary namespaces.
+type RolloutVerifier interface {
+	// Verify returns an error wrapping ErrRolloutVerificationFailed if the new credentials,
+	// replicated on the canary namespaces since the received time, are not valid. Any other
+	// error means the verification could not be done and will be retried.
+	Verify(ctx context.Context, secret *corev1.Secret, namespaces []string, since time.Time) error
+}
+
+// RolloutRepository is the service used by the rollout to get the namespaces.
+type RolloutRepository interface {
+	ListNamespaces(ctx context.Context, options metav1.ListOptions) (*corev1.NamespaceList, error)
+}
+
+// RolloutStateRepository is the service used by the rollout to store its state.
+type RolloutStateRepository interface {
+	GetSecret(ctx context.Context, ns string, name string) (*corev1.Secret, error)
+	EnsureSecret(ctx context.Context, secret *corev1.Secret) error
+}
+
+// RolloutConfig is the rollout configuration.
+type RolloutConfig struct {
+	// SecretNamespace and SecretName identify the image pull secret source.
+	SecretNamespace string
+	SecretName      string
+	// CanaryNamespaces are the namespaces that get the new credentials first.
+	CanaryNamespaces []string
+	// VerificationPeriod is the duration the canary namespaces need to be verified before
+	// promoting the new credentials to the rest of the namespaces.
+	VerificationPeriod time.Duration
+	// CheckInterval is the interval between verifications during the verification period.
+	CheckInterval time.Duration
+	Verifiers     []RolloutVerifier
+	K8sRepo       RolloutRepository
+	// StateK8sRepo stores the rollout state on a secret next to the source secret
+	// (`<SecretName>-rollout`), so the rollouts survive the controller restarts.
+	StateK8sRepo RolloutStateRepository
+	Trigger      Trigger
+	Notifier     notify.Notifier
+	Logger       log.Logger
+}
+
+func (c *RolloutConfig) defaults() error {
+	if c.SecretNamespace == "" || c.SecretName == "" {
+		return fmt.Errorf("secret namespace and name are required")
+	}
+
+	if len(c.CanaryNamespaces) == 0 {
+		return fmt.Errorf("at least one canary namespace is required")
+	}
+
+	if c.VerificationPeriod <= 0 {
+		c.VerificationPeriod = 5 * time.Minute
+	}
+
+	if c.CheckInterval <= 0 {
+		c.CheckInterval = 30 * time.Second
+	}
+
+	if c.K8sRepo == nil {
+		return fmt.Errorf("kubernetes repository is required")
+	}
+
+	if c.StateK8sRepo == nil {
+		return fmt.Errorf("state kubernetes repository is required")
+	}
+
+	if c.Trigger == nil {
+		return fmt.Errorf("trigger is required")
+	}
+
+	if c.Notifier == nil {
+		c.Notifier = notify.Noop
+	}
+
+	if c.Logger == nil {
+		c.Logger = log.Noop
+	}
+	c.Logger = c.Logger.WithValues(log.Kv{"svc": "controller.namespace.Rollout"})
+
+	return nil
+}
+
+// rolloutPhase is the phase of a credentials rollout.
+type rolloutPhase string
+
+const (
+	// rolloutPhaseStable means there is no rollout in progress.
+	rolloutPhaseStable rolloutPhase = "stable"
+	// rolloutPhaseCanary means the new credentials are on the canary namespaces being verified.
+	rolloutPhaseCanary rolloutPhase = "canary"
+	// rolloutPhaseHalted means the new credentials verification failed, all the namespaces use
+	// the stable credentials until the source changes again.
+	rolloutPhaseHalted rolloutPhase = "halted"
+)
+
+// rolloutState is the state of a credentials rollout.
+type rolloutState struct {
+	phase     rolloutPhase
+	stable    *corev1.Secret
+	candidate *corev1.Secret
+	startedAt time.Time
+}
+
+// observed returns true if the secret content hash is the stable or the candidate version
+// of the rollout, so observing it doesn't change the state.
+func (s rolloutState) observed(hash string) bool {
+	switch {
+	case s.stable == nil:
+		return false
+	case hash == secretContentHash(s.stable):
+		return s.phase == rolloutPhaseStable
+	case s.candidate != nil:
+		return hash == secretContentHash(s.candidate)
+	}
+	return false
+}
+
+// Rollout rolls out the image pull secret source changes in a canary way: the new
+// credentials are replicated first on the canary namespaces, verified for a period, and
+// then promoted to the rest of the namespaces. If the verification fails the rollout is
+// halted and the canary namespaces rolled back.
+//
+// The rollout state is stored on a secret and loaded with the first source secret observed,
+// if there is no state, the credentials found on startup are the stable ones.
+//
+// The state transitions are serialized and stored before being applied, the state lock is
+// only held to snapshot and apply the state, so the namespace handlings reading the state
+// don't wait for the state API calls.
+type Rollout struct {
+	secretNamespace    string
+	secretName         string
+	canaryNamespaces   map[string]struct{}
+	verificationPeriod time.Duration
+	checkInterval      time.Duration
+	verifiers          []RolloutVerifier
+	k8sRepo            RolloutRepository
+	stateK8sRepo       RolloutStateRepository
+	trigger            Trigger
+	notifier           notify.Notifier
+	logger             log.Logger
+
+	// transitionMu serializes the state loading and transitions.
+	transitionMu sync.Mutex
+	mu           sync.Mutex
+	loaded       bool
+	state        rolloutState
+	// generation is increased on every state change, so the transitions computed from an
+	// old state (e.g the verifications) are discarded.
+	generation uint64
+}
+
+// NewRollout returns a new Rollout.
+func NewRollout(config RolloutConfig) (*Rollout, error) {
+	err := config.defaults()
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	canaries := map[string]struct{}{}
+	for _, ns := range config.CanaryNamespaces {
+		canaries[ns] = struct{}{}
+	}
+
+	return &Rollout{
+		secretNamespace:    config.SecretNamespace,
+		secretName:         config.SecretName,
+		canaryNamespaces:   canaries,
+		verificationPeriod: config.VerificationPeriod,
+		checkInterval:      config.CheckInterval,
+		verifiers:          config.Verifiers,
+		k8sRepo:            config.K8sRepo,
+		stateK8sRepo:       config.StateK8sRepo,
+		trigger:            config.Trigger,
+		notifier:           config.Notifier,
+		logger:             config.Logger,
+		state:              rolloutState{phase: rolloutPhaseStable},
+	}, nil
+}
+
+// Handler wraps the source secret handler (e.g the secret cache handler) so the rollout
+// starts as soon as the source changes.
+func (r *Rollout) Handler(next controller.Handler) controller.Handler {
+	return controller.HandlerFunc(func(ctx context.Context, obj runtime.Object) error {
+		err := next.Handle(ctx, obj)
+		if err != nil {
+			return err
+		}
+
+		secret, ok := obj.(*corev1.Secret)
+		if ok && secret.Namespace == r.secretNamespace && secret.Name == r.secretName {
+			err := r.observe(ctx, secret)
+			if err != nil {
+				return fmt.Errorf("could not observe source secret rollout: %w", err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// source returns the source secret version the namespace should get.
+func (r *Rollout) source(ctx context.Context, ns string, current *corev1.Secret) (*corev1.Secret, error) {
+	err := r.observe(ctx, current)
+	if err != nil {
+		return nil, err
+	}
+
+	state, _ := r.snapshot()
+	if state.phase == rolloutPhaseCanary && r.isCanary(ns) {
+		return state.candidate.DeepCopy(), nil
+	}
+
+	return state.stable.DeepCopy(), nil
+}
+
+// observe checks if the source secret is a new version and starts the rollout in that case.
+func (r *Rollout) observe(ctx context.Context, secret *corev1.Secret) error {
+	hash := secretContentHash(secret)
+
+	// Fast path, most of the times the source is already known.
+	r.mu.Lock()
+	observed := r.loaded && r.state.observed(hash)
+	r.mu.Unlock()
+	if observed {
+		return nil
+	}
+
+	r.transitionMu.Lock()
+	defer r.transitionMu.Unlock()
+
+	err := r.load(ctx, secret)
+	if err != nil {
+		return fmt.Errorf("could not load rollout state: %w", err)
+	}
+
+	current, generation := r.snapshot()
+	switch {
+	// Already known version, observed by another handling meanwhile.
+	case current.observed(hash):
+		return nil
+
+	// First time without stored state, no rollout on startup.
+	case current.stable == nil:
+		next := current
+		next.stable = secret.DeepCopy()
+		return r.store(ctx, generation, next)
+
+	// Back to the stable version (e.g manual rollback), stop any rollout.
+	case hash == secretContentHash(current.stable):
+		next := current
+		next.phase, next.candidate = rolloutPhaseStable, nil
+		err := r.store(ctx, generation, next)
+		if err != nil {
+			return err
+		}
+
+		if current.phase == rolloutPhaseCanary {
+			r.logger.Infof("Source credentials back to the stable version, rollout cancelled")
+			r.triggerCanaries(ctx)
+		}
+		return nil
+	}
+
+	next := rolloutState{
+		phase:     rolloutPhaseCanary,
+		stable:    current.stable,
+		candidate: secret.DeepCopy(),
+		startedAt: time.Now(),
+	}
+	err = r.store(ctx, generation, next)
+	if err != nil {
+		return err
+	}
+
+	r.logger.Infof("New source credentials, starting canary rollout")
+	r.triggerCanaries(ctx)
+
+	return nil
+}
+
+// Run verifies the in progress rollouts and promotes or halts them, until the context is done.
+func (r *Rollout) Run(ctx context.Context) error {
+	t := time.NewTicker(r.checkInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+			r.check(ctx)
+		}
+	}
+}
+
+// check verifies the canary namespaces of the rollout in progress.
+func (r *Rollout) check(ctx context.Context) {
+	state, generation := r.snapshot()
+	if state.phase != rolloutPhaseCanary {
+		return
+	}
+
+	canaries := make([]string, 0, len(r.canaryNamespaces))
+	for ns := range r.canaryNamespaces {
+		canaries = append(canaries, ns)
+	}
+
+	for _, v := range r.verifiers {
+		err := v.Verify(ctx, state.candidate, canaries, state.startedAt)
+		if errors.Is(err, ErrRolloutVerificationFailed) {
+			r.halt(ctx, generation, err)
+			return
+		}
+		if err != nil {
+			r.logger.Warningf("could not verify canary namespaces, retrying on next check: %s", err)
+			return
+		}
+	}
+
+	if time.Since(state.startedAt) < r.verificationPeriod {
+		return
+	}
+
+	r.promote(ctx, generation)
+}
+
+// halt stops the rollout verified on the generation and rolls back the canary namespaces.
+func (r *Rollout) halt(ctx context.Context, generation uint64, verifyErr error) {
+	r.transitionMu.Lock()
+	current, currentGeneration := r.snapshot()
+	// The rollout could have changed while verifying.
+	if currentGeneration != generation {
+		r.transitionMu.Unlock()
+		return
+	}
+	next := current
+	next.phase = rolloutPhaseHalted
+	err := r.store(ctx, generation, next)
+	r.transitionMu.Unlock()
+	if err != nil {
+		r.logger.Errorf("could not halt rollout, retrying on next check: %s", err)
+		return
+	}
+
+	r.logger.Errorf("Canary verification failed, rollout halted: %s", verifyErr)
+	r.notifier.Notify(ctx, notify.Event{
+		Type:      notify.EventTypeRolloutHalted,
+		Namespace: r.secretNamespace,
+		Kind:      string(ResourceKindSecret),
+		Name:      r.secretName,
+		Message:   verifyErr.Error(),
+	})
+	r.triggerCanaries(ctx)
+}
+
+// promote makes the candidate verified on the generation the stable version and replicates
+// it on all the namespaces. The namespaces are only queued on the trigger, the reconciliations
+// are asynchronous.
+func (r *Rollout) promote(ctx context.Context, generation uint64) {
+	r.transitionMu.Lock()
+	current, currentGeneration := r.snapshot()
+	if currentGeneration != generation {
+		r.transitionMu.Unlock()
+		return
+	}
+	next := rolloutState{phase: rolloutPhaseStable, stable: current.candidate}
+	err := r.store(ctx, generation, next)
+	r.transitionMu.Unlock()
+	if err != nil {
+		r.logger.Errorf("could not promote rollout, retrying on next check: %s", err)
+		return
+	}
+
+	r.logger.Infof("Canary verification succeeded, promoting the new credentials")
+	r.notifier.Notify(ctx, notify.Event{
+		Type:      notify.EventTypeRolloutPromoted,
+		Namespace: r.secretNamespace,
+		Kind:      string(ResourceKindSecret),
+		Name:      r.secretName,
+	})
+
+	nsl, err := r.k8sRepo.ListNamespaces(ctx, metav1.ListOptions{})
+	if err != nil {
+		r.logger.Errorf("could not list namespaces, the promotion will be applied on the next resync: %s", err)
+		return
+	}
+	for _, ns := range nsl.Items {
+		r.triggerNamespace(ctx, ns.Name)
+	}
+}
+
+// snapshot returns the current state and its generation.
+func (r *Rollout) snapshot() (rolloutState, uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state, r.generation
+}
+
+// store stores the next state and applies it if the state is still on the generation it was
+// computed from. If it can't be stored the state is not applied, so the in memory state is
+// never ahead of the stored one. Needs to be called with the transitions lock.
+func (r *Rollout) store(ctx context.Context, generation uint64, next rolloutState) error {
+	err := r.storeState(ctx, next)
+	if err != nil {
+		return fmt.Errorf("could not store rollout state: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.generation != generation {
+		return fmt.Errorf("rollout state changed while storing it")
+	}
+	r.state = next
+	r.generation++
+
+	return nil
+}
+
+// load loads the stored rollout state the first time. Needs to be called with the transitions lock.
+func (r *Rollout) load(ctx context.Context, current *corev1.Secret) error {
+	r.mu.Lock()
+	loaded := r.loaded
+	r.mu.Unlock()
+	if loaded {
+		return nil
+	}
+
+	state, err := r.loadState(ctx, current)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.state, r.loaded = state, true
+	r.generation++
+
+	return nil
+}
+
+func (r *Rollout) stateName() string {
+	return r.secretName + "-rollout"
+}
+
+// loadState returns the stored rollout state using the current source secret, if the source
+// changed while the controller was stopped, a new rollout is started against the stored
+// stable version.
+func (r *Rollout) loadState(ctx context.Context, current *corev1.Secret) (rolloutState, error) {
+	rs := rolloutState{phase: rolloutPhaseStable}
+	state, err := r.stateK8sRepo.GetSecret(ctx, r.secretNamespace, r.stateName())
+	if err != nil {
+		if kubeerrors.IsNotFound(err) {
+			return rs, nil
+		}
+		return rs, err
+	}
+
+	stable := &corev1.Secret{}
+	err = json.Unmarshal(state.Data[rolloutStateStableKey], stable)
+	if err != nil {
+		r.logger.Warningf("invalid rollout state, ignoring: %s", err)
+		return rs, nil
+	}
+	rs.stable = stable
+
+	phase := rolloutPhase(state.Annotations[AnnotationRolloutPhase])
+	if phase != rolloutPhaseCanary && phase != rolloutPhaseHalted {
+		return rs, nil
+	}
+	if state.Annotations[AnnotationRolloutCandidateHash] != secretContentHash(current) {
+		return rs, nil
+	}
+	startedAt, err := time.Parse(time.RFC3339, state.Annotations[AnnotationRolloutStartedAt])
+	if err != nil {
+		startedAt = time.Now()
+	}
+
+	rs.phase, rs.candidate, rs.startedAt = phase, current.DeepCopy(), startedAt
+	r.logger.Infof("Rollout state restored on %q phase", phase)
+
+	return rs, nil
+}
+
+// storeState stores the rollout state.
+func (r *Rollout) storeState(ctx context.Context, rs rolloutState) error {
+	// Only the data and metadata used on the replication are stored.
+	stable, err := json.Marshal(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       rs.stable.Namespace,
+			Name:            rs.stable.Name,
+			UID:             rs.stable.UID,
+			ResourceVersion: rs.stable.ResourceVersion,
+			Labels:          rs.stable.Labels,
+			Annotations:     rs.stable.Annotations,
+		},
+		Type: rs.stable.Type,
+		Data: rs.stable.Data,
+	})
+	if err != nil {
+		return fmt.Errorf("could not marshal rollout state: %w", err)
+	}
+
+	annotations := map[string]string{AnnotationRolloutPhase: string(rs.phase)}
+	if rs.candidate != nil {
+		annotations[AnnotationRolloutCandidateHash] = secretContentHash(rs.candidate)
+		annotations[AnnotationRolloutStartedAt] = rs.startedAt.UTC().Format(time.RFC3339)
+	}
+
+	return r.stateK8sRepo.EnsureSecret(ctx, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   r.secretNamespace,
+			Name:        r.stateName(),
+			Annotations: annotations,
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{rolloutStateStableKey: stable},
+	})
+}
+
+func (r *Rollout) triggerCanaries(ctx context.Context) {
+	for ns := range r.canaryNamespaces {
+		r.triggerNamespace(ctx, ns)
+	}
+}
+
+func (r *Rollout) triggerNamespace(ctx context.Context, ns string) {
+	err := r.trigger.Trigger(ctx, ns)
+	if err != nil && !kubeerrors.IsNotFound(err) {
+		r.logger.WithValues(log.Kv{"k8s-name": ns}).Warningf("could not trigger namespace reconciliation: %s", err)
+	}
+}
+
+func (r *Rollout) isCanary(ns string) bool {
+	_, ok := r.canaryNamespaces[ns]
+	return ok
+}
@@ -0,0 +1,231 @@
+package namespace_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spotahome/kooper/v2/controller"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/slok/imagepull-controller-workshop/internal/controller/namespace"
+)
+
+// fakeVerifier is a rollout verifier that returns the configured error.
+type fakeVerifier struct {
+	err   error
+	mu    sync.Mutex
+	calls int
+}
+
+func (f *fakeVerifier) Verify(_ context.Context, _ *corev1.Secret, _ []string, _ time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	return f.err
+}
+
+func (f *fakeVerifier) callCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+// failingStateRepo is a rollout state repository that can't store the state.
+type failingStateRepo struct {
+	*fakeRepo
+}
+
+func (failingStateRepo) EnsureSecret(_ context.Context, _ *corev1.Secret) error {
+	return fmt.Errorf("something")
+}
+
+var noopHandler = controller.HandlerFunc(func(_ context.Context, _ runtime.Object) error { return nil })
+
+func TestRolloutCanary(t *testing.T) {
+	const (
+		v1 = "djE6djE="
+		v2 = "djI6djI="
+	)
+
+	tests := map[string]struct {
+		verifyErr          error
+		verificationPeriod time.Duration
+		// rollbackSource sets the source back to the stable version after starting the rollout.
+		rollbackSource bool
+		// run runs the rollout verifications until the state phase is the expected one.
+		run       bool
+		expPhase  string
+		expCanary string
+		expOther  string
+	}{
+		"A new source version should be replicated only on the canary namespaces.": {
+			expPhase:  "canary",
+			expCanary: v2,
+			expOther:  v1,
+		},
+
+		"A verified rollout should be promoted to all the namespaces after the verification period.": {
+			verificationPeriod: time.Nanosecond,
+			run:                true,
+			expPhase:           "stable",
+			expCanary:          v2,
+			expOther:           v2,
+		},
+
+		"A failed verification should halt the rollout and roll back the canary namespaces.": {
+			verifyErr:          fmt.Errorf("%w: something", namespace.ErrRolloutVerificationFailed),
+			verificationPeriod: time.Hour,
+			run:                true,
+			expPhase:           "halted",
+			expCanary:          v1,
+			expOther:           v1,
+		},
+
+		"A verifier error should not change the rollout in progress.": {
+			verifyErr:          fmt.Errorf("something"),
+			verificationPeriod: time.Nanosecond,
+			run:                true,
+			expPhase:           "canary",
+			expCanary:          v2,
+			expOther:           v1,
+		},
+
+		"A source back to the stable version should cancel the rollout.": {
+			rollbackSource: true,
+			expPhase:       "stable",
+			expCanary:      v1,
+			expOther:       v1,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			repo := newFakeRepo()
+			for _, ns := range []string{"canary-ns", "other-ns"} {
+				repo.addNamespace(testNamespace(ns))
+				repo.addServiceAccount(&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: "default"}})
+			}
+			repo.addSecret(testSourceSecret("source-ns", "creds", v1))
+
+			trigger := &fakeTrigger{}
+			verifier := &fakeVerifier{err: test.verifyErr}
+			rollout, err := namespace.NewRollout(namespace.RolloutConfig{
+				SecretNamespace:    "source-ns",
+				SecretName:         "creds",
+				CanaryNamespaces:   []string{"canary-ns"},
+				VerificationPeriod: test.verificationPeriod,
+				CheckInterval:      time.Millisecond,
+				Verifiers:          []namespace.RolloutVerifier{verifier},
+				K8sRepo:            repo,
+				StateK8sRepo:       repo,
+				Trigger:            trigger,
+			})
+			require.NoError(err)
+
+			h, err := namespace.NewHandler(namespace.HandlerConfig{
+				RunningNamespace:       "source-ns",
+				ImagePullSecretName:    "creds",
+				DisableNamespaceStatus: true,
+				Rollout:                rollout,
+				K8sRepo:                repo,
+			})
+			require.NoError(err)
+			handleAll := func() {
+				for _, ns := range []string{"canary-ns", "other-ns"} {
+					err := h.Handle(context.TODO(), testNamespace(ns))
+					require.NoError(err)
+				}
+			}
+			observe := func(value string) {
+				source := testSourceSecret("source-ns", "creds", value)
+				repo.addSecret(source)
+				err := rollout.Handler(noopHandler).Handle(context.TODO(), source)
+				require.NoError(err)
+			}
+
+			// Replicate the stable version and start the rollout of the new one.
+			handleAll()
+			observe(v2)
+			assert.ElementsMatch([]string{"canary-ns"}, trigger.pop())
+			if test.rollbackSource {
+				observe(v1)
+			}
+
+			if test.run {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				done := make(chan struct{})
+				go func() {
+					defer close(done)
+					_ = rollout.Run(ctx)
+				}()
+				require.Eventually(func() bool {
+					state, err := repo.GetSecret(context.TODO(), "source-ns", "creds-rollout")
+					return err == nil && state.Annotations[namespace.AnnotationRolloutPhase] == test.expPhase && verifier.callCount() > 0
+				}, time.Second, time.Millisecond)
+				cancel()
+				<-done
+			}
+
+			state, err := repo.GetSecret(context.TODO(), "source-ns", "creds-rollout")
+			require.NoError(err)
+			assert.Equal(test.expPhase, state.Annotations[namespace.AnnotationRolloutPhase])
+
+			handleAll()
+			canary, err := repo.GetSecret(context.TODO(), "canary-ns", "creds")
+			require.NoError(err)
+			assert.Equal(testSourceSecret("", "", test.expCanary).Data, canary.Data)
+			other, err := repo.GetSecret(context.TODO(), "other-ns", "creds")
+			require.NoError(err)
+			assert.Equal(testSourceSecret("", "", test.expOther).Data, other.Data)
+		})
+	}
+}
+
+func TestRolloutStateStoreError(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	repo := newFakeRepo()
+	repo.addNamespace(testNamespace("canary-ns"))
+	repo.addServiceAccount(&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "canary-ns", Name: "default"}})
+	source := testSourceSecret("source-ns", "creds", "djE6djE=")
+	repo.addSecret(source)
+
+	rollout, err := namespace.NewRollout(namespace.RolloutConfig{
+		SecretNamespace:  "source-ns",
+		SecretName:       "creds",
+		CanaryNamespaces: []string{"canary-ns"},
+		K8sRepo:          repo,
+		StateK8sRepo:     failingStateRepo{fakeRepo: repo},
+		Trigger:          &fakeTrigger{},
+	})
+	require.NoError(err)
+
+	h, err := namespace.NewHandler(namespace.HandlerConfig{
+		RunningNamespace:       "source-ns",
+		ImagePullSecretName:    "creds",
+		DisableNamespaceStatus: true,
+		Rollout:                rollout,
+		K8sRepo:                repo,
+	})
+	require.NoError(err)
+
+	// Without a stored state the namespaces can't know the version to replicate.
+	err = rollout.Handler(noopHandler).Handle(context.TODO(), source)
+	assert.Error(err)
+	err = h.Handle(context.TODO(), testNamespace("canary-ns"))
+	assert.Error(err)
+	_, err = repo.GetSecret(context.TODO(), "canary-ns", "creds")
+	assert.Error(err)
+}
@@ -0,0 +1,209 @@
+package namespace
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/slok/imagepull-controller-workshop/internal/log"
+)
+
+// SelfHealerRepository is the service to manage k8s resources by the self healer.
+type SelfHealerRepository interface {
+	ListSecrets(ctx context.Context, ns string, options metav1.ListOptions) (*corev1.SecretList, error)
+	WatchSecrets(ctx context.Context, ns string, options metav1.ListOptions) (watch.Interface, error)
+	ListConfigMaps(ctx context.Context, ns string, options metav1.ListOptions) (*corev1.ConfigMapList, error)
+	WatchConfigMaps(ctx context.Context, ns string, options metav1.ListOptions) (watch.Interface, error)
+	ListServiceAccounts(ctx context.Context, ns string, options metav1.ListOptions) (*corev1.ServiceAccountList, error)
+	WatchServiceAccounts(ctx context.Context, ns string, options metav1.ListOptions) (watch.Interface, error)
+}
+
+// SelfHealerConfig is the self healer configuration.
+type SelfHealerConfig struct {
+	K8sRepo SelfHealerRepository
+	Trigger Trigger
+	// Namespaces are the namespaces where the managed resources are watched, if none, all
+	// the namespaces are watched.
+	Namespaces []string
+	// ServiceAccounts will watch the service accounts of the namespaces and heal them when the
+	// image pull secrets change, used when the namespaces are not watched (e.g scoped mode).
+	ServiceAccounts bool
+	Logger          log.Logger
+}
+
+func (c *SelfHealerConfig) defaults() error {
+	if c.K8sRepo == nil {
+		return fmt.Errorf("kubernetes repository is required")
+	}
+
+	if c.Trigger == nil {
+		return fmt.Errorf("trigger is required")
+	}
+
+	if len(c.Namespaces) == 0 {
+		c.Namespaces = []string{metav1.NamespaceAll}
+	}
+
+	if c.Logger == nil {
+		c.Logger = log.Noop
+	}
+	c.Logger = c.Logger.WithValues(log.Kv{"svc": "controller.namespace.SelfHealer"})
+
+	return nil
+}
+
+// SelfHealer watches the resources managed by the controller and when these are edited or
+// deleted, it will trigger the reconciliation of their namespace.
+//
+// Kooper controllers don't handle deleted objects, that's why this uses a plain informer.
+type SelfHealer struct {
+	k8sRepo         SelfHealerRepository
+	trigger         Trigger
+	namespaces      []string
+	serviceAccounts bool
+	logger          log.Logger
+}
+
+// NewSelfHealer returns a new SelfHealer.
+func NewSelfHealer(config SelfHealerConfig) (*SelfHealer, error) {
+	err := config.defaults()
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	return &SelfHealer{
+		k8sRepo:         config.K8sRepo,
+		trigger:         config.Trigger,
+		namespaces:      config.Namespaces,
+		serviceAccounts: config.ServiceAccounts,
+		logger:          config.Logger,
+	}, nil
+}
+
+// Run will start watching the managed resources until the context is done.
+func (s *SelfHealer) Run(ctx context.Context) error {
+	s.logger.Infof("starting self healer")
+	var wg sync.WaitGroup
+	for _, ns := range s.namespaces {
+		ns := ns
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.run(ctx, ns)
+		}()
+	}
+	wg.Wait()
+	s.logger.Infof("self healer stopped")
+
+	return nil
+}
+
+// run watches the managed resources of a namespace (or all) until the context is done.
+func (s *SelfHealer) run(ctx context.Context, ns string) {
+	// Only watch our resources, this way we don't need to watch all the resources of the cluster.
+	selector := labels.Set{managedByKey: managedByValue}.String()
+
+	secretLW := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.LabelSelector = selector
+			return s.k8sRepo.ListSecrets(ctx, ns, options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.LabelSelector = selector
+			return s.k8sRepo.WatchSecrets(ctx, ns, options)
+		},
+	}
+	_, secretInformer := cache.NewInformer(secretLW, &corev1.Secret{}, 0, s.eventHandler(ctx, ResourceKindSecret, func(obj interface{}) bool {
+		secret, ok := obj.(*corev1.Secret)
+		return ok && secret.Annotations[AnnotationContentHash] != secretContentHash(secret)
+	}))
+
+	cmLW := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.LabelSelector = selector
+			return s.k8sRepo.ListConfigMaps(ctx, ns, options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.LabelSelector = selector
+			return s.k8sRepo.WatchConfigMaps(ctx, ns, options)
+		},
+	}
+	_, cmInformer := cache.NewInformer(cmLW, &corev1.ConfigMap{}, 0, s.eventHandler(ctx, ResourceKindConfigMap, func(obj interface{}) bool {
+		cm, ok := obj.(*corev1.ConfigMap)
+		return ok && cm.Annotations[AnnotationContentHash] != configMapContentHash(cm)
+	}))
+
+	if s.serviceAccounts {
+		// The service accounts are not ours, all of them are watched.
+		saLW := &cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return s.k8sRepo.ListServiceAccounts(ctx, ns, options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return s.k8sRepo.WatchServiceAccounts(ctx, ns, options)
+			},
+		}
+		_, saInformer := cache.NewInformer(saLW, &corev1.ServiceAccount{}, 0, cache.ResourceEventHandlerFuncs{
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				oldSA, ok1 := oldObj.(*corev1.ServiceAccount)
+				newSA, ok2 := newObj.(*corev1.ServiceAccount)
+				if !ok1 || !ok2 || equality.Semantic.DeepEqual(oldSA.ImagePullSecrets, newSA.ImagePullSecrets) {
+					return
+				}
+				s.heal(ctx, "ServiceAccount", newSA.Namespace, newSA.Name, "edited")
+			},
+		})
+		go saInformer.Run(ctx.Done())
+	}
+
+	go cmInformer.Run(ctx.Done())
+	secretInformer.Run(ctx.Done())
+}
+
+// eventHandler returns the informer event handler that heals the namespaces when the managed
+// resources are deleted or tampered.
+func (s *SelfHealer) eventHandler(ctx context.Context, kind ResourceKind, tampered func(obj interface{}) bool) cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(_, newObj interface{}) {
+			m, err := meta.Accessor(newObj)
+			if err != nil || !tampered(newObj) {
+				return
+			}
+			s.heal(ctx, string(kind), m.GetNamespace(), m.GetName(), "edited")
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			m, err := meta.Accessor(obj)
+			if err != nil {
+				return
+			}
+			s.heal(ctx, string(kind), m.GetNamespace(), m.GetName(), "deleted")
+		},
+	}
+}
+
+func (s *SelfHealer) heal(ctx context.Context, kind string, ns, name, reason string) {
+	logger := s.logger.WithValues(log.Kv{"k8s-ns": ns, "k8s-name": name, "k8s-kind": kind})
+	logger.Infof("Managed resource %s, triggering namespace reconciliation", reason)
+
+	err := s.trigger.Trigger(ctx, ns)
+	if kubeerrors.IsNotFound(err) {
+		logger.Debugf("Namespace missing, ignoring")
+		return
+	}
+	if err != nil {
+		logger.Errorf("could not trigger namespace reconciliation: %s", err)
+	}
+}
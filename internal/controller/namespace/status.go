@@ -0,0 +1,91 @@
+package namespace
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/slok/imagepull-controller-workshop/internal/log"
+)
+
+// Namespace status annotations written by the controller after handling a namespace.
+const (
+	// AnnotationStatusLastSync is the last time the namespace was synced successfully with a
+	// different status, it's not refreshed on the resyncs that don't change anything.
+	AnnotationStatusLastSync = annotationPrefix + "status-last-sync"
+	// AnnotationStatusSourceContentHash is the content hash of the image pull secret source.
+	AnnotationStatusSourceContentHash = annotationPrefix + "status-source-content-hash"
+	// AnnotationStatusSecretName is the name of the image pull secret on the namespace.
+	AnnotationStatusSecretName = annotationPrefix + "status-secret-name"
+	// AnnotationStatusServiceAccounts are the service accounts (comma separated) referencing the
+	// image pull secret.
+	AnnotationStatusServiceAccounts = annotationPrefix + "status-service-accounts"
+	// AnnotationStatusLastError is the last error handling the namespace.
+	AnnotationStatusLastError = annotationPrefix + "status-last-error"
+	// AnnotationStatusLastErrorTime is the time of the last error handling the namespace.
+	AnnotationStatusLastErrorTime = annotationPrefix + "status-last-error-time"
+)
+
+// syncStatus is the status of a namespace sync.
+type syncStatus struct {
+	secretName        string
+	sourceContentHash string
+	serviceAccounts   []string
+}
+
+// writeStatus writes the sync status on the namespace annotations, only if the status changed.
+// Writing on the namespace triggers a new handling of it, so an unchanged status is never written.
+// Errors writing the status are logged but not returned, the status is best effort.
+func (h handler) writeStatus(ctx context.Context, ns *corev1.Namespace, status syncStatus, syncErr error, logger log.Logger) {
+	now := time.Now().UTC()
+	current := ns.Annotations
+	patch := map[string]*string{}
+	set := func(k, v string) {
+		if current[k] != v {
+			patch[k] = &v
+		}
+	}
+	remove := func(k string) {
+		if _, ok := current[k]; ok {
+			patch[k] = nil
+		}
+	}
+
+	if syncErr != nil {
+		// Requeued handlings are not errors.
+		herr := classifyError(syncErr)
+		if herr.RequeueAfter > 0 {
+			return
+		}
+
+		set(AnnotationStatusLastError, syncErr.Error())
+		if len(patch) > 0 {
+			set(AnnotationStatusLastErrorTime, now.Format(time.RFC3339))
+		}
+	} else {
+		sas := append([]string{}, status.serviceAccounts...)
+		sort.Strings(sas)
+		set(AnnotationStatusSecretName, status.secretName)
+		set(AnnotationStatusSourceContentHash, status.sourceContentHash)
+		set(AnnotationStatusServiceAccounts, strings.Join(sas, ","))
+		remove(AnnotationStatusLastError)
+		remove(AnnotationStatusLastErrorTime)
+
+		_, err := time.Parse(time.RFC3339, current[AnnotationStatusLastSync])
+		if len(patch) > 0 || err != nil {
+			set(AnnotationStatusLastSync, now.Format(time.RFC3339))
+		}
+	}
+
+	if len(patch) == 0 {
+		return
+	}
+
+	err := h.k8sRepo.PatchNamespaceAnnotations(ctx, ns.Name, patch)
+	if err != nil {
+		logger.Warningf("could not write namespace status: %s", err)
+	}
+}
@@ -0,0 +1,79 @@
+package namespace_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/slok/imagepull-controller-workshop/internal/controller/namespace"
+)
+
+func TestHandlerNamespaceStatus(t *testing.T) {
+	tests := map[string]struct {
+		handlings int
+		// lastSyncAge sets the last sync of the written status in the past after the first handling.
+		lastSyncAge time.Duration
+		expPatches  int
+	}{
+		"A first handling should write the namespace status.": {
+			handlings:  1,
+			expPatches: 1,
+		},
+
+		"The handlings of an unchanged namespace should not write the namespace status again.": {
+			handlings:  5,
+			expPatches: 1,
+		},
+
+		"The resyncs of an unchanged namespace synced long ago should not write the namespace status again.": {
+			handlings:   3,
+			lastSyncAge: 24 * time.Hour,
+			expPatches:  1,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			repo := newFakeRepo()
+			repo.addNamespace(testNamespace("test-ns"))
+			repo.addSecret(testSourceSecret("source-ns", "creds", "dXNlcjpwYXNz"))
+			repo.addServiceAccount(&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "test-ns", Name: "default"}})
+
+			h, err := namespace.NewHandler(namespace.HandlerConfig{
+				RunningNamespace:    "source-ns",
+				ImagePullSecretName: "creds",
+				K8sRepo:             repo,
+			})
+			require.NoError(err)
+
+			// Handle the namespace as stored, like the resyncs and the watch events of the status writes.
+			for i := 0; i < test.handlings; i++ {
+				ns, err := repo.GetNamespace(context.TODO(), "test-ns")
+				require.NoError(err)
+				err = h.Handle(context.TODO(), ns)
+				require.NoError(err)
+
+				if i == 0 && test.lastSyncAge > 0 {
+					ns, err := repo.GetNamespace(context.TODO(), "test-ns")
+					require.NoError(err)
+					ns.Annotations[namespace.AnnotationStatusLastSync] = time.Now().Add(-test.lastSyncAge).UTC().Format(time.RFC3339)
+					repo.addNamespace(ns)
+				}
+			}
+
+			assert.Equal(test.expPatches, repo.writeCount("PatchNamespaceAnnotations"))
+			ns, err := repo.GetNamespace(context.TODO(), "test-ns")
+			require.NoError(err)
+			assert.NotEmpty(ns.Annotations[namespace.AnnotationStatusLastSync])
+			assert.Equal("creds", ns.Annotations[namespace.AnnotationStatusSecretName])
+		})
+	}
+}
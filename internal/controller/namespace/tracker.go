@@ -0,0 +1,76 @@
+package namespace
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/spotahome/kooper/v2/controller"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// ReconcileResult is the result of the last reconciliation of a namespace.
+type ReconcileResult struct {
+	Namespace string        `json:"namespace"`
+	Time      time.Time     `json:"time"`
+	Duration  time.Duration `json:"duration"`
+	Success   bool          `json:"success"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// ResultTracker tracks the last reconciliation result of each namespace.
+type ResultTracker struct {
+	mu      sync.RWMutex
+	results map[string]ReconcileResult
+}
+
+// NewResultTracker returns a new ResultTracker.
+func NewResultTracker() *ResultTracker {
+	return &ResultTracker{
+		results: map[string]ReconcileResult{},
+	}
+}
+
+// Handler wraps a namespace handler so the tracker can store the handling results.
+func (r *ResultTracker) Handler(next controller.Handler) controller.Handler {
+	return controller.HandlerFunc(func(ctx context.Context, obj runtime.Object) error {
+		ns, ok := obj.(*corev1.Namespace)
+		if !ok {
+			return next.Handle(ctx, obj)
+		}
+
+		start := time.Now()
+		err := next.Handle(ctx, obj)
+		res := ReconcileResult{
+			Namespace: ns.Name,
+			Time:      start.UTC(),
+			Duration:  time.Since(start),
+			Success:   err == nil,
+		}
+		if err != nil {
+			res.Error = err.Error()
+		}
+
+		r.mu.Lock()
+		r.results[ns.Name] = res
+		r.mu.Unlock()
+
+		return err
+	})
+}
+
+// Results returns the last reconciliation results sorted by namespace.
+func (r *ResultTracker) Results() []ReconcileResult {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	res := make([]ReconcileResult, 0, len(r.results))
+	for _, rr := range r.results {
+		res = append(res, rr)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Namespace < res[j].Namespace })
+
+	return res
+}
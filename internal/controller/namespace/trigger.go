@@ -0,0 +1,220 @@
+package namespace
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/spotahome/kooper/v2/controller"
+	corev1 "k8s.io/api/core/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/slok/imagepull-controller-workshop/internal/log"
+)
+
+// Trigger knows how to force the reconciliation of a namespace.
+type Trigger interface {
+	Trigger(ctx context.Context, ns string) error
+}
+
+// TriggerRepository is the service used by the trigger queue to get the namespaces.
+type TriggerRepository interface {
+	GetNamespace(ctx context.Context, name string) (*corev1.Namespace, error)
+}
+
+// TriggerQueueConfig is the trigger queue configuration.
+type TriggerQueueConfig struct {
+	K8sRepo TriggerRepository
+	// Workers is the number of concurrent triggered handlings.
+	Workers int
+	// MaxGetRetries is the max number of retries when getting a triggered namespace fails.
+	MaxGetRetries int
+	Logger        log.Logger
+}
+
+func (c *TriggerQueueConfig) defaults() error {
+	if c.K8sRepo == nil {
+		return fmt.Errorf("kubernetes repository is required")
+	}
+
+	if c.Workers <= 0 {
+		c.Workers = 1
+	}
+
+	if c.MaxGetRetries <= 0 {
+		c.MaxGetRetries = 5
+	}
+
+	if c.Logger == nil {
+		c.Logger = log.Noop
+	}
+	c.Logger = c.Logger.WithValues(log.Kv{"svc": "controller.namespace.TriggerQueue"})
+
+	return nil
+}
+
+// TriggerQueue knows how to trigger namespace reconciliations outside of the controller
+// resource events.
+//
+// Kooper doesn't give access to its queue, so the triggered namespaces are queued on a
+// separate rate limited queue (deduplicated) and handled by its own workers with the same
+// handler as the controller. This way the triggers don't touch the controller watch (and
+// its resource versions) and are not lost if the watch is restarted. The handlings of the
+// same namespace by the controller and the triggers are serialized using `Handler`.
+type TriggerQueue struct {
+	k8sRepo       TriggerRepository
+	workers       int
+	maxGetRetries int
+	logger        log.Logger
+	queue         workqueue.RateLimitingInterface
+
+	mu    sync.Mutex
+	locks map[string]*namespaceLock
+}
+
+type namespaceLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// NewTriggerQueue returns a new TriggerQueue.
+func NewTriggerQueue(config TriggerQueueConfig) (*TriggerQueue, error) {
+	err := config.defaults()
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	return &TriggerQueue{
+		k8sRepo:       config.K8sRepo,
+		workers:       config.Workers,
+		maxGetRetries: config.MaxGetRetries,
+		logger:        config.Logger,
+		queue:         workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		locks:         map[string]*namespaceLock{},
+	}, nil
+}
+
+// Trigger will queue the reconciliation of the namespace.
+func (t *TriggerQueue) Trigger(ctx context.Context, ns string) error {
+	return t.TriggerAfter(ctx, ns, 0)
+}
+
+// TriggerAfter will queue the reconciliation of the namespace after the duration.
+func (t *TriggerQueue) TriggerAfter(_ context.Context, ns string, after time.Duration) error {
+	if t.queue.ShuttingDown() {
+		return fmt.Errorf("trigger queue stopped")
+	}
+
+	if after <= 0 {
+		t.queue.Add(ns)
+	} else {
+		t.queue.AddAfter(ns, after)
+	}
+
+	return nil
+}
+
+// Handler wraps a namespace handler so the handlings of the same namespace are serialized,
+// the controller and the trigger queue handlers need to be wrapped.
+func (t *TriggerQueue) Handler(next controller.Handler) controller.Handler {
+	return controller.HandlerFunc(func(ctx context.Context, obj runtime.Object) error {
+		ns, ok := obj.(*corev1.Namespace)
+		if !ok {
+			return next.Handle(ctx, obj)
+		}
+
+		unlock := t.lock(ns.Name)
+		defer unlock()
+
+		return next.Handle(ctx, obj)
+	})
+}
+
+// Run handles the triggered namespaces with the handler until the context is done.
+//
+// When the context is done no more namespaces are handled, but the in-flight handlings are
+// not waited nor canceled, like the controller, the handlings lifecycle on shutdown is
+// managed by the handler (e.g drainer).
+func (t *TriggerQueue) Run(ctx context.Context, handler controller.Handler) error {
+	for i := 0; i < t.workers; i++ {
+		go func() {
+			for t.processNext(ctx, handler) {
+			}
+		}()
+	}
+
+	<-ctx.Done()
+	t.queue.ShutDown()
+
+	return nil
+}
+
+func (t *TriggerQueue) processNext(ctx context.Context, handler controller.Handler) bool {
+	item, shutdown := t.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer t.queue.Done(item)
+
+	// The shut down queue returns the queued items, stopped means no more handlings.
+	if ctx.Err() != nil {
+		return false
+	}
+
+	name := item.(string)
+	logger := t.logger.WithValues(log.Kv{"k8s-name": name})
+
+	ns, err := t.k8sRepo.GetNamespace(ctx, name)
+	if err != nil {
+		switch {
+		case kubeerrors.IsNotFound(err):
+			logger.Debugf("Triggered namespace is missing, ignoring")
+			t.queue.Forget(item)
+		case t.queue.NumRequeues(item) < t.maxGetRetries:
+			logger.Warningf("could not get triggered namespace, retrying: %s", err)
+			t.queue.AddRateLimited(item)
+		default:
+			logger.Errorf("could not get triggered namespace: %s", err)
+			t.queue.Forget(item)
+		}
+		return true
+	}
+	t.queue.Forget(item)
+
+	// The handler errors are managed by the handler chain (e.g retry handler). The handling
+	// context is not the queue one, the queue stopping doesn't cancel the handling.
+	err = handler.Handle(context.Background(), ns)
+	if err != nil {
+		logger.Errorf("could not handle triggered namespace: %s", err)
+	}
+
+	return true
+}
+
+// lock locks the namespace and returns the func to unlock it.
+func (t *TriggerQueue) lock(ns string) (unlock func()) {
+	t.mu.Lock()
+	l, ok := t.locks[ns]
+	if !ok {
+		l = &namespaceLock{}
+		t.locks[ns] = l
+	}
+	l.refs++
+	t.mu.Unlock()
+
+	l.mu.Lock()
+
+	return func() {
+		l.mu.Unlock()
+
+		t.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(t.locks, ns)
+		}
+		t.mu.Unlock()
+	}
+}
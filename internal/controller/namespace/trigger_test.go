@@ -0,0 +1,62 @@
+package namespace_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/spotahome/kooper/v2/controller"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/slok/imagepull-controller-workshop/internal/controller/drain"
+	"github.com/slok/imagepull-controller-workshop/internal/controller/namespace"
+)
+
+func TestTriggerQueueShutdownInFlight(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	repo := newFakeRepo()
+	repo.addNamespace(testNamespace("test-ns"))
+	q, err := namespace.NewTriggerQueue(namespace.TriggerQueueConfig{K8sRepo: repo})
+	require.NoError(err)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	finished := make(chan error, 1)
+	drainer := drain.NewDrainer(nil)
+	handler := q.Handler(drainer.Handler("test", controller.HandlerFunc(func(ctx context.Context, _ runtime.Object) error {
+		close(started)
+		<-release
+		finished <- ctx.Err()
+		return nil
+	})))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runErr := make(chan error, 1)
+	go func() { runErr <- q.Run(ctx, handler) }()
+	require.NoError(q.Trigger(ctx, "test-ns"))
+	<-started
+
+	// Shutdown while the handling is in flight, the queue stops without waiting.
+	cancel()
+	select {
+	case err := <-runErr:
+		require.NoError(err)
+	case <-time.After(time.Second):
+		require.Fail("trigger queue didn't stop")
+	}
+	assert.Error(q.Trigger(context.Background(), "test-ns"))
+
+	// The drain lets the in-flight handling finish without canceling it.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(release)
+	}()
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), time.Minute)
+	defer drainCancel()
+	require.NoError(drainer.Drain(drainCtx))
+	assert.NoError(<-finished)
+}
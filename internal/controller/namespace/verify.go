@@ -0,0 +1,72 @@
+package namespace
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// imagePullFailureReasons are the container waiting reasons of image pull failures.
+var imagePullFailureReasons = map[string]struct{}{
+	"ImagePullBackOff": {},
+	"ErrImagePull":     {},
+}
+
+// PodRepository is the service used to get the pods.
+type PodRepository interface {
+	ListPods(ctx context.Context, ns string, options metav1.ListOptions) (*corev1.PodList, error)
+}
+
+// ImagePullVerifier is a rollout verifier that fails when there are new pods (created
+// after the rollout started) failing to pull their images on the canary namespaces.
+type ImagePullVerifier struct {
+	K8sRepo PodRepository
+}
+
+// Verify satisfies RolloutVerifier interface.
+func (i ImagePullVerifier) Verify(ctx context.Context, _ *corev1.Secret, namespaces []string, since time.Time) error {
+	failing := []string{}
+	for _, ns := range namespaces {
+		pods, err := i.K8sRepo.ListPods(ctx, ns, metav1.ListOptions{})
+		if err != nil {
+			return fmt.Errorf("could not list %q namespace pods: %w", ns, err)
+		}
+
+		for _, pod := range pods.Items {
+			if pod.CreationTimestamp.Time.Before(since) {
+				continue
+			}
+
+			if failingImagePull(pod) {
+				failing = append(failing, ns+"/"+pod.Name)
+			}
+		}
+	}
+
+	if len(failing) > 0 {
+		sort.Strings(failing)
+		return fmt.Errorf("%w: pods failing to pull images: %s", ErrRolloutVerificationFailed, strings.Join(failing, ", "))
+	}
+
+	return nil
+}
+
+func failingImagePull(pod corev1.Pod) bool {
+	statuses := append([]corev1.ContainerStatus{}, pod.Status.InitContainerStatuses...)
+	statuses = append(statuses, pod.Status.ContainerStatuses...)
+	for _, s := range statuses {
+		if s.State.Waiting == nil {
+			continue
+		}
+		if _, ok := imagePullFailureReasons[s.State.Waiting.Reason]; ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,401 @@
+package secretcache
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spotahome/kooper/v2/controller"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/slok/imagepull-controller-workshop/internal/log"
+	"github.com/slok/imagepull-controller-workshop/internal/metrics"
+)
+
+// AnnotationExpiresAt is the source secret annotation with the expiry time (RFC3339) of the
+// credentials, used when the registry credentials don't embed their expiry (JWT `exp` claim).
+const AnnotationExpiresAt = "imagepull-controller-workshop.slok.dev/expires-at"
+
+// ExpiryTrackerRepository is the service used by the expiry tracker to evict the expired
+// credentials.
+type ExpiryTrackerRepository interface {
+	DeleteSecretFromCache(ctx context.Context, secret *corev1.Secret) error
+}
+
+// ExpiryTrackerConfig is the expiry tracker configuration.
+type ExpiryTrackerConfig struct {
+	// Thresholds are the time to expiry thresholds that trigger a warning when crossed.
+	Thresholds []time.Duration
+	// RejectExpired refuses the source credentials that are already expired, so they are
+	// not propagated, the cached credentials that expire are evicted from the cache.
+	RejectExpired bool
+	// CheckInterval is the interval to check the tracked credentials against the thresholds.
+	CheckInterval time.Duration
+	// K8sRepo is required to reject the expired credentials.
+	K8sRepo ExpiryTrackerRepository
+	// DockerConfig returns the docker config JSON of the source secrets (e.g normalized),
+	// by default only docker config JSON secrets are tracked.
+	DockerConfig DockerConfigFunc
+	// TimeNow returns the current time, by default `time.Now`.
+	TimeNow         func() time.Time
+	EventRecorder   EventRecorder
+	MetricsRecorder metrics.Recorder
+	Logger          log.Logger
+}
+
+func (c *ExpiryTrackerConfig) defaults() error {
+	for _, t := range c.Thresholds {
+		if t <= 0 {
+			return fmt.Errorf("thresholds must be positive")
+		}
+	}
+
+	if c.CheckInterval <= 0 {
+		c.CheckInterval = 5 * time.Minute
+	}
+
+	if c.RejectExpired && c.K8sRepo == nil {
+		return fmt.Errorf("kubernetes repository is required to reject expired credentials")
+	}
+
+	if c.DockerConfig == nil {
+		c.DockerConfig = rawDockerConfig
+	}
+
+	if c.TimeNow == nil {
+		c.TimeNow = time.Now
+	}
+
+	if c.EventRecorder == nil {
+		c.EventRecorder = noopEventRecorder{}
+	}
+
+	if c.MetricsRecorder == nil {
+		c.MetricsRecorder = metrics.Noop
+	}
+
+	if c.Logger == nil {
+		c.Logger = log.Noop
+	}
+	c.Logger = c.Logger.WithValues(log.Kv{"svc": "controller.secretcache.ExpiryTracker"})
+
+	return nil
+}
+
+// trackedSecret is a source secret whose credentials expiry is tracked.
+type trackedSecret struct {
+	secret   *corev1.Secret
+	expiries map[string]time.Time
+	// levels are the number of thresholds already warned by registry.
+	levels map[string]int
+}
+
+// ExpiryTracker tracks the expiry of the source credentials of each registry, exposing the
+// time to expiry as metrics and warning when the credentials are close to expire.
+type ExpiryTracker struct {
+	thresholds      []time.Duration
+	rejectExpired   bool
+	checkInterval   time.Duration
+	k8sRepo         ExpiryTrackerRepository
+	dockerConfig    DockerConfigFunc
+	timeNow         func() time.Time
+	eventRecorder   EventRecorder
+	metricsRecorder metrics.Recorder
+	logger          log.Logger
+
+	mu      sync.Mutex
+	tracked map[string]*trackedSecret
+}
+
+// NewExpiryTracker returns a new ExpiryTracker.
+func NewExpiryTracker(config ExpiryTrackerConfig) (*ExpiryTracker, error) {
+	err := config.defaults()
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	// Longest first, so the warning level increases as the expiry gets closer.
+	thresholds := append([]time.Duration{}, config.Thresholds...)
+	sort.Slice(thresholds, func(i, j int) bool { return thresholds[i] > thresholds[j] })
+
+	return &ExpiryTracker{
+		thresholds:      thresholds,
+		rejectExpired:   config.RejectExpired,
+		checkInterval:   config.CheckInterval,
+		k8sRepo:         config.K8sRepo,
+		dockerConfig:    config.DockerConfig,
+		timeNow:         config.TimeNow,
+		eventRecorder:   config.EventRecorder,
+		metricsRecorder: config.MetricsRecorder,
+		logger:          config.Logger,
+		tracked:         map[string]*trackedSecret{},
+	}, nil
+}
+
+// Handler wraps the source secret handler (e.g the secret cache handler) to track the
+// expiry of the handled credentials and reject the expired ones if required.
+func (e *ExpiryTracker) Handler(next controller.Handler) controller.Handler {
+	return controller.HandlerFunc(func(ctx context.Context, obj runtime.Object) error {
+		secret, ok := obj.(*corev1.Secret)
+		if !ok {
+			return next.Handle(ctx, obj)
+		}
+
+		logger := e.logger.WithCtxValues(ctx).WithValues(log.Kv{"k8s-ns": secret.Namespace, "k8s-name": secret.Name})
+		data, err := e.dockerConfig(secret)
+		if err != nil {
+			logger.Warningf("Could not get docker config to track credentials expiry: %s", err)
+			return next.Handle(ctx, obj)
+		}
+		if data == nil {
+			return next.Handle(ctx, obj)
+		}
+
+		expiries, err := credentialsExpiries(secret.Annotations[AnnotationExpiresAt], data)
+		if err != nil {
+			logger.Warningf("Could not get credentials expiry: %s", err)
+		}
+
+		if e.rejectExpired {
+			expired := expiredRegistries(expiries, e.timeNow())
+			if len(expired) > 0 {
+				msg := strings.Join(expired, ", ")
+				e.eventRecorder.Eventf(secret, corev1.EventTypeWarning, "CredentialsExpired", "Rejected expired credentials: %s", msg)
+				return fmt.Errorf("expired credentials: %s", msg)
+			}
+		}
+
+		err = next.Handle(ctx, obj)
+		if err != nil {
+			return err
+		}
+
+		e.track(ctx, secret, expiries)
+
+		return nil
+	})
+}
+
+// track starts tracking the secret credentials expiry, the warnings are reset when the
+// expiries change (e.g rotation).
+func (e *ExpiryTracker) track(ctx context.Context, secret *corev1.Secret, expiries map[string]time.Time) {
+	id := fmt.Sprintf("%s/%s", secret.Namespace, secret.Name)
+
+	e.mu.Lock()
+	t, ok := e.tracked[id]
+	if !ok || !sameExpiries(t.expiries, expiries) {
+		t = &trackedSecret{expiries: expiries, levels: map[string]int{}}
+		e.tracked[id] = t
+	}
+	t.secret = secret.DeepCopy()
+	e.mu.Unlock()
+
+	e.recordMetrics(ctx)
+	e.check(ctx)
+}
+
+// Run checks the tracked credentials against the thresholds until the context is done.
+func (e *ExpiryTracker) Run(ctx context.Context) error {
+	t := time.NewTicker(e.checkInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+			e.check(ctx)
+		}
+	}
+}
+
+// check warns about the tracked credentials that crossed a new threshold or expired, the
+// expired ones are evicted from the cache if required.
+func (e *ExpiryTracker) check(ctx context.Context) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := e.timeNow()
+	for _, t := range e.tracked {
+		logger := e.logger.WithCtxValues(ctx).WithValues(log.Kv{"k8s-ns": t.secret.Namespace, "k8s-name": t.secret.Name})
+
+		for registry, expiry := range t.expiries {
+			left := expiry.Sub(now)
+			level := e.level(left)
+			if level <= t.levels[registry] {
+				continue
+			}
+			t.levels[registry] = level
+
+			rLogger := logger.WithValues(log.Kv{"registry": registry, "expires-at": expiry.UTC().Format(time.RFC3339)})
+			if left <= 0 {
+				rLogger.Errorf("Registry credentials expired")
+				e.eventRecorder.Eventf(t.secret, corev1.EventTypeWarning, "CredentialsExpired", "Credentials of %q registry expired at %s", registry, expiry.UTC().Format(time.RFC3339))
+				e.evict(ctx, t, rLogger)
+				continue
+			}
+
+			left = left.Round(time.Minute)
+			rLogger.Warningf("Registry credentials expire in %s", left)
+			e.eventRecorder.Eventf(t.secret, corev1.EventTypeWarning, "CredentialsExpiringSoon", "Credentials of %q registry expire in %s", registry, left)
+		}
+	}
+}
+
+// evict removes the expired credentials from the cache, so they are not propagated anymore
+// until the source is rotated.
+func (e *ExpiryTracker) evict(ctx context.Context, t *trackedSecret, logger log.Logger) {
+	if !e.rejectExpired {
+		return
+	}
+
+	err := e.k8sRepo.DeleteSecretFromCache(ctx, t.secret)
+	if err != nil {
+		logger.Errorf("could not evict expired credentials from cache: %s", err)
+		return
+	}
+	logger.Warningf("Expired credentials evicted from cache")
+}
+
+// level returns the warning level of the time to expiry, 0 means no warning and the
+// highest level (thresholds + 1) means expired.
+func (e *ExpiryTracker) level(left time.Duration) int {
+	if left <= 0 {
+		return len(e.thresholds) + 1
+	}
+
+	level := 0
+	for i, t := range e.thresholds {
+		if left <= t {
+			level = i + 1
+		}
+	}
+
+	return level
+}
+
+func (e *ExpiryTracker) recordMetrics(ctx context.Context) {
+	e.mu.Lock()
+	// If the same registry is on multiple secrets, the earliest expiry is the relevant one.
+	expiries := map[string]time.Time{}
+	for _, t := range e.tracked {
+		for registry, expiry := range t.expiries {
+			if current, ok := expiries[registry]; !ok || expiry.Before(current) {
+				expiries[registry] = expiry
+			}
+		}
+	}
+	e.mu.Unlock()
+
+	e.metricsRecorder.SetRegistryCredentialsExpiries(ctx, expiries)
+}
+
+// credentialsExpiries returns the expiry of the credentials of each registry of the docker
+// config JSON. The expiry is the earliest of the annotation and the JWT tokens `exp` claims,
+// the registries without expiry are omitted.
+func credentialsExpiries(annotation string, dockerConfigJSON []byte) (map[string]time.Time, error) {
+	var annotated *time.Time
+	if annotation != "" {
+		t, err := time.Parse(time.RFC3339, annotation)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %q annotation: %w", AnnotationExpiresAt, err)
+		}
+		annotated = &t
+	}
+
+	cfg := struct {
+		Auths map[string]struct {
+			Password      string `json:"password"`
+			Auth          string `json:"auth"`
+			IdentityToken string `json:"identitytoken"`
+			RegistryToken string `json:"registrytoken"`
+		} `json:"auths"`
+	}{}
+	err := json.Unmarshal(dockerConfigJSON, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid docker config JSON: %w", err)
+	}
+
+	expiries := map[string]time.Time{}
+	for registry, auth := range cfg.Auths {
+		tokens := []string{auth.Password, auth.IdentityToken, auth.RegistryToken}
+		if decoded, err := base64.StdEncoding.DecodeString(auth.Auth); err == nil {
+			if parts := strings.SplitN(string(decoded), ":", 2); len(parts) == 2 {
+				tokens = append(tokens, parts[1])
+			}
+		}
+
+		expiry := annotated
+		for _, token := range tokens {
+			exp, ok := jwtExpiry(token)
+			if ok && (expiry == nil || exp.Before(*expiry)) {
+				expiry = &exp
+			}
+		}
+
+		if expiry != nil {
+			expiries[registry] = *expiry
+		}
+	}
+
+	return expiries, nil
+}
+
+// jwtExpiry returns the `exp` claim of a JWT, the signature is not verified.
+func jwtExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	claims := struct {
+		Exp *json.Number `json:"exp"`
+	}{}
+	err = json.Unmarshal(payload, &claims)
+	if err != nil || claims.Exp == nil {
+		return time.Time{}, false
+	}
+
+	exp, err := claims.Exp.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(int64(exp), 0), true
+}
+
+func expiredRegistries(expiries map[string]time.Time, now time.Time) []string {
+	expired := []string{}
+	for registry, expiry := range expiries {
+		if !expiry.After(now) {
+			expired = append(expired, registry)
+		}
+	}
+	sort.Strings(expired)
+
+	return expired
+}
+
+func sameExpiries(a, b map[string]time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || !bv.Equal(v) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,384 @@
+package secretcache_test
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spotahome/kooper/v2/controller"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/slok/imagepull-controller-workshop/internal/controller/secretcache"
+	"github.com/slok/imagepull-controller-workshop/internal/metrics"
+)
+
+var testNow = time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+
+// testClock is a controllable clock.
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+}
+
+type fakeEventRecorder struct {
+	mu      sync.Mutex
+	reasons []string
+}
+
+func (f *fakeEventRecorder) Eventf(_ runtime.Object, _, reason, _ string, _ ...interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reasons = append(f.reasons, reason)
+}
+
+func (f *fakeEventRecorder) recorded() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.reasons...)
+}
+
+type fakeMetricsRecorder struct {
+	metrics.Recorder
+	expiries map[string]time.Time
+}
+
+func (f *fakeMetricsRecorder) SetRegistryCredentialsExpiries(_ context.Context, expiries map[string]time.Time) {
+	f.expiries = expiries
+}
+
+type fakeCacheRepo struct {
+	mu      sync.Mutex
+	evicted []string
+}
+
+func (f *fakeCacheRepo) DeleteSecretFromCache(_ context.Context, secret *corev1.Secret) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.evicted = append(f.evicted, secret.Name)
+	return nil
+}
+
+func (f *fakeCacheRepo) evictions() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.evicted...)
+}
+
+// testJWT returns an unsigned JWT with the claims JSON as payload.
+func testJWT(claims string, padded bool) string {
+	enc := base64.RawURLEncoding
+	if padded {
+		enc = base64.URLEncoding
+	}
+	return enc.EncodeToString([]byte(`{"alg":"none"}`)) + "." + enc.EncodeToString([]byte(claims)) + "."
+}
+
+func testDockerSecret(annotations map[string]string, auths ...string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "source-ns", Name: "creds", Annotations: annotations},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{
+			corev1.DockerConfigJsonKey: []byte(fmt.Sprintf(`{"auths":{%s}}`, strings.Join(auths, ","))),
+		},
+	}
+}
+
+var noopHandler = controller.HandlerFunc(func(context.Context, runtime.Object) error { return nil })
+
+func TestExpiryTrackerExpiries(t *testing.T) {
+	exp := testNow.Add(time.Hour)
+	expClaims := fmt.Sprintf(`{"exp":%d}`, exp.Unix())
+	earlier := testNow.Add(30 * time.Minute)
+
+	tests := map[string]struct {
+		secret      *corev1.Secret
+		expExpiries map[string]time.Time
+	}{
+		"Credentials without expiry should not be tracked.": {
+			secret:      testDockerSecret(nil, `"r.io":{"username":"u","password":"p"}`),
+			expExpiries: map[string]time.Time{},
+		},
+
+		"An unsigned JWT password should be tracked by its exp claim.": {
+			secret:      testDockerSecret(nil, fmt.Sprintf(`"r.io":{"username":"u","password":%q}`, testJWT(expClaims, false))),
+			expExpiries: map[string]time.Time{"r.io": exp},
+		},
+
+		"A JWT with a padded payload should be tracked by its exp claim.": {
+			secret:      testDockerSecret(nil, fmt.Sprintf(`"r.io":{"username":"u","password":%q}`, testJWT(expClaims, true))),
+			expExpiries: map[string]time.Time{"r.io": exp},
+		},
+
+		"A JWT on the auth field should be tracked by its exp claim.": {
+			secret: testDockerSecret(nil, fmt.Sprintf(`"r.io":{"auth":%q}`,
+				base64.StdEncoding.EncodeToString([]byte("u:"+testJWT(expClaims, false))))),
+			expExpiries: map[string]time.Time{"r.io": exp},
+		},
+
+		"A JWT identity token should be tracked by its exp claim.": {
+			secret:      testDockerSecret(nil, fmt.Sprintf(`"r.io":{"identitytoken":%q}`, testJWT(expClaims, false))),
+			expExpiries: map[string]time.Time{"r.io": exp},
+		},
+
+		"A JWT with a non numeric exp claim should be ignored.": {
+			secret:      testDockerSecret(nil, fmt.Sprintf(`"r.io":{"username":"u","password":%q}`, testJWT(`{"exp":"tomorrow"}`, false))),
+			expExpiries: map[string]time.Time{},
+		},
+
+		"A JWT without exp claim should be ignored.": {
+			secret:      testDockerSecret(nil, fmt.Sprintf(`"r.io":{"username":"u","password":%q}`, testJWT(`{"sub":"u"}`, false))),
+			expExpiries: map[string]time.Time{},
+		},
+
+		"A JWT with an invalid payload encoding should be ignored.": {
+			secret:      testDockerSecret(nil, `"r.io":{"username":"u","password":"a.!!!.b"}`),
+			expExpiries: map[string]time.Time{},
+		},
+
+		"The annotation should set the expiry of all the registries.": {
+			secret: testDockerSecret(map[string]string{secretcache.AnnotationExpiresAt: exp.Format(time.RFC3339)},
+				`"r.io":{"username":"u","password":"p"}`, `"q.io":{"username":"u","password":"p"}`),
+			expExpiries: map[string]time.Time{"r.io": exp, "q.io": exp},
+		},
+
+		"The earliest of the annotation and the JWT should be the expiry.": {
+			secret: testDockerSecret(map[string]string{secretcache.AnnotationExpiresAt: earlier.Format(time.RFC3339)},
+				fmt.Sprintf(`"r.io":{"username":"u","password":%q}`, testJWT(expClaims, false))),
+			expExpiries: map[string]time.Time{"r.io": earlier},
+		},
+
+		"An invalid annotation should not track the expiries.": {
+			secret: testDockerSecret(map[string]string{secretcache.AnnotationExpiresAt: "tomorrow"},
+				fmt.Sprintf(`"r.io":{"username":"u","password":%q}`, testJWT(expClaims, false))),
+			expExpiries: map[string]time.Time{},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			mr := &fakeMetricsRecorder{Recorder: metrics.Noop}
+			tracker, err := secretcache.NewExpiryTracker(secretcache.ExpiryTrackerConfig{
+				TimeNow:         func() time.Time { return testNow },
+				MetricsRecorder: mr,
+			})
+			require.NoError(err)
+
+			err = tracker.Handler(noopHandler).Handle(context.TODO(), test.secret)
+			require.NoError(err)
+
+			require.Len(mr.expiries, len(test.expExpiries))
+			for registry, exp := range test.expExpiries {
+				assert.True(exp.Equal(mr.expiries[registry]), "registry %s: expected %s, got %s", registry, exp, mr.expiries[registry])
+			}
+		})
+	}
+}
+
+func TestExpiryTrackerThresholds(t *testing.T) {
+	expiry := testNow.Add(48 * time.Hour)
+
+	tests := map[string]struct {
+		// elapsed are the clock steps where the credentials are checked.
+		elapsed    []time.Duration
+		expReasons []string
+	}{
+		"Credentials far from the expiry should not warn.": {
+			elapsed:    []time.Duration{0, time.Hour},
+			expReasons: []string{},
+		},
+
+		"Crossing a threshold should warn once.": {
+			elapsed:    []time.Duration{30 * time.Hour, 31 * time.Hour, 32 * time.Hour},
+			expReasons: []string{"CredentialsExpiringSoon"},
+		},
+
+		"Crossing each threshold should warn.": {
+			elapsed:    []time.Duration{30 * time.Hour, 47*time.Hour + 30*time.Minute},
+			expReasons: []string{"CredentialsExpiringSoon", "CredentialsExpiringSoon"},
+		},
+
+		"Crossing multiple thresholds at once should warn once.": {
+			elapsed:    []time.Duration{47*time.Hour + 30*time.Minute},
+			expReasons: []string{"CredentialsExpiringSoon"},
+		},
+
+		"Expired credentials should warn once.": {
+			elapsed:    []time.Duration{30 * time.Hour, 49 * time.Hour, 50 * time.Hour},
+			expReasons: []string{"CredentialsExpiringSoon", "CredentialsExpired"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			clock := &testClock{now: testNow}
+			er := &fakeEventRecorder{}
+			tracker, err := secretcache.NewExpiryTracker(secretcache.ExpiryTrackerConfig{
+				Thresholds:    []time.Duration{time.Hour, 24 * time.Hour},
+				TimeNow:       clock.Now,
+				EventRecorder: er,
+			})
+			require.NoError(err)
+
+			// Handling the same credentials again checks them without resetting the warnings.
+			h := tracker.Handler(noopHandler)
+			secret := testDockerSecret(map[string]string{secretcache.AnnotationExpiresAt: expiry.Format(time.RFC3339)}, `"r.io":{"username":"u","password":"p"}`)
+			for _, elapsed := range test.elapsed {
+				clock.set(testNow.Add(elapsed))
+				err := h.Handle(context.TODO(), secret)
+				require.NoError(err)
+			}
+
+			assert.Equal(test.expReasons, er.recorded())
+		})
+	}
+}
+
+func TestExpiryTrackerRejectExpired(t *testing.T) {
+	tests := map[string]struct {
+		rejectExpired bool
+		expiresIn     time.Duration
+		expErr        bool
+		expNext       bool
+		expReasons    []string
+	}{
+		"Valid credentials should be handled.": {
+			rejectExpired: true,
+			expiresIn:     time.Hour,
+			expNext:       true,
+			expReasons:    []string{},
+		},
+
+		"Expired credentials should be rejected if required.": {
+			rejectExpired: true,
+			expiresIn:     -time.Hour,
+			expErr:        true,
+			expReasons:    []string{"CredentialsExpired"},
+		},
+
+		"Expired credentials should be handled if not required to reject them.": {
+			rejectExpired: false,
+			expiresIn:     -time.Hour,
+			expNext:       true,
+			expReasons:    []string{"CredentialsExpired"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			er := &fakeEventRecorder{}
+			repo := &fakeCacheRepo{}
+			tracker, err := secretcache.NewExpiryTracker(secretcache.ExpiryTrackerConfig{
+				RejectExpired: test.rejectExpired,
+				K8sRepo:       repo,
+				TimeNow:       func() time.Time { return testNow },
+				EventRecorder: er,
+			})
+			require.NoError(err)
+
+			called := false
+			next := controller.HandlerFunc(func(context.Context, runtime.Object) error {
+				called = true
+				return nil
+			})
+			expiry := testNow.Add(test.expiresIn)
+			secret := testDockerSecret(map[string]string{secretcache.AnnotationExpiresAt: expiry.Format(time.RFC3339)}, `"r.io":{"username":"u","password":"p"}`)
+			err = tracker.Handler(next).Handle(context.TODO(), secret)
+
+			if test.expErr {
+				assert.Error(err)
+			} else {
+				assert.NoError(err)
+			}
+			assert.Equal(test.expNext, called)
+			assert.Equal(test.expReasons, er.recorded())
+			// Rejected credentials are never cached, nothing to evict.
+			assert.Empty(repo.evictions())
+		})
+	}
+}
+
+func TestExpiryTrackerEviction(t *testing.T) {
+	tests := map[string]struct {
+		rejectExpired bool
+		expEvicted    []string
+	}{
+		"Cached credentials that expire should be evicted if required.": {
+			rejectExpired: true,
+			expEvicted:    []string{"creds"},
+		},
+
+		"Cached credentials that expire should be kept if not required to reject them.": {
+			rejectExpired: false,
+			expEvicted:    []string{},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			clock := &testClock{now: testNow}
+			er := &fakeEventRecorder{}
+			repo := &fakeCacheRepo{}
+			tracker, err := secretcache.NewExpiryTracker(secretcache.ExpiryTrackerConfig{
+				RejectExpired: test.rejectExpired,
+				CheckInterval: time.Millisecond,
+				K8sRepo:       repo,
+				TimeNow:       clock.Now,
+				EventRecorder: er,
+			})
+			require.NoError(err)
+
+			expiry := testNow.Add(time.Hour)
+			secret := testDockerSecret(map[string]string{secretcache.AnnotationExpiresAt: expiry.Format(time.RFC3339)}, `"r.io":{"username":"u","password":"p"}`)
+			err = tracker.Handler(noopHandler).Handle(context.TODO(), secret)
+			require.NoError(err)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				_ = tracker.Run(ctx)
+			}()
+
+			clock.set(testNow.Add(2 * time.Hour))
+			require.Eventually(func() bool { return len(er.recorded()) > 0 }, time.Second, time.Millisecond)
+			cancel()
+			<-done
+
+			assert.Equal([]string{"CredentialsExpired"}, er.recorded())
+			assert.Equal(test.expEvicted, repo.evictions())
+		})
+	}
+}
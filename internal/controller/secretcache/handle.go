@@ -2,13 +2,20 @@ package secretcache
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"sort"
+	"sync"
 
 	"github.com/spotahome/kooper/v2/controller"
+	"go.opentelemetry.io/otel/attribute"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 
 	"github.com/slok/imagepull-controller-workshop/internal/log"
+	"github.com/slok/imagepull-controller-workshop/internal/notify"
+	"github.com/slok/imagepull-controller-workshop/internal/tracing"
 )
 
 // HandlerRepository is the service to manage k8s resources by the Kubernetes controller handler.
@@ -17,34 +24,92 @@ type HandlerRepository interface {
 }
 
 type handler struct {
-	k8sRepo HandlerRepository
-	logger  log.Logger
+	k8sRepo  HandlerRepository
+	notifier notify.Notifier
+	logger   log.Logger
+
+	mu     *sync.Mutex
+	hashes map[string]string
 }
 
-// NewHandler returns the handler for the controller.
-func NewHandler(k8sRepo HandlerRepository, logger log.Logger) (controller.Handler, error) {
+// NewHandler returns the handler for the controller. The notifier will be notified when
+// the content of an already seen secret changes.
+func NewHandler(k8sRepo HandlerRepository, notifier notify.Notifier, logger log.Logger) (controller.Handler, error) {
+	if notifier == nil {
+		notifier = notify.Noop
+	}
+
 	return handler{
-		k8sRepo: k8sRepo,
-		logger:  logger.WithValues(log.Kv{"svc": "controller.secretcache.Handler"}),
+		k8sRepo:  k8sRepo,
+		notifier: notifier,
+		logger:   logger.WithValues(log.Kv{"svc": "controller.secretcache.Handler"}),
+		mu:       &sync.Mutex{},
+		hashes:   map[string]string{},
 	}, nil
 }
 
-func (h handler) Handle(ctx context.Context, obj runtime.Object) error {
+func (h handler) Handle(ctx context.Context, obj runtime.Object) (err error) {
 	secret, ok := obj.(*corev1.Secret)
 	if !ok {
 		h.logger.Warningf("controller received object that is not a secret")
 		return nil
 	}
 
-	logger := h.logger.WithValues(log.Kv{"k8s-ns": secret.Namespace, "k8s-name": secret.Name})
+	ctx, span := tracing.Start(ctx, "controller.secretcache.Handle", attribute.String("k8s.namespace", secret.Namespace), attribute.String("k8s.name", secret.Name))
+	defer func() { tracing.End(span, err) }()
+	ctx = tracing.CtxWithLogValues(ctx)
+
+	logger := h.logger.WithCtxValues(ctx).WithValues(log.Kv{"k8s-ns": secret.Namespace, "k8s-name": secret.Name})
 
 	// Store on cache.
-	err := h.k8sRepo.SetSecretOnCache(ctx, secret)
+	err = h.k8sRepo.SetSecretOnCache(ctx, secret)
 	if err != nil {
 		return fmt.Errorf("could not update secret cache: %w", err)
 	}
 
 	logger.Infof("Secret cache updated")
 
+	if h.rotated(secret) {
+		logger.Infof("Secret rotated")
+		h.notifier.Notify(ctx, notify.Event{
+			Type:      notify.EventTypeSecretRotated,
+			Namespace: secret.Namespace,
+			Kind:      "Secret",
+			Name:      secret.Name,
+		})
+	}
+
 	return nil
 }
+
+// rotated returns true if the secret content changed since the last time it was handled,
+// the first time a secret is handled is not a rotation.
+func (h handler) rotated(secret *corev1.Secret) bool {
+	id := fmt.Sprintf("%s/%s", secret.Namespace, secret.Name)
+	hash := dataHash(secret.Data)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	previous, ok := h.hashes[id]
+	h.hashes[id] = hash
+
+	return ok && previous != hash
+}
+
+func dataHash(data map[string][]byte) string {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	for _, k := range keys {
+		_, _ = h.Write([]byte(k))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write(data[k])
+		_, _ = h.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
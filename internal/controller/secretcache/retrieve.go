@@ -18,18 +18,19 @@ type RetrieverRepository interface {
 	WatchSecrets(ctx context.Context, ns string, options metav1.ListOptions) (watch.Interface, error)
 }
 
-// NewRetriever returns the retriever for the controller.
-func NewRetriever(k8sRepo RetrieverRepository, ns, secretName string) (controller.Retriever, error) {
+// NewRetriever returns the retriever for the controller. The list and watch requests
+// will end when the received context is done.
+func NewRetriever(ctx context.Context, k8sRepo RetrieverRepository, ns, secretName string) (controller.Retriever, error) {
 	secretFieldSelector := fmt.Sprintf("metadata.name=%s", secretName)
 
 	return controller.RetrieverFromListerWatcher(&cache.ListWatch{
 		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
 			options.FieldSelector = secretFieldSelector
-			return k8sRepo.ListSecrets(context.Background(), ns, options)
+			return k8sRepo.ListSecrets(ctx, ns, options)
 		},
 		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
 			options.FieldSelector = secretFieldSelector
-			return k8sRepo.WatchSecrets(context.Background(), ns, options)
+			return k8sRepo.WatchSecrets(ctx, ns, options)
 		},
 	})
 }
@@ -0,0 +1,198 @@
+package secretcache
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/spotahome/kooper/v2/controller"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/slok/imagepull-controller-workshop/internal/log"
+	"github.com/slok/imagepull-controller-workshop/internal/metrics"
+	"github.com/slok/imagepull-controller-workshop/internal/registry"
+)
+
+// RegistryVerifier knows how to verify the registry credentials of a docker config JSON.
+type RegistryVerifier interface {
+	VerifyDockerConfig(ctx context.Context, dockerConfigJSON []byte) ([]registry.RegistryResult, error)
+}
+
+// EventRecorder knows how to record Kubernetes events.
+type EventRecorder interface {
+	Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{})
+}
+
+type noopEventRecorder struct{}
+
+func (noopEventRecorder) Eventf(runtime.Object, string, string, string, ...interface{}) {}
+
+// DockerConfigFunc returns the docker config JSON of a secret, nil if the secret doesn't have
+// docker credentials.
+type DockerConfigFunc func(secret *corev1.Secret) ([]byte, error)
+
+// rawDockerConfig is the default DockerConfigFunc, only supports docker config JSON secrets.
+func rawDockerConfig(secret *corev1.Secret) ([]byte, error) {
+	return secret.Data[corev1.DockerConfigJsonKey], nil
+}
+
+// VerifyHandlerConfig is the verify handler configuration.
+type VerifyHandlerConfig struct {
+	// Handler is the handler called with the secrets whose credentials are valid.
+	Handler  controller.Handler
+	Verifier RegistryVerifier
+	// DockerConfig returns the docker config JSON of the secrets (e.g normalizing other formats).
+	DockerConfig    DockerConfigFunc
+	EventRecorder   EventRecorder
+	MetricsRecorder metrics.Recorder
+	Logger          log.Logger
+}
+
+func (c *VerifyHandlerConfig) defaults() error {
+	if c.Handler == nil {
+		return fmt.Errorf("handler is required")
+	}
+
+	if c.Verifier == nil {
+		return fmt.Errorf("verifier is required")
+	}
+
+	if c.DockerConfig == nil {
+		c.DockerConfig = rawDockerConfig
+	}
+
+	if c.EventRecorder == nil {
+		c.EventRecorder = noopEventRecorder{}
+	}
+
+	if c.MetricsRecorder == nil {
+		c.MetricsRecorder = metrics.Noop
+	}
+
+	if c.Logger == nil {
+		c.Logger = log.Noop
+	}
+	c.Logger = c.Logger.WithValues(log.Kv{"svc": "controller.secretcache.VerifyHandler"})
+
+	return nil
+}
+
+type verifyHandler struct {
+	next            controller.Handler
+	verifier        RegistryVerifier
+	dockerConfig    DockerConfigFunc
+	eventRecorder   EventRecorder
+	metricsRecorder metrics.Recorder
+	logger          log.Logger
+
+	mu       *sync.Mutex
+	verified map[string]string
+}
+
+// NewVerifyHandler returns a handler that verifies the docker config credentials of the
+// source secrets against their registries before passing them to the wrapped handler, this
+// way invalid credentials never get on the secret cache. The secrets without docker credentials
+// are passed as they are.
+//
+// Only the credentials rejected by the registries are rejected, the ones that could not be
+// verified (e.g registry unreachable) are passed with a warning and verified again on the
+// next handling, this way a registry outage doesn't block the credentials rotation.
+func NewVerifyHandler(config VerifyHandlerConfig) (controller.Handler, error) {
+	err := config.defaults()
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	return verifyHandler{
+		next:            config.Handler,
+		verifier:        config.Verifier,
+		dockerConfig:    config.DockerConfig,
+		eventRecorder:   config.EventRecorder,
+		metricsRecorder: config.MetricsRecorder,
+		logger:          config.Logger,
+		mu:              &sync.Mutex{},
+		verified:        map[string]string{},
+	}, nil
+}
+
+func (v verifyHandler) Handle(ctx context.Context, obj runtime.Object) error {
+	secret, ok := obj.(*corev1.Secret)
+	if !ok {
+		return v.next.Handle(ctx, obj)
+	}
+
+	data, err := v.dockerConfig(secret)
+	if err != nil {
+		v.eventRecorder.Eventf(secret, corev1.EventTypeWarning, "RegistryAuthFailed", "Invalid docker credentials: %s", err)
+		return fmt.Errorf("invalid docker credentials: %w", err)
+	}
+	if data == nil {
+		return v.next.Handle(ctx, obj)
+	}
+
+	// Already verified credentials (e.g resyncs), don't hit the registries again.
+	id := fmt.Sprintf("%s/%s", secret.Namespace, secret.Name)
+	hash := dataHash(secret.Data)
+	v.mu.Lock()
+	verified := v.verified[id] == hash
+	v.mu.Unlock()
+	if verified {
+		return v.next.Handle(ctx, obj)
+	}
+
+	logger := v.logger.WithCtxValues(ctx).WithValues(log.Kv{"k8s-ns": secret.Namespace, "k8s-name": secret.Name})
+
+	results, err := v.verifier.VerifyDockerConfig(ctx, data)
+	if err != nil {
+		v.eventRecorder.Eventf(secret, corev1.EventTypeWarning, "RegistryAuthFailed", "Could not verify registry credentials: %s", err)
+		return fmt.Errorf("could not verify registry credentials: %w", err)
+	}
+
+	failed, unverified := []string{}, []string{}
+	for _, r := range results {
+		v.metricsRecorder.SetRegistryCredentialsStatus(ctx, r.Registry, string(r.Result))
+
+		rLogger := logger.WithValues(log.Kv{"registry": r.Registry, "result": r.Result})
+		switch r.Result {
+		case registry.ResultValid:
+			rLogger.Debugf("Registry credentials verified")
+		case registry.ResultSkipped:
+			rLogger.Infof("Registry credentials verification skipped: %s", r.Err)
+		case registry.ResultError:
+			rLogger.Warningf("Registry credentials could not be verified: %s", r.Err)
+			unverified = append(unverified, fmt.Sprintf("%s (%s)", r.Registry, r.Err))
+		default:
+			rLogger.Warningf("Registry credentials verification failed: %s", r.Err)
+			failed = append(failed, fmt.Sprintf("%s (%s: %s)", r.Registry, r.Result, r.Err))
+		}
+	}
+
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		msg := strings.Join(failed, ", ")
+		v.eventRecorder.Eventf(secret, corev1.EventTypeWarning, "RegistryAuthFailed", "Registry credentials verification failed: %s", msg)
+		return fmt.Errorf("registry credentials verification failed: %s", msg)
+	}
+
+	// Accept the unverified credentials, but don't mark them as verified so they are verified
+	// again on the next handling.
+	if len(unverified) > 0 {
+		sort.Strings(unverified)
+		msg := strings.Join(unverified, ", ")
+		v.eventRecorder.Eventf(secret, corev1.EventTypeWarning, "RegistryAuthUnverified", "Registry credentials could not be verified: %s", msg)
+		logger.Warningf("Registry credentials accepted without verification: %s", msg)
+		return v.next.Handle(ctx, obj)
+	}
+
+	v.eventRecorder.Eventf(secret, corev1.EventTypeNormal, "RegistryAuthVerified", "Credentials of %d registries verified", len(results))
+	logger.Infof("Registry credentials verified")
+
+	v.mu.Lock()
+	v.verified[id] = hash
+	v.mu.Unlock()
+
+	return v.next.Handle(ctx, obj)
+}
@@ -0,0 +1,246 @@
+package manifests
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/yaml"
+
+	"github.com/slok/imagepull-controller-workshop/internal/preflight"
+)
+
+// Port is a port exposed by the controller.
+type Port struct {
+	Name string
+	Port int32
+}
+
+// Config is the manifests configuration.
+type Config struct {
+	// Name is the name used on all the resources.
+	Name string
+	// Namespace is the namespace where the controller runs.
+	Namespace string
+	Image     string
+	// Args are the controller command line arguments.
+	Args []string
+	// SecretEnv are the environment variables set from the keys with the same name of the
+	// `Name` secret (e.g tokens), this way the secrets are not on the manifests.
+	SecretEnv []string
+	// Ports are the ports exposed by the controller with a service.
+	Ports []Port
+	// Permissions are the permissions required by the controller, rendered as the RBAC rules.
+	Permissions []preflight.Permission
+}
+
+func (c *Config) defaults() error {
+	if c.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+
+	if c.Namespace == "" {
+		return fmt.Errorf("namespace is required")
+	}
+
+	if c.Image == "" {
+		return fmt.Errorf("image is required")
+	}
+
+	return nil
+}
+
+// Render renders the controller manifests as a multi document YAML: service account, RBAC,
+// deployment and service.
+func Render(config Config) ([]byte, error) {
+	err := config.defaults()
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	labels := map[string]string{"app.kubernetes.io/name": config.Name}
+	meta := func(ns string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{Name: config.Name, Namespace: ns, Labels: labels}
+	}
+	subjects := []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: config.Name, Namespace: config.Namespace}}
+
+	objs := []runtime.Object{
+		&corev1.ServiceAccount{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ServiceAccount"},
+			ObjectMeta: meta(config.Namespace),
+		},
+	}
+
+	// RBAC, cluster wide permissions are rendered as a cluster role and the namespaced ones as
+	// a role on each namespace.
+	rules := policyRules(config.Permissions)
+	namespaces := make([]string, 0, len(rules))
+	for ns := range rules {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+
+	for _, ns := range namespaces {
+		if ns == "" {
+			objs = append(objs,
+				&rbacv1.ClusterRole{
+					TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "ClusterRole"},
+					ObjectMeta: meta(""),
+					Rules:      rules[ns],
+				},
+				&rbacv1.ClusterRoleBinding{
+					TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "ClusterRoleBinding"},
+					ObjectMeta: meta(""),
+					RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: config.Name},
+					Subjects:   subjects,
+				},
+			)
+			continue
+		}
+
+		objs = append(objs,
+			&rbacv1.Role{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "Role"},
+				ObjectMeta: meta(ns),
+				Rules:      rules[ns],
+			},
+			&rbacv1.RoleBinding{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "RoleBinding"},
+				ObjectMeta: meta(ns),
+				RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: config.Name},
+				Subjects:   subjects,
+			},
+		)
+	}
+
+	// Deployment, only one replica, the controller doesn't support leader election.
+	replicas := int32(1)
+	container := corev1.Container{
+		Name:  "controller",
+		Image: config.Image,
+		Args:  config.Args,
+	}
+	for _, env := range config.SecretEnv {
+		container.Env = append(container.Env, corev1.EnvVar{
+			Name: env,
+			ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: config.Name},
+				Key:                  env,
+			}},
+		})
+	}
+	for _, p := range config.Ports {
+		container.Ports = append(container.Ports, corev1.ContainerPort{Name: p.Name, ContainerPort: p.Port, Protocol: corev1.ProtocolTCP})
+	}
+
+	objs = append(objs, &appsv1.Deployment{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+		ObjectMeta: meta(config.Namespace),
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Strategy: appsv1.DeploymentStrategy{Type: appsv1.RecreateDeploymentStrategyType},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					ServiceAccountName: config.Name,
+					Containers:         []corev1.Container{container},
+				},
+			},
+		},
+	})
+
+	if len(config.Ports) > 0 {
+		svc := &corev1.Service{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Service"},
+			ObjectMeta: meta(config.Namespace),
+			Spec:       corev1.ServiceSpec{Selector: labels},
+		}
+		for _, p := range config.Ports {
+			svc.Spec.Ports = append(svc.Spec.Ports, corev1.ServicePort{Name: p.Name, Port: p.Port, TargetPort: intstr.FromString(p.Name), Protocol: corev1.ProtocolTCP})
+		}
+		objs = append(objs, svc)
+	}
+
+	var b bytes.Buffer
+	for _, obj := range objs {
+		data, err := marshal(obj)
+		if err != nil {
+			return nil, err
+		}
+		b.WriteString("---\n")
+		b.Write(data)
+	}
+
+	return b.Bytes(), nil
+}
+
+// policyRules groups the permissions by namespace as RBAC rules, one rule per resource.
+func policyRules(perms []preflight.Permission) map[string][]rbacv1.PolicyRule {
+	verbs := map[string]map[string]map[string]struct{}{}
+	for _, p := range perms {
+		if verbs[p.Namespace] == nil {
+			verbs[p.Namespace] = map[string]map[string]struct{}{}
+		}
+		if verbs[p.Namespace][p.Resource] == nil {
+			verbs[p.Namespace][p.Resource] = map[string]struct{}{}
+		}
+		verbs[p.Namespace][p.Resource][p.Verb] = struct{}{}
+	}
+
+	rules := map[string][]rbacv1.PolicyRule{}
+	for ns, resources := range verbs {
+		names := make([]string, 0, len(resources))
+		for r := range resources {
+			names = append(names, r)
+		}
+		sort.Strings(names)
+
+		for _, r := range names {
+			vs := make([]string, 0, len(resources[r]))
+			for v := range resources[r] {
+				vs = append(vs, v)
+			}
+			sort.Strings(vs)
+			rules[ns] = append(rules[ns], rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{r}, Verbs: vs})
+		}
+	}
+
+	return rules
+}
+
+// marshal marshals the object as YAML without the fields that are set by the API server.
+func marshal(obj runtime.Object) ([]byte, error) {
+	u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, fmt.Errorf("could not convert %T: %w", obj, err)
+	}
+	delete(u, "status")
+	removeCreationTimestamps(u)
+
+	data, err := yaml.Marshal(u)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal %T: %w", obj, err)
+	}
+
+	return data, nil
+}
+
+func removeCreationTimestamps(obj map[string]interface{}) {
+	for k, v := range obj {
+		if k == "metadata" {
+			if m, ok := v.(map[string]interface{}); ok {
+				delete(m, "creationTimestamp")
+			}
+		}
+		if m, ok := v.(map[string]interface{}); ok {
+			removeCreationTimestamps(m)
+		}
+	}
+}
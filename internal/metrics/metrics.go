@@ -0,0 +1,39 @@
+package metrics
+
+import (
+	"context"
+	"time"
+)
+
+// Recorder knows how to record the application metrics.
+type Recorder interface {
+	// IncNamespaceResourceConflict increments the number of conflicts found with already
+	// present resources that are not managed by the controller.
+	IncNamespaceResourceConflict(ctx context.Context, kind, policy, decision string)
+	// IncNamespaceHandlerError increments the number of namespace handling errors by kind
+	// (transient, permanent) and reason.
+	IncNamespaceHandlerError(ctx context.Context, kind, reason string)
+	// IncNamespaceHandlerRetry increments the number of namespace handling retries by result
+	// (requeued, exhausted).
+	IncNamespaceHandlerRetry(ctx context.Context, result string)
+	// SetRegistryCredentialsStatus sets the result (valid, invalid, error, skipped) of the last
+	// verification of the source credentials against a registry.
+	SetRegistryCredentialsStatus(ctx context.Context, registry, result string)
+	// SetRegistryCredentialsExpiries sets the expiry time of the source credentials of each
+	// registry, replacing the previous ones.
+	SetRegistryCredentialsExpiries(ctx context.Context, expiries map[string]time.Time)
+	// SetClusterConnected sets if the controller of the cluster is connected and running.
+	SetClusterConnected(ctx context.Context, connected bool)
+}
+
+// Noop recorder doesn't record anything.
+const Noop = noop(0)
+
+type noop int
+
+func (noop) IncNamespaceResourceConflict(ctx context.Context, kind, policy, decision string)   {}
+func (noop) IncNamespaceHandlerError(ctx context.Context, kind, reason string)                 {}
+func (noop) IncNamespaceHandlerRetry(ctx context.Context, result string)                       {}
+func (noop) SetRegistryCredentialsStatus(ctx context.Context, registry, result string)         {}
+func (noop) SetRegistryCredentialsExpiries(ctx context.Context, expiries map[string]time.Time) {}
+func (noop) SetClusterConnected(ctx context.Context, connected bool)                           {}
@@ -0,0 +1,149 @@
+package prometheus
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/slok/imagepull-controller-workshop/internal/metrics"
+)
+
+const prefix = "imagepull_controller"
+
+type recorder struct {
+	namespaceResourceConflicts *prometheus.CounterVec
+	namespaceHandlerErrors     *prometheus.CounterVec
+	namespaceHandlerRetries    *prometheus.CounterVec
+	registryCredentialsStatus  *prometheus.GaugeVec
+	registryCredentialsExpiry  *expiryCollector
+	clusterConnected           prometheus.Gauge
+}
+
+// registryCredentialsResults are the possible results of a registry credentials verification.
+var registryCredentialsResults = []string{"valid", "invalid", "error", "skipped"}
+
+// NewRecorder returns a new metrics.Recorder implementation using Prometheus as the backend.
+func NewRecorder(reg prometheus.Registerer) metrics.Recorder {
+	r := recorder{
+		namespaceResourceConflicts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prefix,
+			Subsystem: "namespace",
+			Name:      "resource_conflicts_total",
+			Help:      "Total number of conflicts with unmanaged resources on the namespaces.",
+		}, []string{"kind", "policy", "decision"}),
+
+		namespaceHandlerErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prefix,
+			Subsystem: "namespace",
+			Name:      "handler_errors_total",
+			Help:      "Total number of namespace handling errors.",
+		}, []string{"kind", "reason"}),
+
+		namespaceHandlerRetries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prefix,
+			Subsystem: "namespace",
+			Name:      "handler_retries_total",
+			Help:      "Total number of namespace handling retries.",
+		}, []string{"result"}),
+
+		registryCredentialsStatus: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: prefix,
+			Subsystem: "registry",
+			Name:      "credentials_status",
+			Help:      "The result of the last source credentials verification against the registry (1 for the current result).",
+		}, []string{"registry", "result"}),
+
+		registryCredentialsExpiry: &expiryCollector{
+			desc: prometheus.NewDesc(
+				prometheus.BuildFQName(prefix, "registry", "credentials_expiry_seconds"),
+				"The time left until the source credentials of the registry expire (negative if already expired).",
+				[]string{"registry"}, nil,
+			),
+			expiries: map[string]time.Time{},
+		},
+
+		clusterConnected: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: prefix,
+			Subsystem: "cluster",
+			Name:      "connected",
+			Help:      "If the controller of the cluster is connected and running (1) or failing (0).",
+		}),
+	}
+
+	reg.MustRegister(
+		r.namespaceResourceConflicts,
+		r.namespaceHandlerErrors,
+		r.namespaceHandlerRetries,
+		r.registryCredentialsStatus,
+		r.registryCredentialsExpiry,
+		r.clusterConnected,
+	)
+
+	return r
+}
+
+func (r recorder) IncNamespaceResourceConflict(_ context.Context, kind, policy, decision string) {
+	r.namespaceResourceConflicts.WithLabelValues(kind, policy, decision).Inc()
+}
+
+func (r recorder) IncNamespaceHandlerError(_ context.Context, kind, reason string) {
+	r.namespaceHandlerErrors.WithLabelValues(kind, reason).Inc()
+}
+
+func (r recorder) IncNamespaceHandlerRetry(_ context.Context, result string) {
+	r.namespaceHandlerRetries.WithLabelValues(result).Inc()
+}
+
+func (r recorder) SetRegistryCredentialsStatus(_ context.Context, registry, result string) {
+	for _, res := range registryCredentialsResults {
+		v := 0.0
+		if res == result {
+			v = 1
+		}
+		r.registryCredentialsStatus.WithLabelValues(registry, res).Set(v)
+	}
+}
+
+func (r recorder) SetRegistryCredentialsExpiries(_ context.Context, expiries map[string]time.Time) {
+	r.registryCredentialsExpiry.set(expiries)
+}
+
+func (r recorder) SetClusterConnected(_ context.Context, connected bool) {
+	v := 0.0
+	if connected {
+		v = 1
+	}
+	r.clusterConnected.Set(v)
+}
+
+// expiryCollector computes the time to expiry on every scrape, this way the metric is
+// accurate even if the credentials are not handled again.
+type expiryCollector struct {
+	desc *prometheus.Desc
+
+	mu       sync.Mutex
+	expiries map[string]time.Time
+}
+
+func (e *expiryCollector) set(expiries map[string]time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.expiries = make(map[string]time.Time, len(expiries))
+	for registry, expiry := range expiries {
+		e.expiries[registry] = expiry
+	}
+}
+
+func (e *expiryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- e.desc
+}
+
+func (e *expiryCollector) Collect(ch chan<- prometheus.Metric) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for registry, expiry := range e.expiries {
+		ch <- prometheus.MustNewConstMetric(e.desc, prometheus.GaugeValue, time.Until(expiry).Seconds(), registry)
+	}
+}
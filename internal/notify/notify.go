@@ -0,0 +1,51 @@
+package notify
+
+import (
+	"context"
+	"time"
+)
+
+// EventType is the type of a notification event.
+type EventType string
+
+const (
+	// EventTypeSecretRotated is the event of a source secret content change.
+	EventTypeSecretRotated EventType = "secret-rotated"
+	// EventTypeResourcePropagated is the event of a resource copy written on a namespace.
+	EventTypeResourcePropagated EventType = "resource-propagated"
+	// EventTypeFanOutCompleted is the event of a source secret change handled on all the namespaces.
+	EventTypeFanOutCompleted EventType = "fan-out-completed"
+	// EventTypePropagationFailing is the event of a namespace whose handling failures
+	// exceeded the threshold.
+	EventTypePropagationFailing EventType = "propagation-failing"
+	// EventTypeRolloutPromoted is the event of new credentials promoted from the canary
+	// namespaces to all the namespaces.
+	EventTypeRolloutPromoted EventType = "rollout-promoted"
+	// EventTypeRolloutHalted is the event of a credentials rollout halted by a failed verification.
+	EventTypeRolloutHalted EventType = "rollout-halted"
+)
+
+// Event is a notification event.
+type Event struct {
+	Type EventType `json:"type"`
+	Time time.Time `json:"time"`
+	// Namespace is the namespace where the event happened.
+	Namespace string `json:"namespace"`
+	// Kind and Name identify the resource of the event (if any).
+	Kind    string `json:"kind,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// Notifier knows how to notify events. Notifications are best effort, implementations
+// should not block.
+type Notifier interface {
+	Notify(ctx context.Context, e Event)
+}
+
+// Noop notifier doesn't notify anything.
+const Noop = noop(0)
+
+type noop int
+
+func (noop) Notify(ctx context.Context, e Event) {}
@@ -0,0 +1,322 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/slok/imagepull-controller-workshop/internal/log"
+	"github.com/slok/imagepull-controller-workshop/internal/notify"
+)
+
+// Format is the payload format sent to a webhook.
+type Format string
+
+const (
+	// FormatGeneric sends a JSON payload with the summary and all the batched events.
+	FormatGeneric Format = "generic"
+	// FormatSlack sends a Slack incoming webhook compatible JSON payload.
+	FormatSlack Format = "slack"
+)
+
+// Formats are the supported webhook formats.
+var Formats = []Format{FormatGeneric, FormatSlack}
+
+// Target is a webhook where the notifications will be sent.
+type Target struct {
+	URL    string
+	Format Format
+}
+
+// maxListedNamespaces is the max number of namespaces listed on the summary of a group of events.
+const maxListedNamespaces = 10
+
+// Config is the webhook notifier configuration.
+type Config struct {
+	Targets []Target
+	// Debounce is the duration without new events that will flush the batched events.
+	Debounce time.Duration
+	// MaxDelay is the max duration the first batched event will wait before being sent,
+	// this way a continuous stream of events is still notified.
+	MaxDelay time.Duration
+	// QueueSize is the max number of events waiting to be batched, the rest will be dropped.
+	QueueSize  int
+	HTTPClient *http.Client
+	Logger     log.Logger
+}
+
+func (c *Config) defaults() error {
+	if len(c.Targets) == 0 {
+		return fmt.Errorf("at least one target is required")
+	}
+
+	for _, t := range c.Targets {
+		if t.URL == "" {
+			return fmt.Errorf("target URL is required")
+		}
+
+		switch t.Format {
+		case FormatGeneric, FormatSlack:
+		default:
+			return fmt.Errorf("unknown %q webhook format", t.Format)
+		}
+	}
+
+	if c.Debounce <= 0 {
+		c.Debounce = 30 * time.Second
+	}
+
+	if c.MaxDelay <= 0 {
+		c.MaxDelay = 5 * time.Minute
+	}
+
+	if c.MaxDelay < c.Debounce {
+		c.MaxDelay = c.Debounce
+	}
+
+	if c.QueueSize <= 0 {
+		c.QueueSize = 10000
+	}
+
+	if c.HTTPClient == nil {
+		c.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	if c.Logger == nil {
+		c.Logger = log.Noop
+	}
+	c.Logger = c.Logger.WithValues(log.Kv{"svc": "notify.webhook.Notifier"})
+
+	return nil
+}
+
+// Notifier is a notifier that sends the events to webhooks. The events are batched and
+// debounced, so a burst of events (e.g a rotation propagated to all the namespaces) is
+// sent as a single message.
+type Notifier struct {
+	targets    []Target
+	debounce   time.Duration
+	maxDelay   time.Duration
+	httpClient *http.Client
+	logger     log.Logger
+	events     chan notify.Event
+}
+
+// NewNotifier returns a new webhook notifier. The notifier will not send anything until
+// it's run.
+func NewNotifier(config Config) (*Notifier, error) {
+	err := config.defaults()
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	return &Notifier{
+		targets:    config.Targets,
+		debounce:   config.Debounce,
+		maxDelay:   config.MaxDelay,
+		httpClient: config.HTTPClient,
+		logger:     config.Logger,
+		events:     make(chan notify.Event, config.QueueSize),
+	}, nil
+}
+
+// Notify queues the event to be sent, it doesn't block, if the queue is full the event will
+// be dropped.
+func (n *Notifier) Notify(ctx context.Context, e notify.Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+
+	select {
+	case n.events <- e:
+	default:
+		n.logger.Warningf("Notification queue full, dropping %q event", e.Type)
+	}
+}
+
+// Run will batch the notified events and send them to the webhooks until the context
+// is cancelled, the pending events will be sent before returning.
+func (n *Notifier) Run(ctx context.Context) error {
+	var (
+		batch       []notify.Event
+		debounceC   <-chan time.Time
+		maxDelayC   <-chan time.Time
+		debounceTmr *time.Timer
+	)
+
+	flush := func(ctx context.Context) {
+		if debounceTmr != nil {
+			debounceTmr.Stop()
+		}
+		debounceC, maxDelayC, debounceTmr = nil, nil, nil
+		if len(batch) == 0 {
+			return
+		}
+
+		n.send(ctx, batch)
+		batch = nil
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Batch the queued events that were not received yet.
+			for queued := true; queued; {
+				select {
+				case e := <-n.events:
+					batch = append(batch, e)
+				default:
+					queued = false
+				}
+			}
+
+			// Send the pending events with a fresh context, the received one is already cancelled.
+			sendCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			flush(sendCtx)
+			cancel()
+			return nil
+
+		case e := <-n.events:
+			batch = append(batch, e)
+			if debounceTmr != nil {
+				debounceTmr.Stop()
+			}
+			debounceTmr = time.NewTimer(n.debounce)
+			debounceC = debounceTmr.C
+			if maxDelayC == nil {
+				maxDelayC = time.After(n.maxDelay)
+			}
+
+		case <-debounceC:
+			flush(ctx)
+
+		case <-maxDelayC:
+			flush(ctx)
+		}
+	}
+}
+
+// send sends the batch of events to all the targets.
+func (n *Notifier) send(ctx context.Context, events []notify.Event) {
+	summary := summarize(events)
+
+	for _, t := range n.targets {
+		var payload interface{}
+		switch t.Format {
+		case FormatSlack:
+			payload = slackPayload{Text: summary}
+		default:
+			payload = genericPayload{Summary: summary, Events: events}
+		}
+
+		err := n.post(ctx, t.URL, payload)
+		if err != nil {
+			n.logger.Errorf("could not send %d events to %s webhook: %s", len(events), t.Format, err)
+			continue
+		}
+		n.logger.Debugf("%d events sent to %s webhook", len(events), t.Format)
+	}
+}
+
+func (n *Notifier) post(ctx context.Context, url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("could not marshal payload: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("could not create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected %d status code", resp.StatusCode)
+	}
+
+	return nil
+}
+
+type slackPayload struct {
+	Text string `json:"text"`
+}
+
+type genericPayload struct {
+	Summary string         `json:"summary"`
+	Events  []notify.Event `json:"events"`
+}
+
+// summarize returns a human readable summary of the events, grouping the events by type
+// and resource.
+func summarize(events []notify.Event) string {
+	type group struct {
+		e          notify.Event
+		namespaces map[string]struct{}
+	}
+
+	groups := map[string]*group{}
+	keys := []string{}
+	for _, e := range events {
+		key := fmt.Sprintf("%s/%s/%s", e.Type, e.Kind, e.Name)
+		switch e.Type {
+		case notify.EventTypeSecretRotated, notify.EventTypeFanOutCompleted, notify.EventTypeRolloutPromoted, notify.EventTypeRolloutHalted:
+			key += "/" + e.Namespace
+		}
+
+		g, ok := groups[key]
+		if !ok {
+			g = &group{e: e, namespaces: map[string]struct{}{}}
+			groups[key] = g
+			keys = append(keys, key)
+		}
+		g.namespaces[e.Namespace] = struct{}{}
+	}
+
+	lines := make([]string, 0, len(keys))
+	for _, key := range keys {
+		g := groups[key]
+		switch g.e.Type {
+		case notify.EventTypeSecretRotated:
+			lines = append(lines, fmt.Sprintf("%s %s/%s rotated", g.e.Kind, g.e.Namespace, g.e.Name))
+		case notify.EventTypeResourcePropagated:
+			lines = append(lines, fmt.Sprintf("%s %q updated on %d namespaces", g.e.Kind, g.e.Name, len(g.namespaces)))
+		case notify.EventTypeFanOutCompleted:
+			lines = append(lines, fmt.Sprintf("%s %s/%s change propagated to all namespaces: %s", g.e.Kind, g.e.Namespace, g.e.Name, g.e.Message))
+		case notify.EventTypeRolloutPromoted:
+			lines = append(lines, fmt.Sprintf("%s %s/%s canary verified, promoted to all namespaces", g.e.Kind, g.e.Namespace, g.e.Name))
+		case notify.EventTypeRolloutHalted:
+			lines = append(lines, fmt.Sprintf("%s %s/%s rollout halted: %s", g.e.Kind, g.e.Namespace, g.e.Name, g.e.Message))
+		case notify.EventTypePropagationFailing:
+			lines = append(lines, fmt.Sprintf("Propagation failing on %d namespaces: %s", len(g.namespaces), listNamespaces(g.namespaces)))
+		default:
+			lines = append(lines, fmt.Sprintf("%s on %d namespaces", g.e.Type, len(g.namespaces)))
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func listNamespaces(nss map[string]struct{}) string {
+	names := make([]string, 0, len(nss))
+	for ns := range nss {
+		names = append(names, ns)
+	}
+	sort.Strings(names)
+
+	if len(names) > maxListedNamespaces {
+		return fmt.Sprintf("%s and %d more", strings.Join(names[:maxListedNamespaces], ", "), len(names)-maxListedNamespaces)
+	}
+
+	return strings.Join(names, ", ")
+}
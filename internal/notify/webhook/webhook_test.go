@@ -0,0 +1,235 @@
+package webhook_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/slok/imagepull-controller-workshop/internal/notify"
+	"github.com/slok/imagepull-controller-workshop/internal/notify/webhook"
+)
+
+// testServer is a webhook server that records the received payloads.
+type testServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	payloads []map[string]interface{}
+}
+
+func newTestServer(t *testing.T) *testServer {
+	s := &testServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("could not read body: %s", err)
+			return
+		}
+		payload := map[string]interface{}{}
+		err = json.Unmarshal(body, &payload)
+		if err != nil {
+			t.Errorf("invalid JSON payload: %s", err)
+			return
+		}
+
+		s.mu.Lock()
+		s.payloads = append(s.payloads, payload)
+		s.mu.Unlock()
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *testServer) received() []map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]map[string]interface{}{}, s.payloads...)
+}
+
+func TestNotifierPayloads(t *testing.T) {
+	events := []notify.Event{
+		{Type: notify.EventTypeSecretRotated, Namespace: "source-ns", Kind: "Secret", Name: "creds"},
+		{Type: notify.EventTypeResourcePropagated, Namespace: "ns-1", Kind: "Secret", Name: "creds"},
+		{Type: notify.EventTypeResourcePropagated, Namespace: "ns-2", Kind: "Secret", Name: "creds"},
+		{Type: notify.EventTypeFanOutCompleted, Namespace: "source-ns", Kind: "Secret", Name: "creds", Message: "handled on 2 namespaces in 3s"},
+		{Type: notify.EventTypePropagationFailing, Namespace: "ns-3"},
+		{Type: notify.EventTypeRolloutHalted, Namespace: "source-ns", Kind: "Secret", Name: "creds", Message: "something"},
+	}
+	expSummary := `Secret source-ns/creds rotated
+Secret "creds" updated on 2 namespaces
+Secret source-ns/creds change propagated to all namespaces: handled on 2 namespaces in 3s
+Propagation failing on 1 namespaces: ns-3
+Secret source-ns/creds rollout halted: something`
+
+	tests := map[string]struct {
+		format webhook.Format
+	}{
+		"The Slack format should send the summary as the text.": {
+			format: webhook.FormatSlack,
+		},
+
+		"The generic format should send the summary and the events.": {
+			format: webhook.FormatGeneric,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			srv := newTestServer(t)
+			n, err := webhook.NewNotifier(webhook.Config{
+				Targets:  []webhook.Target{{URL: srv.URL, Format: test.format}},
+				Debounce: 10 * time.Millisecond,
+			})
+			require.NoError(err)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go func() { _ = n.Run(ctx) }()
+
+			for _, e := range events {
+				n.Notify(context.TODO(), e)
+			}
+
+			require.Eventually(func() bool { return len(srv.received()) > 0 }, time.Second, time.Millisecond)
+			payloads := srv.received()
+			require.Len(payloads, 1)
+
+			switch test.format {
+			case webhook.FormatSlack:
+				assert.Equal(map[string]interface{}{"text": expSummary}, payloads[0])
+			case webhook.FormatGeneric:
+				assert.Equal(expSummary, payloads[0]["summary"])
+				gotEvents, ok := payloads[0]["events"].([]interface{})
+				require.True(ok)
+				assert.Len(gotEvents, len(events))
+				assert.Equal(string(notify.EventTypeSecretRotated), gotEvents[0].(map[string]interface{})["type"])
+				assert.NotEmpty(gotEvents[0].(map[string]interface{})["time"])
+			}
+		})
+	}
+}
+
+func TestNotifierBatching(t *testing.T) {
+	tests := map[string]struct {
+		debounce time.Duration
+		maxDelay time.Duration
+		// events is the number of events, notified one every interval.
+		events      int
+		interval    time.Duration
+		cancel      bool
+		expPayloads int
+		expEvents   int
+	}{
+		"A burst of events should be sent as a single message after the debounce.": {
+			debounce:    50 * time.Millisecond,
+			maxDelay:    time.Minute,
+			events:      500,
+			expPayloads: 1,
+			expEvents:   500,
+		},
+
+		"A continuous stream of events should be sent after the max delay.": {
+			debounce:    100 * time.Millisecond,
+			maxDelay:    150 * time.Millisecond,
+			events:      20,
+			interval:    10 * time.Millisecond,
+			expPayloads: 2,
+			expEvents:   20,
+		},
+
+		"The pending events should be sent on shutdown.": {
+			debounce:    time.Minute,
+			maxDelay:    time.Minute,
+			events:      10,
+			cancel:      true,
+			expPayloads: 1,
+			expEvents:   10,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			srv := newTestServer(t)
+			n, err := webhook.NewNotifier(webhook.Config{
+				Targets:  []webhook.Target{{URL: srv.URL, Format: webhook.FormatGeneric}},
+				Debounce: test.debounce,
+				MaxDelay: test.maxDelay,
+			})
+			require.NoError(err)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				_ = n.Run(ctx)
+			}()
+
+			for i := 0; i < test.events; i++ {
+				n.Notify(context.TODO(), notify.Event{Type: notify.EventTypeResourcePropagated, Namespace: "ns", Kind: "Secret", Name: "creds"})
+				time.Sleep(test.interval)
+			}
+
+			if test.cancel {
+				cancel()
+				<-done
+			}
+
+			countEvents := func() int {
+				total := 0
+				for _, p := range srv.received() {
+					total += len(p["events"].([]interface{}))
+				}
+				return total
+			}
+			require.Eventually(func() bool { return countEvents() == test.expEvents }, 2*time.Second, time.Millisecond)
+			assert.Len(srv.received(), test.expPayloads)
+		})
+	}
+}
+
+func TestNotifierQueueFull(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	srv := newTestServer(t)
+	n, err := webhook.NewNotifier(webhook.Config{
+		Targets:   []webhook.Target{{URL: srv.URL, Format: webhook.FormatGeneric}},
+		Debounce:  time.Minute,
+		QueueSize: 5,
+	})
+	require.NoError(err)
+
+	// Not running, the events above the queue size are dropped without blocking.
+	for i := 0; i < 10; i++ {
+		n.Notify(context.TODO(), notify.Event{Type: notify.EventTypeResourcePropagated, Namespace: "ns"})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = n.Run(ctx)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	<-done
+
+	payloads := srv.received()
+	require.Len(payloads, 1)
+	assert.Len(payloads[0]["events"], 5)
+}
@@ -0,0 +1,272 @@
+package preflight
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/slok/imagepull-controller-workshop/internal/log"
+)
+
+// Repository is the service used by the preflight checks.
+type Repository interface {
+	CheckSelfAccess(ctx context.Context, attrs authorizationv1.ResourceAttributes) (allowed bool, reason string, err error)
+	GetSecret(ctx context.Context, ns string, name string) (*corev1.Secret, error)
+	GetConfigMap(ctx context.Context, ns string, name string) (*corev1.ConfigMap, error)
+}
+
+// Config is the preflight checker configuration.
+type Config struct {
+	// Cluster is the name of the checked cluster, used on the report.
+	Cluster string
+	// SourceNamespace is the namespace with the replicated resources, if empty the source
+	// is not checked (e.g target clusters get the source from the running cluster).
+	SourceNamespace string
+	// ImagePullSecretName is the image pull secret source, if empty it's not checked (e.g
+	// the credentials come from Vault).
+	ImagePullSecretName string
+	// SecretNames and ConfigMapNames are the extra resources replicated from the source namespace.
+	SecretNames    []string
+	ConfigMapNames []string
+	// Namespaces are the namespaces where the resources are propagated, if none, all the
+	// cluster namespaces (cluster wide permissions).
+	Namespaces []string
+	// NamespaceStatus requires patching the namespaces to write the status annotations.
+	NamespaceStatus bool
+	// CanaryNamespaces require listing their pods to verify the canary rollouts and storing
+	// the rollout state on the source namespace.
+	CanaryNamespaces []string
+	// KubeConfigSecretNamespaces require getting the secrets with the target clusters kubeconfigs.
+	KubeConfigSecretNamespaces []string
+	// ValidateImagePullSecret validates the image pull secret source content.
+	ValidateImagePullSecret func(secret *corev1.Secret) error
+	K8sRepo                 Repository
+	Logger                  log.Logger
+}
+
+func (c *Config) defaults() error {
+	if c.K8sRepo == nil {
+		return fmt.Errorf("kubernetes repository is required")
+	}
+
+	if c.ValidateImagePullSecret == nil {
+		c.ValidateImagePullSecret = func(*corev1.Secret) error { return nil }
+	}
+
+	if c.Logger == nil {
+		c.Logger = log.Noop
+	}
+	c.Logger = c.Logger.WithValues(log.Kv{"svc": "preflight.Checker"})
+
+	return nil
+}
+
+// Result is the result of a preflight check.
+type Result struct {
+	Check string
+	Err   error
+}
+
+// Report is the result of all the preflight checks of a cluster.
+type Report struct {
+	Cluster string
+	Results []Result
+}
+
+// Failed returns true if any of the checks failed.
+func (r Report) Failed() bool {
+	for _, res := range r.Results {
+		if res.Err != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// String returns the human readable report.
+func (r Report) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Preflight checks of %q cluster:\n", r.Cluster)
+	for _, res := range r.Results {
+		if res.Err != nil {
+			fmt.Fprintf(&b, "  [FAIL] %s: %s\n", res.Check, res.Err)
+			continue
+		}
+		fmt.Fprintf(&b, "  [OK]   %s\n", res.Check)
+	}
+
+	return b.String()
+}
+
+// Permission is a Kubernetes API action the controller needs to perform, all the resources
+// are from the core API group.
+type Permission struct {
+	Verb     string
+	Resource string
+	// Namespace is empty for the cluster wide permissions.
+	Namespace string
+}
+
+func (p Permission) String() string {
+	if p.Namespace == "" {
+		return fmt.Sprintf("%s %s (cluster wide)", p.Verb, p.Resource)
+	}
+	return fmt.Sprintf("%s %s on %q namespace", p.Verb, p.Resource, p.Namespace)
+}
+
+// Checker checks the controller has the required RBAC permissions and configuration before
+// starting, this way the misconfigurations are found before handling the namespaces.
+type Checker struct {
+	cfg    Config
+	logger log.Logger
+}
+
+// NewChecker returns a new Checker.
+func NewChecker(config Config) (*Checker, error) {
+	err := config.defaults()
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	return &Checker{cfg: config, logger: config.Logger}, nil
+}
+
+// Check runs all the preflight checks.
+func (c *Checker) Check(ctx context.Context) Report {
+	report := Report{Cluster: c.cfg.Cluster}
+
+	for _, p := range RequiredPermissions(c.cfg) {
+		report.Results = append(report.Results, Result{
+			Check: "can " + p.String(),
+			Err:   c.checkPermission(ctx, p),
+		})
+	}
+
+	if c.cfg.SourceNamespace != "" && c.cfg.ImagePullSecretName != "" {
+		report.Results = append(report.Results, Result{
+			Check: fmt.Sprintf("image pull secret %s/%s is valid", c.cfg.SourceNamespace, c.cfg.ImagePullSecretName),
+			Err:   c.checkImagePullSecret(ctx),
+		})
+	}
+
+	if c.cfg.SourceNamespace != "" {
+		for _, name := range c.cfg.SecretNames {
+			_, err := c.cfg.K8sRepo.GetSecret(ctx, c.cfg.SourceNamespace, name)
+			report.Results = append(report.Results, Result{
+				Check: fmt.Sprintf("secret %s/%s exists", c.cfg.SourceNamespace, name),
+				Err:   err,
+			})
+		}
+
+		for _, name := range c.cfg.ConfigMapNames {
+			_, err := c.cfg.K8sRepo.GetConfigMap(ctx, c.cfg.SourceNamespace, name)
+			report.Results = append(report.Results, Result{
+				Check: fmt.Sprintf("configmap %s/%s exists", c.cfg.SourceNamespace, name),
+				Err:   err,
+			})
+		}
+	}
+
+	if report.Failed() {
+		c.logger.Warningf("Preflight checks failed")
+	} else {
+		c.logger.Infof("Preflight checks succeeded")
+	}
+
+	return report
+}
+
+func (c *Checker) checkPermission(ctx context.Context, p Permission) error {
+	allowed, reason, err := c.cfg.K8sRepo.CheckSelfAccess(ctx, authorizationv1.ResourceAttributes{
+		Verb:      p.Verb,
+		Resource:  p.Resource,
+		Namespace: p.Namespace,
+	})
+	if err != nil {
+		return fmt.Errorf("could not review access: %w", err)
+	}
+
+	if !allowed {
+		if reason == "" {
+			reason = "RBAC missing"
+		}
+		return fmt.Errorf("forbidden: %s", reason)
+	}
+
+	return nil
+}
+
+func (c *Checker) checkImagePullSecret(ctx context.Context) error {
+	secret, err := c.cfg.K8sRepo.GetSecret(ctx, c.cfg.SourceNamespace, c.cfg.ImagePullSecretName)
+	if err != nil {
+		return err
+	}
+
+	return c.cfg.ValidateImagePullSecret(secret)
+}
+
+// RequiredPermissions returns the permissions required by the controller with the configuration,
+// the repository and the preflight settings are ignored.
+func RequiredPermissions(config Config) []Permission {
+	perms := []Permission{}
+	add := func(resource string, namespaces []string, verbs ...string) {
+		for _, ns := range namespaces {
+			for _, v := range verbs {
+				perms = append(perms, Permission{Verb: v, Resource: resource, Namespace: ns})
+			}
+		}
+	}
+
+	// Source namespace.
+	if config.SourceNamespace != "" {
+		source := []string{config.SourceNamespace}
+		switch {
+		case config.ImagePullSecretName != "":
+			add("secrets", source, "get", "list", "watch")
+		case len(config.SecretNames) > 0:
+			add("secrets", source, "get")
+		}
+		if len(config.ConfigMapNames) > 0 {
+			add("configmaps", source, "get")
+		}
+		// The canary rollouts store their state on a secret.
+		if len(config.CanaryNamespaces) > 0 {
+			add("secrets", source, "get", "create", "update")
+		}
+		add("events", source, "create", "patch")
+	}
+
+	// Target namespaces, cluster wide if none.
+	targets := config.Namespaces
+	if len(targets) == 0 {
+		targets = []string{""}
+		add("namespaces", targets, "get", "list", "watch")
+		if config.NamespaceStatus {
+			add("namespaces", targets, "patch")
+		}
+	} else {
+		// The scoped namespaces are get one by one (a role on the namespace is enough) and
+		// their service accounts watched.
+		add("namespaces", targets, "get")
+		add("serviceaccounts", targets, "list", "watch")
+		// The events of the cluster scoped objects (e.g namespaces) are on the default namespace.
+		add("events", []string{corev1.NamespaceDefault}, "create", "patch")
+	}
+	add("secrets", targets, "get", "list", "watch", "create", "update", "delete")
+	if len(config.ConfigMapNames) > 0 {
+		add("configmaps", targets, "get", "list", "watch", "create", "update")
+	} else {
+		// The self healer watches the managed configmaps always.
+		add("configmaps", targets, "list", "watch")
+	}
+	add("serviceaccounts", targets, "get", "create", "update")
+	add("events", targets, "create", "patch")
+	add("pods", config.CanaryNamespaces, "list")
+	add("secrets", config.KubeConfigSecretNamespaces, "get")
+
+	return perms
+}
@@ -0,0 +1,340 @@
+package registry
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Result is the result of a registry credentials verification.
+type Result string
+
+const (
+	// ResultValid means the registry accepted the credentials.
+	ResultValid Result = "valid"
+	// ResultInvalid means the registry rejected the credentials.
+	ResultInvalid Result = "invalid"
+	// ResultError means the credentials could not be verified (e.g registry unreachable).
+	ResultError Result = "error"
+	// ResultSkipped means the credentials can't be verified (e.g identity tokens, anonymous registries).
+	ResultSkipped Result = "skipped"
+)
+
+// ErrInvalidCredentials is returned when the registry rejects the credentials.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// errSkipped is returned when the credentials can't be verified.
+var errSkipped = errors.New("verification skipped")
+
+// dockerHubRegistry is the registry host used for all the Docker Hub forms.
+const dockerHubRegistry = "registry-1.docker.io"
+
+// RegistryResult is the verification result of a docker config registry.
+type RegistryResult struct {
+	// Registry is the key of the docker config auths.
+	Registry string
+	Result   Result
+	Err      error
+}
+
+// Config is the verifier configuration.
+type Config struct {
+	HTTPClient *http.Client
+}
+
+func (c *Config) defaults() error {
+	if c.HTTPClient == nil {
+		c.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	return nil
+}
+
+// Verifier knows how to verify registry credentials using the Docker Registry v2 auth flow:
+// `/v2/` ping, and depending on the challenge, basic auth or bearer token exchange.
+type Verifier struct {
+	httpClient *http.Client
+}
+
+// NewVerifier returns a new Verifier.
+func NewVerifier(config Config) (*Verifier, error) {
+	err := config.defaults()
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	return &Verifier{httpClient: config.HTTPClient}, nil
+}
+
+type dockerConfig struct {
+	Auths map[string]dockerAuth `json:"auths"`
+}
+
+type dockerAuth struct {
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	Auth          string `json:"auth"`
+	IdentityToken string `json:"identitytoken"`
+}
+
+// VerifyDockerConfig verifies the credentials of each registry of a docker config JSON,
+// the results are sorted by registry.
+func (v *Verifier) VerifyDockerConfig(ctx context.Context, dockerConfigJSON []byte) ([]RegistryResult, error) {
+	cfg := dockerConfig{}
+	err := json.Unmarshal(dockerConfigJSON, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid docker config JSON: %w", err)
+	}
+
+	registries := make([]string, 0, len(cfg.Auths))
+	for r := range cfg.Auths {
+		registries = append(registries, r)
+	}
+	sort.Strings(registries)
+
+	results := make([]RegistryResult, 0, len(registries))
+	for _, r := range registries {
+		auth := cfg.Auths[r]
+		err := v.verifyAuth(ctx, r, auth)
+		results = append(results, RegistryResult{Registry: r, Result: resultFromError(err), Err: err})
+	}
+
+	return results, nil
+}
+
+func (v *Verifier) verifyAuth(ctx context.Context, registry string, auth dockerAuth) error {
+	if auth.IdentityToken != "" {
+		return fmt.Errorf("identity tokens are not supported: %w", errSkipped)
+	}
+
+	username, password := auth.Username, auth.Password
+	if auth.Auth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err != nil {
+			return fmt.Errorf("invalid auth: %s: %w", err, ErrInvalidCredentials)
+		}
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid auth format: %w", ErrInvalidCredentials)
+		}
+		username, password = parts[0], parts[1]
+	}
+
+	if username == "" && password == "" {
+		return fmt.Errorf("missing credentials: %w", ErrInvalidCredentials)
+	}
+
+	return v.VerifyCredentials(ctx, registry, username, password)
+}
+
+// VerifyCredentials verifies the credentials against the registry, the registry can be a host
+// or a URL (e.g `https://index.docker.io/v1/`). Returns ErrInvalidCredentials wrapped if the
+// registry rejects the credentials.
+func (v *Verifier) VerifyCredentials(ctx context.Context, registry, username, password string) error {
+	base := registryBaseURL(registry)
+
+	// Ping.
+	resp, err := v.get(ctx, base+"/v2/", nil)
+	if err != nil {
+		return fmt.Errorf("could not ping registry: %w", err)
+	}
+	drain(resp)
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// Registry doesn't require auth, we can't know if the credentials are valid.
+		return fmt.Errorf("registry doesn't require authentication: %w", errSkipped)
+	case http.StatusUnauthorized:
+	default:
+		return fmt.Errorf("unexpected %d ping status code", resp.StatusCode)
+	}
+
+	scheme, params := parseChallenge(resp.Header.Get("WWW-Authenticate"))
+	switch scheme {
+	case "basic":
+		return v.verifyBasic(ctx, base, username, password)
+	case "bearer":
+		return v.verifyBearer(ctx, base, params, username, password)
+	default:
+		return fmt.Errorf("unsupported %q auth challenge", scheme)
+	}
+}
+
+func (v *Verifier) verifyBasic(ctx context.Context, base, username, password string) error {
+	resp, err := v.get(ctx, base+"/v2/", func(r *http.Request) { r.SetBasicAuth(username, password) })
+	if err != nil {
+		return fmt.Errorf("could not authenticate on registry: %w", err)
+	}
+	drain(resp)
+
+	return checkAuthStatus(resp.StatusCode)
+}
+
+// verifyBearer gets a token from the challenge realm using the credentials. The realm can be
+// on another host (e.g Docker Hub uses `auth.docker.io`), but the credentials are never sent
+// in cleartext to a realm of a registry served over https.
+func (v *Verifier) verifyBearer(ctx context.Context, base string, params map[string]string, username, password string) error {
+	realm := params["realm"]
+	if realm == "" {
+		return fmt.Errorf("bearer challenge without realm")
+	}
+
+	u, err := url.Parse(realm)
+	if err != nil {
+		return fmt.Errorf("invalid %q realm: %w", realm, err)
+	}
+	switch {
+	case u.Host == "":
+		return fmt.Errorf("invalid %q realm: missing host", realm)
+	case u.Scheme == "https":
+	case u.Scheme == "http" && strings.HasPrefix(base, "http://"):
+	default:
+		return fmt.Errorf("insecure %q realm for %s registry", realm, base)
+	}
+	q := u.Query()
+	if s := params["service"]; s != "" {
+		q.Set("service", s)
+	}
+	if s := params["scope"]; s != "" {
+		q.Set("scope", s)
+	}
+	u.RawQuery = q.Encode()
+
+	resp, err := v.get(ctx, u.String(), func(r *http.Request) { r.SetBasicAuth(username, password) })
+	if err != nil {
+		return fmt.Errorf("could not get token: %w", err)
+	}
+	defer drain(resp)
+
+	err = checkAuthStatus(resp.StatusCode)
+	if err != nil {
+		return err
+	}
+
+	token := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	if err != nil {
+		return fmt.Errorf("could not decode token response: %w", err)
+	}
+	if token.Token == "" && token.AccessToken == "" {
+		return fmt.Errorf("token response without token")
+	}
+
+	return nil
+}
+
+func (v *Verifier) get(ctx context.Context, u string, mutate func(r *http.Request)) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if mutate != nil {
+		mutate(req)
+	}
+
+	return v.httpClient.Do(req)
+}
+
+func checkAuthStatus(status int) error {
+	switch {
+	case status >= 200 && status <= 299:
+		return nil
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return fmt.Errorf("registry rejected the credentials with %d status code: %w", status, ErrInvalidCredentials)
+	default:
+		return fmt.Errorf("unexpected %d auth status code", status)
+	}
+}
+
+func resultFromError(err error) Result {
+	switch {
+	case err == nil:
+		return ResultValid
+	case errors.Is(err, ErrInvalidCredentials):
+		return ResultInvalid
+	case errors.Is(err, errSkipped):
+		return ResultSkipped
+	default:
+		return ResultError
+	}
+}
+
+// registryBaseURL returns the base URL of a docker config registry key, `https` is used
+// unless the key explicitly uses `http`.
+func registryBaseURL(registry string) string {
+	r := strings.TrimSpace(registry)
+	scheme := "https"
+	if strings.HasPrefix(r, "http://") {
+		scheme = "http"
+	}
+	r = strings.TrimPrefix(r, "https://")
+	r = strings.TrimPrefix(r, "http://")
+	if i := strings.Index(r, "/"); i >= 0 {
+		r = r[:i]
+	}
+
+	switch strings.ToLower(r) {
+	case "docker.io", "index.docker.io":
+		r = dockerHubRegistry
+	}
+
+	return scheme + "://" + r
+}
+
+// parseChallenge parses a `WWW-Authenticate` header (e.g `Bearer realm="https://auth.docker.io/token",service="registry.docker.io"`).
+func parseChallenge(header string) (scheme string, params map[string]string) {
+	params = map[string]string{}
+	header = strings.TrimSpace(header)
+	parts := strings.SplitN(header, " ", 2)
+	scheme = strings.ToLower(parts[0])
+	if len(parts) < 2 {
+		return scheme, params
+	}
+
+	rest := parts[1]
+	for rest != "" {
+		rest = strings.TrimLeft(rest, " ,")
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			end := strings.Index(rest, ",")
+			if end < 0 {
+				value, rest = rest, ""
+			} else {
+				value, rest = rest[:end], rest[end:]
+			}
+		}
+		params[key] = value
+	}
+
+	return scheme, params
+}
+
+func drain(resp *http.Response) {
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
@@ -0,0 +1,201 @@
+package registry_test
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/slok/imagepull-controller-workshop/internal/registry"
+)
+
+const (
+	testUser     = "user"
+	testPassword = "password"
+)
+
+// basicRegistry returns a registry using basic auth with the test credentials.
+func basicRegistry() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if ok && user == testUser && pass == testPassword {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+}
+
+// bearerRegistry returns a registry using the bearer token flow with the test credentials,
+// the token server is on the same server, on the realm with `{host}` replaced by the server host.
+func bearerRegistry(realm string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+		realm := strings.ReplaceAll(realm, "{host}", r.Host)
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm=%q,service="test-registry",scope="registry:catalog:*"`, realm))
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("service") != "test-registry" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != testUser || pass != testPassword {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{"token": "test-token"}`))
+	})
+
+	return mux
+}
+
+func statusRegistry(status int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	})
+}
+
+func dockerConfig(registry, user, password string) []byte {
+	auth := base64.StdEncoding.EncodeToString([]byte(user + ":" + password))
+	return []byte(fmt.Sprintf(`{"auths":{%q:{"auth":%q}}}`, registry, auth))
+}
+
+func TestVerifierVerifyDockerConfig(t *testing.T) {
+	tests := map[string]struct {
+		registry    http.Handler
+		tls         bool
+		unreachable bool
+		user        string
+		password    string
+		expResult   registry.Result
+		expInvalid  bool
+		expErr      string
+	}{
+		"Valid credentials on a basic auth registry should be valid.": {
+			registry:  basicRegistry(),
+			user:      testUser,
+			password:  testPassword,
+			expResult: registry.ResultValid,
+		},
+
+		"Wrong credentials on a basic auth registry should be invalid.": {
+			registry:   basicRegistry(),
+			user:       testUser,
+			password:   "wrong",
+			expResult:  registry.ResultInvalid,
+			expInvalid: true,
+		},
+
+		"Valid credentials on a bearer token registry should be valid.": {
+			registry:  bearerRegistry("http://{host}/token"),
+			user:      testUser,
+			password:  testPassword,
+			expResult: registry.ResultValid,
+		},
+
+		"Valid credentials on an https bearer token registry should be valid.": {
+			registry:  bearerRegistry("https://{host}/token"),
+			tls:       true,
+			user:      testUser,
+			password:  testPassword,
+			expResult: registry.ResultValid,
+		},
+
+		"An https bearer token registry with an http realm should be an error.": {
+			registry:  bearerRegistry("http://{host}/token"),
+			tls:       true,
+			user:      testUser,
+			password:  testPassword,
+			expResult: registry.ResultError,
+			expErr:    "insecure",
+		},
+
+		"A bearer token registry with a realm without host should be an error.": {
+			registry:  bearerRegistry("/token"),
+			user:      testUser,
+			password:  testPassword,
+			expResult: registry.ResultError,
+			expErr:    "missing host",
+		},
+
+		"Wrong credentials on a bearer token registry should be invalid.": {
+			registry:   bearerRegistry("http://{host}/token"),
+			user:       testUser,
+			password:   "wrong",
+			expResult:  registry.ResultInvalid,
+			expInvalid: true,
+		},
+
+		"A registry without authentication should skip the verification.": {
+			registry:  statusRegistry(http.StatusOK),
+			user:      testUser,
+			password:  testPassword,
+			expResult: registry.ResultSkipped,
+		},
+
+		"A registry failing should be an error.": {
+			registry:  statusRegistry(http.StatusServiceUnavailable),
+			user:      testUser,
+			password:  testPassword,
+			expResult: registry.ResultError,
+		},
+
+		"An unreachable registry should be an error.": {
+			registry:    basicRegistry(),
+			unreachable: true,
+			user:        testUser,
+			password:    testPassword,
+			expResult:   registry.ResultError,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			srv := httptest.NewUnstartedServer(test.registry)
+			if test.tls {
+				srv.StartTLS()
+			} else {
+				srv.Start()
+			}
+			defer srv.Close()
+			if test.unreachable {
+				srv.Close()
+			}
+
+			v, err := registry.NewVerifier(registry.Config{HTTPClient: srv.Client()})
+			require.NoError(err)
+
+			results, err := v.VerifyDockerConfig(context.TODO(), dockerConfig(srv.URL, test.user, test.password))
+			require.NoError(err)
+			require.Len(results, 1)
+
+			assert.Equal(srv.URL, results[0].Registry)
+			assert.Equal(test.expResult, results[0].Result)
+			assert.Equal(test.expInvalid, errors.Is(results[0].Err, registry.ErrInvalidCredentials))
+			if test.expErr != "" {
+				assert.Contains(results[0].Err.Error(), test.expErr)
+			}
+		})
+	}
+}
+
+func TestVerifierVerifyDockerConfigInvalidJSON(t *testing.T) {
+	v, err := registry.NewVerifier(registry.Config{})
+	require.NoError(t, err)
+
+	_, err = v.VerifyDockerConfig(context.TODO(), []byte("{"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,408 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spotahome/kooper/v2/controller"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/slok/imagepull-controller-workshop/internal/log"
+)
+
+// AuthMethod is the method used to authenticate against Vault.
+type AuthMethod string
+
+const (
+	// AuthMethodToken uses a static Vault token.
+	AuthMethodToken AuthMethod = "token"
+	// AuthMethodKubernetes logs in with the pod service account token using the Vault
+	// Kubernetes auth method.
+	AuthMethodKubernetes AuthMethod = "kubernetes"
+)
+
+// AuthMethods are the supported Vault auth methods.
+var AuthMethods = []AuthMethod{AuthMethodToken, AuthMethodKubernetes}
+
+// Vault KV data keys used to build the docker config.
+const (
+	// keyDockerConfigJSON has a complete docker config JSON, if present the other keys are ignored.
+	keyDockerConfigJSON = ".dockerconfigjson"
+	keyRegistry         = "registry"
+	keyUsername         = "username"
+	keyPassword         = "password"
+	keyEmail            = "email"
+)
+
+const (
+	// AnnotationVaultPath is the Vault KV path used as the source of the secret.
+	AnnotationVaultPath = "imagepull-controller-workshop.slok.dev/vault-path"
+	// AnnotationVaultVersion is the Vault KV version used as the source of the secret.
+	AnnotationVaultVersion = "imagepull-controller-workshop.slok.dev/vault-version"
+)
+
+// Config is the Vault source configuration.
+type Config struct {
+	// Address is the Vault server address (e.g `https://vault:8200`).
+	Address string
+	// KVMount is the mount path of the KV v2 secrets engine.
+	KVMount string
+	// Path is the path of the credentials on the KV secrets engine.
+	Path string
+	// AuthMethod is the method used to authenticate.
+	AuthMethod AuthMethod
+	// Token is the token used with the token auth method.
+	Token string
+	// KubernetesRole is the Vault role used with the Kubernetes auth method.
+	KubernetesRole string
+	// KubernetesAuthMount is the mount path of the Kubernetes auth method.
+	KubernetesAuthMount string
+	// KubernetesTokenPath is the path of the service account token used with the Kubernetes auth method.
+	KubernetesTokenPath string
+	// PollInterval is the interval to check for new versions of the credentials.
+	PollInterval time.Duration
+	// SecretNamespace and SecretName are the identity of the Kubernetes secret the
+	// credentials will be converted to.
+	SecretNamespace string
+	SecretName      string
+	// Handler is the handler that will receive the converted secrets (e.g the secret cache handler).
+	Handler    controller.Handler
+	HTTPClient *http.Client
+	Logger     log.Logger
+}
+
+func (c *Config) defaults() error {
+	if c.Address == "" {
+		return fmt.Errorf("address is required")
+	}
+	c.Address = strings.TrimSuffix(c.Address, "/")
+
+	if c.KVMount == "" {
+		c.KVMount = "secret"
+	}
+	c.KVMount = strings.Trim(c.KVMount, "/")
+
+	if c.Path == "" {
+		return fmt.Errorf("path is required")
+	}
+	c.Path = strings.Trim(c.Path, "/")
+
+	switch c.AuthMethod {
+	case "", AuthMethodToken:
+		c.AuthMethod = AuthMethodToken
+		if c.Token == "" {
+			return fmt.Errorf("token is required with %q auth method", c.AuthMethod)
+		}
+	case AuthMethodKubernetes:
+		if c.KubernetesRole == "" {
+			return fmt.Errorf("kubernetes role is required with %q auth method", c.AuthMethod)
+		}
+	default:
+		return fmt.Errorf("unknown %q auth method", c.AuthMethod)
+	}
+
+	if c.KubernetesAuthMount == "" {
+		c.KubernetesAuthMount = "kubernetes"
+	}
+	c.KubernetesAuthMount = strings.Trim(c.KubernetesAuthMount, "/")
+
+	if c.KubernetesTokenPath == "" {
+		c.KubernetesTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	}
+
+	if c.PollInterval <= 0 {
+		c.PollInterval = time.Minute
+	}
+
+	if c.SecretNamespace == "" || c.SecretName == "" {
+		return fmt.Errorf("secret namespace and name are required")
+	}
+
+	if c.Handler == nil {
+		return fmt.Errorf("handler is required")
+	}
+
+	if c.HTTPClient == nil {
+		c.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	if c.Logger == nil {
+		c.Logger = log.Noop
+	}
+	c.Logger = c.Logger.WithValues(log.Kv{"svc": "source.vault.Source", "vault-path": c.KVMount + "/" + c.Path})
+
+	return nil
+}
+
+// Source is a registry credentials source that reads the credentials from a Vault KV v2
+// path, converts them into a dockerconfigjson secret and sends them to the handler every
+// time a new version is found.
+type Source struct {
+	cfg    Config
+	logger log.Logger
+
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+	version     int
+}
+
+// NewSource returns a new Vault source.
+func NewSource(config Config) (*Source, error) {
+	err := config.defaults()
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	return &Source{
+		cfg:    config,
+		logger: config.Logger,
+		token:  config.Token,
+	}, nil
+}
+
+// Run polls Vault for new versions of the credentials until the context is done.
+func (s *Source) Run(ctx context.Context) error {
+	s.logger.Infof("Polling Vault credentials every %s", s.cfg.PollInterval)
+
+	t := time.NewTicker(s.cfg.PollInterval)
+	defer t.Stop()
+	for {
+		err := s.Sync(ctx)
+		if err != nil {
+			s.logger.Errorf("could not sync Vault credentials: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+// Sync reads the credentials from Vault and sends them to the handler if the version
+// changed since the last sync.
+func (s *Source) Sync(ctx context.Context) error {
+	data, version, err := s.readKV(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	current := s.version
+	s.mu.Unlock()
+	if version == current {
+		s.logger.Debugf("Vault credentials version %d already synced", version)
+		return nil
+	}
+
+	dockerConfig, err := dockerConfigJSON(data)
+	if err != nil {
+		return fmt.Errorf("invalid credentials on version %d: %w", version, err)
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       s.cfg.SecretNamespace,
+			Name:            s.cfg.SecretName,
+			ResourceVersion: "vault-" + strconv.Itoa(version),
+			Annotations: map[string]string{
+				AnnotationVaultPath:    s.cfg.KVMount + "/" + s.cfg.Path,
+				AnnotationVaultVersion: strconv.Itoa(version),
+			},
+		},
+		Type: corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{
+			corev1.DockerConfigJsonKey: dockerConfig,
+		},
+	}
+
+	err = s.cfg.Handler.Handle(ctx, secret)
+	if err != nil {
+		return fmt.Errorf("could not handle credentials version %d: %w", version, err)
+	}
+
+	s.mu.Lock()
+	s.version = version
+	s.mu.Unlock()
+	s.logger.Infof("Vault credentials version %d synced", version)
+
+	return nil
+}
+
+type kvResponse struct {
+	Data struct {
+		Data     map[string]interface{} `json:"data"`
+		Metadata struct {
+			Version int `json:"version"`
+		} `json:"metadata"`
+	} `json:"data"`
+}
+
+// readKV reads the latest version of the KV v2 path.
+func (s *Source) readKV(ctx context.Context) (map[string]string, int, error) {
+	token, err := s.authToken(ctx)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not authenticate: %w", err)
+	}
+
+	url := fmt.Sprintf("%s/v1/%s/data/%s", s.cfg.Address, s.cfg.KVMount, s.cfg.Path)
+	kv := kvResponse{}
+	status, err := s.do(ctx, http.MethodGet, url, token, nil, &kv)
+	if err != nil {
+		// Expired or revoked token, force a new login on the next sync.
+		if status == http.StatusForbidden && s.cfg.AuthMethod == AuthMethodKubernetes {
+			s.mu.Lock()
+			s.token = ""
+			s.mu.Unlock()
+		}
+		return nil, 0, fmt.Errorf("could not read KV: %w", err)
+	}
+
+	data := map[string]string{}
+	for k, v := range kv.Data.Data {
+		sv, ok := v.(string)
+		if !ok {
+			return nil, 0, fmt.Errorf("%q key is not a string", k)
+		}
+		data[k] = sv
+	}
+
+	return data, kv.Data.Metadata.Version, nil
+}
+
+type loginResponse struct {
+	Auth struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+	} `json:"auth"`
+}
+
+// authToken returns the token used on the requests, with the Kubernetes auth method it will
+// login again when the token is missing or about to expire.
+func (s *Source) authToken(ctx context.Context) (string, error) {
+	if s.cfg.AuthMethod == AuthMethodToken {
+		return s.cfg.Token, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && time.Now().Add(s.cfg.PollInterval).Before(s.tokenExpiry) {
+		return s.token, nil
+	}
+
+	jwt, err := os.ReadFile(s.cfg.KubernetesTokenPath)
+	if err != nil {
+		return "", fmt.Errorf("could not read service account token: %w", err)
+	}
+
+	url := fmt.Sprintf("%s/v1/auth/%s/login", s.cfg.Address, s.cfg.KubernetesAuthMount)
+	body := map[string]string{
+		"role": s.cfg.KubernetesRole,
+		"jwt":  strings.TrimSpace(string(jwt)),
+	}
+	login := loginResponse{}
+	_, err = s.do(ctx, http.MethodPost, url, "", body, &login)
+	if err != nil {
+		return "", fmt.Errorf("could not login: %w", err)
+	}
+	if login.Auth.ClientToken == "" {
+		return "", fmt.Errorf("login response without token")
+	}
+
+	s.token = login.Auth.ClientToken
+	s.tokenExpiry = time.Now().Add(time.Duration(login.Auth.LeaseDuration) * time.Second)
+	s.logger.Debugf("Logged in on Vault with %q role", s.cfg.KubernetesRole)
+
+	return s.token, nil
+}
+
+// do makes a Vault API request and decodes the JSON response, it returns the response status code.
+func (s *Source) do(ctx context.Context, method, url, token string, reqBody, respBody interface{}) (int, error) {
+	var body *bytes.Reader
+	if reqBody != nil {
+		b, err := json.Marshal(reqBody)
+		if err != nil {
+			return 0, fmt.Errorf("could not marshal request: %w", err)
+		}
+		body = bytes.NewReader(b)
+	} else {
+		body = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return 0, fmt.Errorf("could not create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+
+	resp, err := s.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("could not make request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected %d status code", resp.StatusCode)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(respBody)
+	if err != nil {
+		return resp.StatusCode, fmt.Errorf("could not decode response: %w", err)
+	}
+
+	return resp.StatusCode, nil
+}
+
+type dockerConfig struct {
+	Auths map[string]dockerAuth `json:"auths"`
+}
+
+type dockerAuth struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Email    string `json:"email,omitempty"`
+	Auth     string `json:"auth"`
+}
+
+// dockerConfigJSON converts the Vault KV data into a docker config JSON, the data can have
+// the docker config JSON already or the registry, username and password keys.
+func dockerConfigJSON(data map[string]string) ([]byte, error) {
+	if dc, ok := data[keyDockerConfigJSON]; ok {
+		if !json.Valid([]byte(dc)) {
+			return nil, fmt.Errorf("%q key is not valid JSON", keyDockerConfigJSON)
+		}
+		return []byte(dc), nil
+	}
+
+	for _, k := range []string{keyRegistry, keyUsername, keyPassword} {
+		if data[k] == "" {
+			return nil, fmt.Errorf("%q or %q key is required", keyDockerConfigJSON, k)
+		}
+	}
+
+	dc := dockerConfig{Auths: map[string]dockerAuth{
+		data[keyRegistry]: {
+			Username: data[keyUsername],
+			Password: data[keyPassword],
+			Email:    data[keyEmail],
+			Auth:     base64.StdEncoding.EncodeToString([]byte(data[keyUsername] + ":" + data[keyPassword])),
+		},
+	}}
+
+	return json.Marshal(dc)
+}
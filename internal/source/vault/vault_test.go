@@ -0,0 +1,251 @@
+package vault_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/spotahome/kooper/v2/controller"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/slok/imagepull-controller-workshop/internal/source/vault"
+)
+
+const (
+	testToken     = "test-token"
+	testLoginRole = "test-role"
+	testLoginJWT  = "test-jwt"
+)
+
+// fakeVault is a Vault HTTP API stand-in with a KV v2 secret on `secret/creds`, token
+// and kubernetes auth methods.
+type fakeVault struct {
+	mu      sync.Mutex
+	data    map[string]interface{}
+	version int
+}
+
+func (f *fakeVault) set(version int, data map[string]interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.version, f.data = version, data
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/v1/auth/kubernetes/login":
+		body := map[string]string{}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		if r.Method != http.MethodPost || body["role"] != testLoginRole || body["jwt"] != testLoginJWT {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte(`{"auth": {"client_token": "` + testToken + `", "lease_duration": 3600}}`))
+
+	case "/v1/secret/data/creds":
+		if r.Header.Get("X-Vault-Token") != testToken {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		f.mu.Lock()
+		resp := map[string]interface{}{"data": map[string]interface{}{
+			"data":     f.data,
+			"metadata": map[string]interface{}{"version": f.version},
+		}}
+		f.mu.Unlock()
+		_ = json.NewEncoder(w).Encode(resp)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// recordHandler records the handled secrets.
+type recordHandler struct {
+	mu      sync.Mutex
+	secrets []*corev1.Secret
+}
+
+func (r *recordHandler) Handle(_ context.Context, obj runtime.Object) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.secrets = append(r.secrets, obj.(*corev1.Secret))
+	return nil
+}
+
+var _ controller.Handler = &recordHandler{}
+
+func writeJWT(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "token")
+	err := os.WriteFile(path, []byte(testLoginJWT+"\n"), 0600)
+	require.NoError(t, err)
+	return path
+}
+
+func TestSourceSync(t *testing.T) {
+	tests := map[string]struct {
+		config          func(t *testing.T, cfg vault.Config) vault.Config
+		data            map[string]interface{}
+		expErr          bool
+		expDockerConfig string
+	}{
+		"Username and password credentials with token auth should be converted to a docker config JSON.": {
+			config: func(t *testing.T, cfg vault.Config) vault.Config {
+				cfg.Token = testToken
+				return cfg
+			},
+			data: map[string]interface{}{
+				"registry": "registry.example.com",
+				"username": "user",
+				"password": "pass",
+			},
+			expDockerConfig: `{"auths":{"registry.example.com":{"username":"user","password":"pass","auth":"dXNlcjpwYXNz"}}}`,
+		},
+
+		"Docker config JSON credentials should be used as they are.": {
+			config: func(t *testing.T, cfg vault.Config) vault.Config {
+				cfg.Token = testToken
+				return cfg
+			},
+			data: map[string]interface{}{
+				".dockerconfigjson": `{"auths":{"registry.example.com":{"auth":"dXNlcjpwYXNz"}}}`,
+			},
+			expDockerConfig: `{"auths":{"registry.example.com":{"auth":"dXNlcjpwYXNz"}}}`,
+		},
+
+		"Kubernetes auth should login with the service account token.": {
+			config: func(t *testing.T, cfg vault.Config) vault.Config {
+				cfg.AuthMethod = vault.AuthMethodKubernetes
+				cfg.KubernetesRole = testLoginRole
+				cfg.KubernetesTokenPath = writeJWT(t)
+				return cfg
+			},
+			data: map[string]interface{}{
+				"registry": "registry.example.com",
+				"username": "user",
+				"password": "pass",
+			},
+			expDockerConfig: `{"auths":{"registry.example.com":{"username":"user","password":"pass","auth":"dXNlcjpwYXNz"}}}`,
+		},
+
+		"Kubernetes auth with a wrong role should fail.": {
+			config: func(t *testing.T, cfg vault.Config) vault.Config {
+				cfg.AuthMethod = vault.AuthMethodKubernetes
+				cfg.KubernetesRole = "wrong"
+				cfg.KubernetesTokenPath = writeJWT(t)
+				return cfg
+			},
+			data:   map[string]interface{}{".dockerconfigjson": `{"auths":{}}`},
+			expErr: true,
+		},
+
+		"A wrong token should fail.": {
+			config: func(t *testing.T, cfg vault.Config) vault.Config {
+				cfg.Token = "wrong"
+				return cfg
+			},
+			data:   map[string]interface{}{".dockerconfigjson": `{"auths":{}}`},
+			expErr: true,
+		},
+
+		"Credentials without the required keys should fail.": {
+			config: func(t *testing.T, cfg vault.Config) vault.Config {
+				cfg.Token = testToken
+				return cfg
+			},
+			data:   map[string]interface{}{"username": "user"},
+			expErr: true,
+		},
+
+		"Invalid docker config JSON credentials should fail.": {
+			config: func(t *testing.T, cfg vault.Config) vault.Config {
+				cfg.Token = testToken
+				return cfg
+			},
+			data:   map[string]interface{}{".dockerconfigjson": `{`},
+			expErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			fv := &fakeVault{}
+			fv.set(3, test.data)
+			srv := httptest.NewServer(fv)
+			defer srv.Close()
+
+			handler := &recordHandler{}
+			source, err := vault.NewSource(test.config(t, vault.Config{
+				Address:         srv.URL,
+				Path:            "creds",
+				SecretNamespace: "test-ns",
+				SecretName:      "test-secret",
+				Handler:         handler,
+			}))
+			require.NoError(err)
+
+			err = source.Sync(context.TODO())
+			if test.expErr {
+				assert.Error(err)
+				assert.Empty(handler.secrets)
+				return
+			}
+			require.NoError(err)
+			require.Len(handler.secrets, 1)
+
+			secret := handler.secrets[0]
+			assert.Equal("test-ns", secret.Namespace)
+			assert.Equal("test-secret", secret.Name)
+			assert.Equal(corev1.SecretTypeDockerConfigJson, secret.Type)
+			assert.Equal("secret/creds", secret.Annotations[vault.AnnotationVaultPath])
+			assert.Equal("3", secret.Annotations[vault.AnnotationVaultVersion])
+			assert.JSONEq(test.expDockerConfig, string(secret.Data[corev1.DockerConfigJsonKey]))
+		})
+	}
+}
+
+func TestSourceSyncVersionChange(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	fv := &fakeVault{}
+	fv.set(1, map[string]interface{}{"registry": "registry.example.com", "username": "user", "password": "pass1"})
+	srv := httptest.NewServer(fv)
+	defer srv.Close()
+
+	handler := &recordHandler{}
+	source, err := vault.NewSource(vault.Config{
+		Address:         srv.URL,
+		Path:            "creds",
+		Token:           testToken,
+		SecretNamespace: "test-ns",
+		SecretName:      "test-secret",
+		Handler:         handler,
+	})
+	require.NoError(err)
+
+	// First sync and the same version again, only handled once.
+	require.NoError(source.Sync(context.TODO()))
+	require.NoError(source.Sync(context.TODO()))
+	require.Len(handler.secrets, 1)
+	assert.Equal("1", handler.secrets[0].Annotations[vault.AnnotationVaultVersion])
+
+	// New version should be handled.
+	fv.set(2, map[string]interface{}{"registry": "registry.example.com", "username": "user", "password": "pass2"})
+	require.NoError(source.Sync(context.TODO()))
+	require.Len(handler.secrets, 2)
+	assert.Equal("2", handler.secrets[1].Annotations[vault.AnnotationVaultVersion])
+	assert.NotEqual(handler.secrets[0].Data, handler.secrets[1].Data)
+}
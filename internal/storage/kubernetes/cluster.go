@@ -0,0 +1,51 @@
+package kubernetes
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// SourceRepository is the repository of the cluster where the replicated resources come from.
+type SourceRepository interface {
+	GetSecret(ctx context.Context, ns string, name string) (*corev1.Secret, error)
+	GetConfigMap(ctx context.Context, ns string, name string) (*corev1.ConfigMap, error)
+}
+
+// ClusterRepository is a Kubernetes repository like `Repository` for a target cluster, but
+// getting the secrets and configmaps of the source namespace is done from the source
+// cluster repository (e.g the secret cache of the cluster the controller runs on).
+type ClusterRepository struct {
+	Repository
+	source          SourceRepository
+	sourceNamespace string
+}
+
+// NewClusterRepository returns a new ClusterRepository.
+func NewClusterRepository(repo Repository, source SourceRepository, sourceNamespace string) *ClusterRepository {
+	return &ClusterRepository{
+		Repository:      repo,
+		source:          source,
+		sourceNamespace: sourceNamespace,
+	}
+}
+
+// GetSecret returns the secret from the source cluster if it's on the source namespace,
+// otherwise from the target cluster.
+func (c *ClusterRepository) GetSecret(ctx context.Context, ns string, name string) (*corev1.Secret, error) {
+	if ns == c.sourceNamespace {
+		return c.source.GetSecret(ctx, ns, name)
+	}
+
+	return c.Repository.GetSecret(ctx, ns, name)
+}
+
+// GetConfigMap returns the configmap from the source cluster if it's on the source namespace,
+// otherwise from the target cluster.
+func (c *ClusterRepository) GetConfigMap(ctx context.Context, ns string, name string) (*corev1.ConfigMap, error) {
+	if ns == c.sourceNamespace {
+		return c.source.GetConfigMap(ctx, ns, name)
+	}
+
+	return c.Repository.GetConfigMap(ctx, ns, name)
+}
@@ -0,0 +1,32 @@
+package kubernetes
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// EventRecorder knows how to record Kubernetes events on the Kubernetes API server.
+type EventRecorder struct {
+	record.EventRecorder
+	broadcaster record.EventBroadcaster
+}
+
+// NewEventRecorder returns a new EventRecorder that will record the events as the
+// received component.
+func NewEventRecorder(kcli *kubernetes.Clientset, component string) EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kcli.CoreV1().Events("")})
+
+	return EventRecorder{
+		EventRecorder: broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: component}),
+		broadcaster:   broadcaster,
+	}
+}
+
+// Stop stops sending the events to the Kubernetes API server.
+func (e EventRecorder) Stop() {
+	e.broadcaster.Shutdown()
+}
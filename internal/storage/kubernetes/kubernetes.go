@@ -2,13 +2,19 @@ package kubernetes
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 
+	"go.opentelemetry.io/otel/attribute"
+	authorizationv1 "k8s.io/api/authorization/v1"
 	corev1 "k8s.io/api/core/v1"
 	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
+
+	"github.com/slok/imagepull-controller-workshop/internal/tracing"
 )
 
 // Repository represents a Kubernetes repository that knows how to speak with the
@@ -24,21 +30,47 @@ func NewRepository(kcli *kubernetes.Clientset) Repository {
 }
 
 // ListNamespaces will list Kubernetes namespaces from the API server.
-func (r Repository) ListNamespaces(ctx context.Context, labelSelector map[string]string) (*corev1.NamespaceList, error) {
-	return r.kcli.CoreV1().Namespaces().List(ctx, metav1.ListOptions{
-		LabelSelector: labels.Set(labelSelector).String(),
-	})
+func (r Repository) ListNamespaces(ctx context.Context, options metav1.ListOptions) (*corev1.NamespaceList, error) {
+	return r.kcli.CoreV1().Namespaces().List(ctx, options)
 }
 
 // WatchNamespaces will return a Kubernetes watcher to subscribe to namespaces changes.
-func (r Repository) WatchNamespaces(ctx context.Context, labelSelector map[string]string) (watch.Interface, error) {
-	return r.kcli.CoreV1().Namespaces().Watch(ctx, metav1.ListOptions{
-		LabelSelector: labels.Set(labelSelector).String(),
+func (r Repository) WatchNamespaces(ctx context.Context, options metav1.ListOptions) (watch.Interface, error) {
+	return r.kcli.CoreV1().Namespaces().Watch(ctx, options)
+}
+
+// GetNamespace will return a namespace from Kubernetes API server.
+func (r Repository) GetNamespace(ctx context.Context, name string) (_ *corev1.Namespace, err error) {
+	ctx, span := tracing.Start(ctx, "storage.kubernetes.Repository.GetNamespace", attribute.String("k8s.name", name))
+	defer func() { tracing.End(span, err) }()
+
+	return r.kcli.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+}
+
+// PatchNamespaceAnnotations will patch the annotations of a namespace, the annotations with
+// nil value will be removed.
+func (r Repository) PatchNamespaceAnnotations(ctx context.Context, name string, annotations map[string]*string) (err error) {
+	ctx, span := tracing.Start(ctx, "storage.kubernetes.Repository.PatchNamespaceAnnotations", attribute.String("k8s.name", name))
+	defer func() { tracing.End(span, err) }()
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
 	})
+	if err != nil {
+		return fmt.Errorf("could not marshal patch: %w", err)
+	}
+
+	_, err = r.kcli.CoreV1().Namespaces().Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
 }
 
 // GetSecret will return a secret from Kubernets API server.
-func (r Repository) GetSecret(ctx context.Context, ns string, name string) (*corev1.Secret, error) {
+func (r Repository) GetSecret(ctx context.Context, ns string, name string) (_ *corev1.Secret, err error) {
+	ctx, span := tracing.Start(ctx, "storage.kubernetes.Repository.GetSecret", attribute.String("k8s.namespace", ns), attribute.String("k8s.name", name))
+	defer func() { tracing.End(span, err) }()
+
 	return r.kcli.CoreV1().Secrets(ns).Get(ctx, name, metav1.GetOptions{})
 }
 
@@ -53,7 +85,10 @@ func (r Repository) WatchSecrets(ctx context.Context, ns string, options metav1.
 }
 
 // EnsureSecret will create the secret if is missing and overwrite if already exists.
-func (r Repository) EnsureSecret(ctx context.Context, secret *corev1.Secret) error {
+func (r Repository) EnsureSecret(ctx context.Context, secret *corev1.Secret) (err error) {
+	ctx, span := tracing.Start(ctx, "storage.kubernetes.Repository.EnsureSecret", attribute.String("k8s.namespace", secret.Namespace), attribute.String("k8s.name", secret.Name))
+	defer func() { tracing.End(span, err) }()
+
 	storedSecret, err := r.kcli.CoreV1().Secrets(secret.Namespace).Get(ctx, secret.Name, metav1.GetOptions{})
 	if err != nil {
 		if !kubeerrors.IsNotFound(err) {
@@ -69,6 +104,22 @@ func (r Repository) EnsureSecret(ctx context.Context, secret *corev1.Secret) err
 		return nil
 	}
 
+	// The secret type is immutable, recreate the secret.
+	if storedSecret.Type != secret.Type {
+		uid := storedSecret.UID
+		err = r.kcli.CoreV1().Secrets(secret.Namespace).Delete(ctx, secret.Name, metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &uid}})
+		if err != nil && !kubeerrors.IsNotFound(err) {
+			return err
+		}
+
+		_, err = r.kcli.CoreV1().Secrets(secret.Namespace).Create(ctx, secret, metav1.CreateOptions{})
+		if err != nil {
+			return err
+		}
+
+		return nil
+	}
+
 	// Force overwrite.
 	secret.ObjectMeta.ResourceVersion = storedSecret.ResourceVersion
 	_, err = r.kcli.CoreV1().Secrets(secret.Namespace).Update(ctx, secret, metav1.UpdateOptions{})
@@ -79,13 +130,102 @@ func (r Repository) EnsureSecret(ctx context.Context, secret *corev1.Secret) err
 	return nil
 }
 
+// DeleteSecret will delete a secret from Kubernetes API server.
+func (r Repository) DeleteSecret(ctx context.Context, ns string, name string) (err error) {
+	ctx, span := tracing.Start(ctx, "storage.kubernetes.Repository.DeleteSecret", attribute.String("k8s.namespace", ns), attribute.String("k8s.name", name))
+	defer func() { tracing.End(span, err) }()
+
+	return r.kcli.CoreV1().Secrets(ns).Delete(ctx, name, metav1.DeleteOptions{})
+}
+
+// CheckSelfAccess returns if the controller is allowed to perform the action on the resource,
+// and the reason, using a self subject access review on the Kubernetes API server.
+func (r Repository) CheckSelfAccess(ctx context.Context, attrs authorizationv1.ResourceAttributes) (allowed bool, reason string, err error) {
+	review, err := r.kcli.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, &authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{ResourceAttributes: &attrs},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return false, "", err
+	}
+
+	return review.Status.Allowed, review.Status.Reason, nil
+}
+
+// ListPods lists Kubernetes pods from Kubernetes API server.
+func (r Repository) ListPods(ctx context.Context, ns string, options metav1.ListOptions) (*corev1.PodList, error) {
+	return r.kcli.CoreV1().Pods(ns).List(ctx, options)
+}
+
+// GetConfigMap will return a configmap from Kubernets API server.
+func (r Repository) GetConfigMap(ctx context.Context, ns string, name string) (_ *corev1.ConfigMap, err error) {
+	ctx, span := tracing.Start(ctx, "storage.kubernetes.Repository.GetConfigMap", attribute.String("k8s.namespace", ns), attribute.String("k8s.name", name))
+	defer func() { tracing.End(span, err) }()
+
+	return r.kcli.CoreV1().ConfigMaps(ns).Get(ctx, name, metav1.GetOptions{})
+}
+
+// ListConfigMaps lists Kubernetes configmaps from Kubernetes API server.
+func (r Repository) ListConfigMaps(ctx context.Context, ns string, options metav1.ListOptions) (*corev1.ConfigMapList, error) {
+	return r.kcli.CoreV1().ConfigMaps(ns).List(ctx, options)
+}
+
+// WatchConfigMaps watchs Kubernetes configmaps from Kubernetes API server.
+func (r Repository) WatchConfigMaps(ctx context.Context, ns string, options metav1.ListOptions) (watch.Interface, error) {
+	return r.kcli.CoreV1().ConfigMaps(ns).Watch(ctx, options)
+}
+
+// EnsureConfigMap will create the configmap if is missing and overwrite if already exists.
+func (r Repository) EnsureConfigMap(ctx context.Context, cm *corev1.ConfigMap) (err error) {
+	ctx, span := tracing.Start(ctx, "storage.kubernetes.Repository.EnsureConfigMap", attribute.String("k8s.namespace", cm.Namespace), attribute.String("k8s.name", cm.Name))
+	defer func() { tracing.End(span, err) }()
+
+	storedCM, err := r.kcli.CoreV1().ConfigMaps(cm.Namespace).Get(ctx, cm.Name, metav1.GetOptions{})
+	if err != nil {
+		if !kubeerrors.IsNotFound(err) {
+			return err
+		}
+
+		_, err = r.kcli.CoreV1().ConfigMaps(cm.Namespace).Create(ctx, cm, metav1.CreateOptions{})
+		if err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	// Force overwrite.
+	cm.ObjectMeta.ResourceVersion = storedCM.ResourceVersion
+	_, err = r.kcli.CoreV1().ConfigMaps(cm.Namespace).Update(ctx, cm, metav1.UpdateOptions{})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ListServiceAccounts lists Kubernetes service accounts from Kubernetes API server.
+func (r Repository) ListServiceAccounts(ctx context.Context, ns string, options metav1.ListOptions) (*corev1.ServiceAccountList, error) {
+	return r.kcli.CoreV1().ServiceAccounts(ns).List(ctx, options)
+}
+
+// WatchServiceAccounts watchs Kubernetes service accounts from Kubernetes API server.
+func (r Repository) WatchServiceAccounts(ctx context.Context, ns string, options metav1.ListOptions) (watch.Interface, error) {
+	return r.kcli.CoreV1().ServiceAccounts(ns).Watch(ctx, options)
+}
+
 // GetServiceAccount  will return a service account from Kubernets API server.
-func (r Repository) GetServiceAccount(ctx context.Context, ns string, name string) (*corev1.ServiceAccount, error) {
+func (r Repository) GetServiceAccount(ctx context.Context, ns string, name string) (_ *corev1.ServiceAccount, err error) {
+	ctx, span := tracing.Start(ctx, "storage.kubernetes.Repository.GetServiceAccount", attribute.String("k8s.namespace", ns), attribute.String("k8s.name", name))
+	defer func() { tracing.End(span, err) }()
+
 	return r.kcli.CoreV1().ServiceAccounts(ns).Get(ctx, name, metav1.GetOptions{})
 }
 
 // EnsureServiceAccount will create the service account if is missing and overwrite if already exists.
-func (r Repository) EnsureServiceAccount(ctx context.Context, sa *corev1.ServiceAccount) error {
+func (r Repository) EnsureServiceAccount(ctx context.Context, sa *corev1.ServiceAccount) (err error) {
+	ctx, span := tracing.Start(ctx, "storage.kubernetes.Repository.EnsureServiceAccount", attribute.String("k8s.namespace", sa.Namespace), attribute.String("k8s.name", sa.Name))
+	defer func() { tracing.End(span, err) }()
+
 	storedSA, err := r.kcli.CoreV1().ServiceAccounts(sa.Namespace).Get(ctx, sa.Name, metav1.GetOptions{})
 	if err != nil {
 		if !kubeerrors.IsNotFound(err) {
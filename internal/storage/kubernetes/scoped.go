@@ -0,0 +1,214 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// NamespaceScopedRepositoryConfig is the namespace scoped repository configuration.
+type NamespaceScopedRepositoryConfig struct {
+	// Namespaces are the scoped namespaces.
+	Namespaces []string
+	// PollInterval is the interval the scoped namespaces are polled for changes.
+	PollInterval time.Duration
+}
+
+func (c *NamespaceScopedRepositoryConfig) defaults() error {
+	if len(c.Namespaces) == 0 {
+		return fmt.Errorf("at least one namespace is required")
+	}
+
+	if c.PollInterval <= 0 {
+		c.PollInterval = 30 * time.Second
+	}
+
+	return nil
+}
+
+// NamespaceScopedRepository is a Kubernetes repository like `Repository` that only knows
+// about a fixed list of namespaces. The namespaces are get one by one from the API server,
+// so it doesn't need cluster wide permissions: on each scoped namespace a role allowing
+// to get the namespace and list/watch the service accounts is enough, plus creating the
+// events on the `default` namespace (where the events of the namespaces are).
+//
+// The namespaces can't be watched without cluster wide permissions, so they are polled.
+// The list options label and field selectors are applied on the polled namespaces.
+type NamespaceScopedRepository struct {
+	Repository
+	namespaces   []string
+	pollInterval time.Duration
+
+	mu sync.Mutex
+	// seen has the resource versions of the scoped namespaces already notified.
+	seen map[string]string
+}
+
+// NewNamespaceScopedRepository returns a new NamespaceScopedRepository.
+func NewNamespaceScopedRepository(repo Repository, config NamespaceScopedRepositoryConfig) (*NamespaceScopedRepository, error) {
+	err := config.defaults()
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	return &NamespaceScopedRepository{
+		Repository:   repo,
+		namespaces:   config.Namespaces,
+		pollInterval: config.PollInterval,
+		seen:         map[string]string{},
+	}, nil
+}
+
+// namespaceSelector selects the namespaces matching the list options selectors.
+type namespaceSelector struct {
+	labels labels.Selector
+	fields fields.Selector
+}
+
+func newNamespaceSelector(options metav1.ListOptions) (namespaceSelector, error) {
+	ls, err := labels.Parse(options.LabelSelector)
+	if err != nil {
+		return namespaceSelector{}, fmt.Errorf("invalid label selector: %w", err)
+	}
+
+	fs, err := fields.ParseSelector(options.FieldSelector)
+	if err != nil {
+		return namespaceSelector{}, fmt.Errorf("invalid field selector: %w", err)
+	}
+
+	return namespaceSelector{labels: ls, fields: fs}, nil
+}
+
+func (s namespaceSelector) matches(ns *corev1.Namespace) bool {
+	return s.labels.Matches(labels.Set(ns.Labels)) && s.fields.Matches(fields.Set{"metadata.name": ns.Name})
+}
+
+// ListNamespaces returns the scoped namespaces matching the selectors, the missing ones are
+// ignored.
+func (n *NamespaceScopedRepository) ListNamespaces(ctx context.Context, options metav1.ListOptions) (*corev1.NamespaceList, error) {
+	selector, err := newNamespaceSelector(options)
+	if err != nil {
+		return nil, err
+	}
+
+	nsl := &corev1.NamespaceList{}
+	for _, name := range n.namespaces {
+		ns, err := n.Repository.GetNamespace(ctx, name)
+		if err != nil {
+			if kubeerrors.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		if !selector.matches(ns) {
+			continue
+		}
+		nsl.Items = append(nsl.Items, *ns)
+	}
+
+	n.mu.Lock()
+	n.seen = map[string]string{}
+	for _, ns := range nsl.Items {
+		n.seen[ns.Name] = ns.ResourceVersion
+	}
+	n.mu.Unlock()
+
+	return nsl, nil
+}
+
+// WatchNamespaces returns a watcher that polls the scoped namespaces and notifies the
+// changes since the last list or poll. Like a watch with selectors, a namespace that stops
+// matching the selectors is notified as deleted.
+func (n *NamespaceScopedRepository) WatchNamespaces(ctx context.Context, options metav1.ListOptions) (watch.Interface, error) {
+	selector, err := newNamespaceSelector(options)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan watch.Event)
+	w := watch.NewProxyWatcher(ch)
+
+	go func() {
+		defer close(ch)
+
+		t := time.NewTicker(n.pollInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-w.StopChan():
+				return
+			case <-t.C:
+			}
+
+			for _, name := range n.namespaces {
+				event, ok := n.poll(ctx, name, selector)
+				if !ok {
+					continue
+				}
+
+				select {
+				case ch <- event:
+				case <-ctx.Done():
+					return
+				case <-w.StopChan():
+					return
+				}
+			}
+		}
+	}()
+
+	return w, nil
+}
+
+// poll gets the namespace and returns the event if it changed since the last time it was seen,
+// the namespaces not matching the selector are handled as missing.
+func (n *NamespaceScopedRepository) poll(ctx context.Context, name string, selector namespaceSelector) (watch.Event, bool) {
+	ns, err := n.Repository.GetNamespace(ctx, name)
+	if err != nil && !kubeerrors.IsNotFound(err) {
+		// Retried on the next poll.
+		return watch.Event{}, false
+	}
+	if err == nil && !selector.matches(ns) {
+		err = kubeerrors.NewNotFound(corev1.Resource("namespaces"), name)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	rv, seen := n.seen[name]
+	switch {
+	case err != nil && seen:
+		delete(n.seen, name)
+		return watch.Event{Type: watch.Deleted, Object: &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, ResourceVersion: rv}}}, true
+	case err != nil:
+		return watch.Event{}, false
+	case !seen:
+		n.seen[name] = ns.ResourceVersion
+		return watch.Event{Type: watch.Added, Object: ns}, true
+	case rv != ns.ResourceVersion:
+		n.seen[name] = ns.ResourceVersion
+		return watch.Event{Type: watch.Modified, Object: ns}, true
+	}
+
+	return watch.Event{}, false
+}
+
+// GetNamespace returns the scoped namespace.
+func (n *NamespaceScopedRepository) GetNamespace(ctx context.Context, name string) (*corev1.Namespace, error) {
+	for _, ns := range n.namespaces {
+		if ns == name {
+			return n.Repository.GetNamespace(ctx, name)
+		}
+	}
+
+	return nil, kubeerrors.NewNotFound(corev1.Resource("namespaces"), name)
+}
@@ -0,0 +1,211 @@
+package kubernetes_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	storagekubernetes "github.com/slok/imagepull-controller-workshop/internal/storage/kubernetes"
+)
+
+// fakeAPIServer is a Kubernetes API server that only knows how to get namespaces.
+type fakeAPIServer struct {
+	mu         sync.Mutex
+	namespaces map[string]*corev1.Namespace
+}
+
+func (f *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/api/v1/namespaces/")
+	if r.Method != http.MethodGet || name == r.URL.Path || strings.Contains(name, "/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	f.mu.Lock()
+	ns, ok := f.namespaces[name]
+	f.mu.Unlock()
+
+	var obj interface{} = ns
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		status := kubeerrors.NewNotFound(corev1.Resource("namespaces"), name).ErrStatus
+		status.APIVersion, status.Kind = "v1", "Status"
+		obj = status
+		w.WriteHeader(http.StatusNotFound)
+	}
+	_ = json.NewEncoder(w).Encode(obj)
+}
+
+func (f *fakeAPIServer) set(ns *corev1.Namespace) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.namespaces[ns.Name] = ns
+}
+
+func newTestRepository(t *testing.T, api *fakeAPIServer) storagekubernetes.Repository {
+	srv := httptest.NewServer(api)
+	t.Cleanup(srv.Close)
+
+	kcli, err := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+	require.NoError(t, err)
+
+	return storagekubernetes.NewRepository(kcli)
+}
+
+func testNamespace(name, rv string, labels map[string]string) *corev1.Namespace {
+	return &corev1.Namespace{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Namespace"},
+		ObjectMeta: metav1.ObjectMeta{Name: name, ResourceVersion: rv, Labels: labels},
+	}
+}
+
+func TestNamespaceScopedRepositoryListNamespaces(t *testing.T) {
+	tests := map[string]struct {
+		options  metav1.ListOptions
+		expNames []string
+		expErr   bool
+	}{
+		"Without selectors all the existing scoped namespaces should be listed.": {
+			expNames: []string{"ns-1", "ns-2"},
+		},
+
+		"A label selector should list only the matching namespaces.": {
+			options:  metav1.ListOptions{LabelSelector: "team=a"},
+			expNames: []string{"ns-1"},
+		},
+
+		"A field selector should list only the matching namespaces.": {
+			options:  metav1.ListOptions{FieldSelector: "metadata.name=ns-2"},
+			expNames: []string{"ns-2"},
+		},
+
+		"An invalid label selector should fail.": {
+			options: metav1.ListOptions{LabelSelector: "team in"},
+			expErr:  true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			api := &fakeAPIServer{namespaces: map[string]*corev1.Namespace{
+				"ns-1":       testNamespace("ns-1", "1", map[string]string{"team": "a"}),
+				"ns-2":       testNamespace("ns-2", "1", map[string]string{"team": "b"}),
+				"not-scoped": testNamespace("not-scoped", "1", map[string]string{"team": "a"}),
+			}}
+			scoped, err := storagekubernetes.NewNamespaceScopedRepository(newTestRepository(t, api), storagekubernetes.NamespaceScopedRepositoryConfig{
+				Namespaces: []string{"ns-1", "ns-2", "missing"},
+			})
+			require.NoError(err)
+
+			nsl, err := scoped.ListNamespaces(context.TODO(), test.options)
+			if test.expErr {
+				assert.Error(err)
+				return
+			}
+			require.NoError(err)
+
+			names := []string{}
+			for _, ns := range nsl.Items {
+				names = append(names, ns.Name)
+			}
+			assert.Equal(test.expNames, names)
+		})
+	}
+}
+
+func TestNamespaceScopedRepositoryWatchNamespaces(t *testing.T) {
+	tests := map[string]struct {
+		options metav1.ListOptions
+		// change is the namespace after the list.
+		change    *corev1.Namespace
+		expEvents []watch.EventType
+	}{
+		"A namespace change should be notified.": {
+			change:    testNamespace("ns-1", "2", map[string]string{"team": "a", "other": "x"}),
+			expEvents: []watch.EventType{watch.Modified},
+		},
+
+		"A namespace that stops matching the label selector should be notified as deleted.": {
+			options:   metav1.ListOptions{LabelSelector: "team=a"},
+			change:    testNamespace("ns-1", "2", map[string]string{"team": "b"}),
+			expEvents: []watch.EventType{watch.Deleted},
+		},
+
+		"A namespace that starts matching the label selector should be notified as added.": {
+			options:   metav1.ListOptions{LabelSelector: "team=a"},
+			change:    testNamespace("ns-2", "2", map[string]string{"team": "a"}),
+			expEvents: []watch.EventType{watch.Added},
+		},
+
+		"A namespace change not matching the label selector should not be notified.": {
+			options: metav1.ListOptions{LabelSelector: "team=a"},
+			change:  testNamespace("ns-2", "2", map[string]string{"team": "c"}),
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			api := &fakeAPIServer{namespaces: map[string]*corev1.Namespace{
+				"ns-1": testNamespace("ns-1", "1", map[string]string{"team": "a"}),
+				"ns-2": testNamespace("ns-2", "1", map[string]string{"team": "b"}),
+			}}
+			scoped, err := storagekubernetes.NewNamespaceScopedRepository(newTestRepository(t, api), storagekubernetes.NamespaceScopedRepositoryConfig{
+				Namespaces:   []string{"ns-1", "ns-2"},
+				PollInterval: time.Millisecond,
+			})
+			require.NoError(err)
+
+			_, err = scoped.ListNamespaces(context.TODO(), test.options)
+			require.NoError(err)
+			api.set(test.change)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			w, err := scoped.WatchNamespaces(ctx, test.options)
+			require.NoError(err)
+			defer w.Stop()
+
+			gotEvents := []watch.EventType{}
+			timeout := time.After(50 * time.Millisecond)
+			for done := false; !done; {
+				select {
+				case e := <-w.ResultChan():
+					gotEvents = append(gotEvents, e.Type)
+					assert.Equal(test.change.Name, e.Object.(*corev1.Namespace).Name)
+				case <-timeout:
+					done = true
+				}
+			}
+
+			if test.expEvents == nil {
+				test.expEvents = []watch.EventType{}
+			}
+			assert.Equal(test.expEvents, gotEvents)
+		})
+	}
+}
+
+func TestNewNamespaceScopedRepositoryWithoutNamespaces(t *testing.T) {
+	_, err := storagekubernetes.NewNamespaceScopedRepository(storagekubernetes.Repository{}, storagekubernetes.NamespaceScopedRepositoryConfig{})
+	assert.Error(t, err)
+}
@@ -5,7 +5,11 @@ import (
 	"fmt"
 	"sync"
 
+	"go.opentelemetry.io/otel/attribute"
 	corev1 "k8s.io/api/core/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+
+	"github.com/slok/imagepull-controller-workshop/internal/tracing"
 )
 
 // SecretCachedRepository is a Kubernetes repository like `Repository` but getting a
@@ -13,26 +17,43 @@ import (
 type SecretCachedRepository struct {
 	mu      sync.RWMutex
 	secrets map[string]*corev1.Secret
+	sources map[string]bool
 	Repository
 }
 
-// NewSecretCachedRepository returns a new NewSecretCachedRepository.
-func NewSecretCachedRepository(repo Repository) *SecretCachedRepository {
+// NewSecretCachedRepository returns a new NewSecretCachedRepository. The source secrets
+// are only get from the cache, so the secrets rejected by the cache handlers (e.g
+// verification, expired) are not get from the API server.
+func NewSecretCachedRepository(repo Repository, sourceNamespace string, sourceNames []string) *SecretCachedRepository {
+	sources := map[string]bool{}
+	for _, name := range sourceNames {
+		sources[fmt.Sprintf("%s/%s", sourceNamespace, name)] = true
+	}
+
 	return &SecretCachedRepository{
 		Repository: repo,
 		secrets:    map[string]*corev1.Secret{},
+		sources:    sources,
 	}
 }
 
-// GetSecret will return a secret from the internal cache.
-func (s *SecretCachedRepository) GetSecret(ctx context.Context, ns string, name string) (*corev1.Secret, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// GetSecret will return a secret from the internal cache. If the secret is not cached,
+// the source secrets will return a service unavailable (transient) error, the rest will
+// fallback to the Kubernetes API server.
+func (s *SecretCachedRepository) GetSecret(ctx context.Context, ns string, name string) (_ *corev1.Secret, err error) {
+	ctx, span := tracing.Start(ctx, "storage.kubernetes.SecretCachedRepository.GetSecret", attribute.String("k8s.namespace", ns), attribute.String("k8s.name", name))
+	defer func() { tracing.End(span, err) }()
 
+	s.mu.RLock()
 	id := fmt.Sprintf("%s/%s", ns, name)
 	secret, ok := s.secrets[id]
+	s.mu.RUnlock()
+	span.SetAttributes(attribute.Bool("cache.hit", ok))
 	if !ok {
-		return nil, fmt.Errorf("secret not found")
+		if s.sources[id] {
+			return nil, kubeerrors.NewServiceUnavailable(fmt.Sprintf("source secret %s is not cached", id))
+		}
+		return s.Repository.GetSecret(ctx, ns, name)
 	}
 
 	// Deep copy because we don't want cache object mutations from the outside.
@@ -48,3 +69,25 @@ func (s *SecretCachedRepository) SetSecretOnCache(ctx context.Context, secret *c
 
 	return nil
 }
+
+// DeleteSecretFromCache removes a secret from the repository cache.
+func (s *SecretCachedRepository) DeleteSecretFromCache(ctx context.Context, secret *corev1.Secret) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.secrets, fmt.Sprintf("%s/%s", secret.Namespace, secret.Name))
+
+	return nil
+}
+
+// ListCachedSecrets returns the secrets stored on the repository cache.
+func (s *SecretCachedRepository) ListCachedSecrets(ctx context.Context) []*corev1.Secret {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	secrets := make([]*corev1.Secret, 0, len(s.secrets))
+	for _, secret := range s.secrets {
+		secrets = append(secrets, secret.DeepCopy())
+	}
+
+	return secrets
+}
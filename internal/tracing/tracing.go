@@ -0,0 +1,130 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/slok/imagepull-controller-workshop/internal/log"
+)
+
+const instrumentationName = "github.com/slok/imagepull-controller-workshop"
+
+// Exporter is the exporter used to send the traces.
+type Exporter string
+
+const (
+	// ExporterNone disables the tracing.
+	ExporterNone Exporter = "none"
+	// ExporterStdout writes the traces on a writer, useful for development and tests.
+	ExporterStdout Exporter = "stdout"
+	// ExporterOTLP sends the traces to an OTLP HTTP collector.
+	ExporterOTLP Exporter = "otlp"
+)
+
+// Exporters are the valid exporters.
+var Exporters = []Exporter{ExporterNone, ExporterStdout, ExporterOTLP}
+
+// Config is the tracing configuration.
+type Config struct {
+	ServiceName  string
+	Exporter     Exporter
+	OTLPEndpoint string
+	OTLPInsecure bool
+	Writer       io.Writer
+}
+
+func (c *Config) defaults() error {
+	if c.ServiceName == "" {
+		c.ServiceName = "imagepull-controller-workshop"
+	}
+
+	if c.Exporter == "" {
+		c.Exporter = ExporterNone
+	}
+
+	if c.Exporter == ExporterStdout && c.Writer == nil {
+		return fmt.Errorf("writer is required for stdout exporter")
+	}
+
+	return nil
+}
+
+// Setup sets the global tracer provider based on the configuration, it returns a func to
+// flush and stop the tracing.
+func Setup(ctx context.Context, config Config) (shutdown func(context.Context) error, err error) {
+	err = config.defaults()
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	var exporter sdktrace.SpanExporter
+	switch config.Exporter {
+	case ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(config.Writer))
+	case ExporterOTLP:
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(config.OTLPEndpoint)}
+		if config.OTLPInsecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("unknown %q exporter", config.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not create %q exporter: %w", config.Exporter, err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(config.ServiceName))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return tp.Shutdown, nil
+}
+
+// Start starts a new span using the global tracer provider.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End ends the span setting the outcome based on the received error.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.SetAttributes(attribute.String("outcome", "error"))
+	} else {
+		span.SetAttributes(attribute.String("outcome", "success"))
+	}
+	span.End()
+}
+
+// CtxWithLogValues returns a copy of the context with the trace information of the
+// context span set as log values.
+func CtxWithLogValues(ctx context.Context) context.Context {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return ctx
+	}
+
+	return log.CtxWithValues(ctx, log.Kv{
+		"trace-id": sc.TraceID().String(),
+		"span-id":  sc.SpanID().String(),
+	})
+}
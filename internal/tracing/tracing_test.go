@@ -0,0 +1,87 @@
+package tracing_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/slok/imagepull-controller-workshop/internal/log"
+	"github.com/slok/imagepull-controller-workshop/internal/tracing"
+)
+
+// exportedSpan is the stdout exporter span format.
+type exportedSpan struct {
+	Name        string
+	SpanContext struct {
+		TraceID string
+	}
+	Attributes []struct {
+		Key   string
+		Value struct {
+			Value string
+		}
+	}
+}
+
+func TestTracingStdout(t *testing.T) {
+	tests := map[string]struct {
+		err        error
+		expOutcome string
+	}{
+		"A span ended without error should be a success.": {
+			expOutcome: "success",
+		},
+
+		"A span ended with an error should be an error.": {
+			err:        fmt.Errorf("something"),
+			expOutcome: "error",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			var out bytes.Buffer
+			shutdown, err := tracing.Setup(context.TODO(), tracing.Config{
+				Exporter: tracing.ExporterStdout,
+				Writer:   &out,
+			})
+			require.NoError(err)
+
+			ctx, span := tracing.Start(context.TODO(), "test-span")
+			ctx = tracing.CtxWithLogValues(ctx)
+			tracing.End(span, test.err)
+
+			// The log values should have the span trace information.
+			sc := span.SpanContext()
+			kv := log.ValuesFromCtx(ctx)
+			assert.Equal(sc.TraceID().String(), kv["trace-id"])
+			assert.Equal(sc.SpanID().String(), kv["span-id"])
+
+			// Flush the spans to the writer.
+			require.NoError(shutdown(context.TODO()))
+			gotSpan := exportedSpan{}
+			require.NoError(json.Unmarshal(out.Bytes(), &gotSpan))
+			assert.Equal("test-span", gotSpan.Name)
+			assert.Equal(sc.TraceID().String(), gotSpan.SpanContext.TraceID)
+			require.Len(gotSpan.Attributes, 1)
+			assert.Equal("outcome", gotSpan.Attributes[0].Key)
+			assert.Equal(test.expOutcome, gotSpan.Attributes[0].Value.Value)
+		})
+	}
+}
+
+func TestCtxWithLogValuesWithoutSpan(t *testing.T) {
+	ctx := tracing.CtxWithLogValues(context.TODO())
+
+	kv := log.ValuesFromCtx(ctx)
+	assert.NotContains(t, kv, "trace-id")
+	assert.NotContains(t, kv, "span-id")
+}